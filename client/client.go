@@ -0,0 +1,322 @@
+// Package client registers services in the discovery server, keeps them alive
+// with heartbeats and caches the registry locally for lookups.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+	proto "github.com/ygaros/discovery-server/gen/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	DEFAULT_ADDRESS = "localhost:7654"
+	// Heartbeats are sent this many times per instance ttl.
+	HEARTBEATS_PER_TTL       = 3
+	DEFAULT_REFRESH_INTERVAL = 30 * time.Second
+	REQUEST_TIMEOUT          = 10 * time.Second
+)
+
+var ErrNoInstances = errors.New("[err] there arent any instances UP")
+
+type Config struct {
+	// Grpc address of the discovery server, DEFAULT_ADDRESS when empty.
+	Address string
+	// Insecure credentials are used unless DialOptions say otherwise.
+	DialOptions []grpc.DialOption
+	// How often the cached registry is refreshed, DEFAULT_REFRESH_INTERVAL when 0.
+	RefreshInterval time.Duration
+	// Bearer token sent with every call when the server authenticates them.
+	Token string
+}
+
+type Client struct {
+	conn      *grpc.ClientConn
+	discovery proto.DiscoveryClient
+	config    Config
+	ctx       context.Context
+	cancel    context.CancelFunc
+	done      sync.WaitGroup
+
+	// registry cache
+	lock      sync.RWMutex
+	revision  uint64
+	instances map[string]dto.ServiceHeartBeat
+}
+
+// Register adds service to the registry and heartbeats it in the background
+// until ctx is cancelled or the client is closed, then it's deregistered.
+func (c *Client) Register(ctx context.Context, service dto.Service) error {
+	ttl, err := c.register(ctx, service)
+	if err != nil {
+		return err
+	}
+	interval := ttl / HEARTBEATS_PER_TTL
+	c.done.Add(1)
+	go func() {
+		defer c.done.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				c.deregister(service)
+				return
+			case <-c.ctx.Done():
+				c.deregister(service)
+				return
+			case <-ticker.C:
+				// registering again may have changed the ttl
+				if ttl := c.heartBeat(service); ttl > 0 && ttl/HEARTBEATS_PER_TTL != interval {
+					interval = ttl / HEARTBEATS_PER_TTL
+					ticker.Reset(interval)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// register returns ttl the server expires service after, servers which
+// dont answer with one expire it after its own ttl or DELETION_TIME.
+func (c *Client) register(ctx context.Context, service dto.Service) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	registration, err := c.discovery.AddService(ctx, toProtoService(service))
+	if err != nil {
+		return 0, fmt.Errorf("[err] failed to register %s on %s: %w", service.Name, service.Url, err)
+	}
+	log.Printf("Registered %s on %s\n", service.Name, service.Url)
+	ttl := time.Duration(registration.GetTtl()) * time.Second
+	if ttl <= 0 {
+		ttl = time.Duration(service.Ttl) * time.Second
+	}
+	if ttl <= 0 {
+		ttl = discover.DELETION_TIME
+	}
+	return ttl, nil
+}
+
+// heartBeat registers service again when the server doesnt know it anymore,
+// e.g. after it was restarted or the instance expired. It returns ttl of
+// the new registration, 0 when service wasnt registered again.
+func (c *Client) heartBeat(service dto.Service) time.Duration {
+	ctx, cancel := context.WithTimeout(c.ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	_, err := c.discovery.HeartBeat(ctx, toProtoService(service))
+	if err == nil {
+		return 0
+	}
+	if status.Code(err) != codes.NotFound {
+		log.Printf("Failed to heartbeat %s on %s: %v\n", service.Name, service.Url, err)
+		return 0
+	}
+	log.Printf("Service %s on %s isnt registered anymore: %v\n", service.Name, service.Url, err)
+	ttl, err := c.register(c.ctx, service)
+	if err != nil {
+		log.Println(err)
+	}
+	return ttl
+}
+
+func (c *Client) deregister(service dto.Service) {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	_, err := c.discovery.Deregister(ctx, &proto.DeregisterRequest{Url: service.Url, Secure: service.Secure})
+	if err != nil {
+		log.Printf("Failed to deregister %s on %s: %v\n", service.Name, service.Url, err)
+		return
+	}
+	log.Printf("Deregistered %s on %s\n", service.Name, service.Url)
+}
+
+// GetService picks one of the cached serviceName instances which are UP.
+func (c *Client) GetService(serviceName string) (dto.ServiceHeartBeat, error) {
+	var up []dto.ServiceHeartBeat
+	for _, instance := range c.ListInstances(serviceName) {
+		if instance.Status == string(discover.UP) {
+			up = append(up, instance)
+		}
+	}
+	if len(up) == 0 {
+		return dto.ServiceHeartBeat{}, fmt.Errorf("%w: %s", ErrNoInstances, serviceName)
+	}
+	return up[rand.Intn(len(up))], nil
+}
+
+// ListInstances returns every cached instance of serviceName whatever its status is.
+func (c *Client) ListInstances(serviceName string) []dto.ServiceHeartBeat {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var result []dto.ServiceHeartBeat
+	for _, instance := range c.instances {
+		if instance.Name == serviceName {
+			result = append(result, instance)
+		}
+	}
+	return result
+}
+
+// Revision of the registry the cache is at.
+func (c *Client) Revision() uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.revision
+}
+
+// Refresh applies registry changes since the cached revision, the whole
+// registry is fetched again when the cache diverged from the server one.
+// The cache is kept as it is when the server is unreachable.
+func (c *Client) Refresh(ctx context.Context) error {
+	c.lock.RLock()
+	revision := c.revision
+	c.lock.RUnlock()
+	if revision > 0 {
+		err := c.fetch(ctx, revision)
+		if err == nil {
+			return nil
+		}
+		if status.Code(err) != codes.Unknown && !errors.Is(err, errDiverged) {
+			return err
+		}
+		log.Printf("Fetching whole registry: %v\n", err)
+	}
+	return c.fetch(ctx, 0)
+}
+
+var errDiverged = errors.New("[err] cached registry diverged from the server one")
+
+func (c *Client) fetch(ctx context.Context, revision uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	delta, err := c.discovery.GetDelta(ctx, &proto.DeltaRequest{Revision: revision})
+	if err != nil {
+		return err
+	}
+	instances := make(map[string]dto.ServiceHeartBeat)
+	c.lock.RLock()
+	if revision > 0 {
+		for id, instance := range c.instances {
+			instances[id] = instance
+		}
+	}
+	c.lock.RUnlock()
+	for _, event := range delta.Events {
+		if event.Type == proto.EventType_REMOVED {
+			delete(instances, event.Service.Id)
+		} else {
+			instances[event.Service.Id] = dto.ToServiceHeartBeat(event.Service)
+		}
+	}
+	list := make([]dto.ServiceHeartBeat, 0, len(instances))
+	for _, instance := range instances {
+		list = append(list, instance)
+	}
+	if hash := dto.RegistryHash(list); hash != delta.Hash {
+		return fmt.Errorf("%w: %s != %s", errDiverged, hash, delta.Hash)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.instances = instances
+	c.revision = delta.Revision
+	return nil
+}
+
+func (c *Client) refresh() {
+	defer c.done.Done()
+	ticker := time.NewTicker(c.config.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Refresh(c.ctx); err != nil && c.ctx.Err() == nil {
+				log.Println("Failed to refresh registry, serving cached one:", err)
+			}
+		}
+	}
+}
+
+// Close deregisters every registered service and stops refreshing the cache.
+func (c *Client) Close() error {
+	c.cancel()
+	c.done.Wait()
+	return c.conn.Close()
+}
+
+func toProtoService(service dto.Service) *proto.Service {
+	return &proto.Service{
+		Name:     service.Name,
+		Url:      service.Url,
+		Secure:   service.Secure,
+		Status:   proto.InstanceStatus(proto.InstanceStatus_value[service.Status]),
+		Metadata: service.Metadata,
+		Tags:     service.Tags,
+		Ttl:      service.Ttl,
+	}
+}
+
+// Creates client caching the registry right away, failing to do so
+// isnt an error as the server may come up later.
+func NewClient(config Config) (*Client, error) {
+	if len(config.Address) == 0 {
+		config.Address = DEFAULT_ADDRESS
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DEFAULT_REFRESH_INTERVAL
+	}
+	options := append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, config.DialOptions...)
+	if len(config.Token) > 0 {
+		options = append(options, grpc.WithPerRPCCredentials(TokenCredentials(config.Token)))
+	}
+	conn, err := grpc.Dial(config.Address, options...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{
+		conn:      conn,
+		discovery: proto.NewDiscoveryClient(conn),
+		config:    config,
+		ctx:       ctx,
+		cancel:    cancel,
+		instances: make(map[string]dto.ServiceHeartBeat),
+	}
+	if err := c.Refresh(ctx); err != nil {
+		log.Println("Failed to fetch registry:", err)
+	}
+	c.done.Add(1)
+	go c.refresh()
+	return c, nil
+}
+
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+// TokenCredentials sends token as bearer of every call, e.g. for the resolver
+// with grpc.WithPerRPCCredentials. It's sent over plaintext connections too
+// so tls should be used outside of local setups.
+func TokenCredentials(token string) credentials.PerRPCCredentials {
+	return tokenCredentials(token)
+}
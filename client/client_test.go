@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+	"github.com/ygaros/discovery-server/server"
+)
+
+// testServer is an in-process grpc discovery server on a local port.
+type testServer struct {
+	storage  discover.Storage
+	dservice server.DiscoveryService
+	grpc     server.GrpcServer
+	address  string
+}
+
+func newTestServer(t *testing.T, defaultTtl time.Duration) *testServer {
+	t.Helper()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{storage: discover.NewMultiMapStorage(), address: listen.Addr().String()}
+	listen.Close()
+	s.storage.Leases().SetDefaultTtl(defaultTtl)
+	s.dservice = server.NewDiscoveryService(s.storage)
+	s.grpc = server.NewDiscoveryGrpcServer(&s.dservice)
+	go s.grpc.ServeAddress(s.address)
+	t.Cleanup(s.stop)
+	return s
+}
+
+func (s *testServer) stop() {
+	s.grpc.Shutdown(context.Background())
+}
+
+func newTestClient(t *testing.T, address string) *Client {
+	t.Helper()
+	c, err := NewClient(Config{Address: address, RefreshInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// eventually polls condition until it holds or a few seconds pass.
+func eventually(t *testing.T, condition func() bool, format string, args ...interface{}) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf(format, args...)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientRegistersAndHeartbeats(t *testing.T) {
+	s := newTestServer(t, 3*time.Second)
+	c := newTestClient(t, s.address)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Register(ctx, dto.Service{Name: "orders", Url: "10.0.0.5:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	registered, err := s.storage.GetByUrl("http://10.0.0.5:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registeredAt := registered.LastHeartBeatCheck
+
+	// heartbeats are sent every second for the 3 second ttl
+	eventually(t, func() bool {
+		saved, err := s.storage.GetByUrl("http://10.0.0.5:8080")
+		return err == nil && saved.LastHeartBeatCheck.After(registeredAt)
+	}, "service wasnt heartbeated")
+
+	cancel()
+	eventually(t, func() bool {
+		_, err := s.storage.GetByUrl("http://10.0.0.5:8080")
+		return errors.Is(err, discover.ErrNotFound)
+	}, "service wasnt deregistered once ctx was cancelled")
+	if err := c.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientRegistersAgainWithNewTtl(t *testing.T) {
+	s := newTestServer(t, 3*time.Second)
+	c := newTestClient(t, s.address)
+	defer c.Close()
+	if err := c.Register(context.Background(), dto.Service{Name: "orders", Url: "10.0.0.5:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	// server forgot the instance and expires new ones after a minute
+	s.storage.Leases().SetDefaultTtl(time.Minute)
+	if err := s.dservice.Deregister(dto.Deregistration{Url: "10.0.0.5:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	var registered *discover.Service
+	eventually(t, func() bool {
+		saved, err := s.storage.GetByUrl("http://10.0.0.5:8080")
+		registered = saved
+		return err == nil
+	}, "service wasnt registered again after heartbeat was answered NotFound")
+
+	// heartbeats follow the new ttl so none is sent within the old interval
+	time.Sleep(1500 * time.Millisecond)
+	saved, err := s.storage.GetByUrl("http://10.0.0.5:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.LastHeartBeatCheck.Equal(registered.LastHeartBeatCheck) {
+		t.Errorf("service was heartbeated at %v after registering again at %v, want every 20s",
+			saved.LastHeartBeatCheck, registered.LastHeartBeatCheck)
+	}
+}
+
+func TestClientHeartBeatRegistersOnlyUnknownService(t *testing.T) {
+	s := newTestServer(t, time.Minute)
+	c := newTestClient(t, s.address)
+	defer c.Close()
+	service := dto.Service{Name: "orders", Url: "10.0.0.5:8080"}
+	if ttl := c.heartBeat(service); ttl != time.Minute {
+		t.Errorf("heartbeat of unknown service registered it with ttl %v, want %v", ttl, time.Minute)
+	}
+	if ttl := c.heartBeat(service); ttl != 0 {
+		t.Errorf("heartbeat of registered service registered it again with ttl %v", ttl)
+	}
+	// other failures dont register it again
+	s.stop()
+	if ttl := c.heartBeat(service); ttl != 0 {
+		t.Errorf("heartbeat of unreachable server registered service with ttl %v", ttl)
+	}
+}
+
+func TestClientRefreshesDeltaAndServesCacheOffline(t *testing.T) {
+	s := newTestServer(t, time.Minute)
+	if err := s.dservice.AddService(dto.Service{Name: "orders", Url: "10.0.0.5:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestClient(t, s.address)
+	defer c.Close()
+	if len(c.ListInstances("orders")) != 1 || c.Revision() != s.dservice.Revision() {
+		t.Fatalf("cached %d orders at %d, want 1 at %d", len(c.ListInstances("orders")), c.Revision(), s.dservice.Revision())
+	}
+
+	tests := []struct {
+		name   string
+		change func() error
+		orders int
+		up     int
+	}{
+		{"registration", func() error {
+			return s.dservice.AddService(dto.Service{Name: "orders", Url: "10.0.0.6:8080"})
+		}, 2, 2},
+		{"status", func() error {
+			return s.dservice.SetStatus(dto.ServiceStatus{Url: "10.0.0.5:8080", Status: "DOWN"})
+		}, 2, 1},
+		{"deregistration", func() error {
+			return s.dservice.Deregister(dto.Deregistration{Url: "10.0.0.6:8080"})
+		}, 1, 0},
+		{"registration again", func() error {
+			return s.dservice.AddService(dto.Service{Name: "orders", Url: "10.0.0.7:8080"})
+		}, 2, 1},
+	}
+	for _, test := range tests {
+		if err := test.change(); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Refresh(context.Background()); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		up := 0
+		for _, instance := range c.ListInstances("orders") {
+			if instance.Status == string(discover.UP) {
+				up++
+			}
+		}
+		if len(c.ListInstances("orders")) != test.orders || up != test.up || c.Revision() != s.dservice.Revision() {
+			t.Errorf("%s: cached %d orders with %d UP at %d, want %d with %d at %d",
+				test.name, len(c.ListInstances("orders")), up, c.Revision(), test.orders, test.up, s.dservice.Revision())
+		}
+	}
+
+	s.stop()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Refresh(ctx); err == nil {
+		t.Error("refresh from stopped server succeeded")
+	}
+	instance, err := c.GetService("orders")
+	if err != nil || instance.Url != "http://10.0.0.7:8080" {
+		t.Errorf("offline client picked %s, %v, want the cached UP instance", instance.Url, err)
+	}
+	if _, err := c.GetService("payments"); !errors.Is(err, ErrNoInstances) {
+		t.Errorf("offline client got %v for unknown service, want %v", err, ErrNoInstances)
+	}
+}
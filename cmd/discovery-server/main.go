@@ -0,0 +1,47 @@
+// Command discovery-server runs the discovery server.
+//
+//	discovery-server [-config discovery.yaml] [-grpc.address :7654] [-lease.defaultTtl 30s] ...
+//
+// Settings come from defaults, then the config file, then DISCOVERY_*
+// environment variables and then flags, see server.Config.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ygaros/discovery-server/server"
+)
+
+func main() {
+	flags := flag.NewFlagSet("discovery-server", flag.ExitOnError)
+	configFile := flags.String("config", os.Getenv(server.ENV_PREFIX+"CONFIG"), "yaml or json config file")
+	validate := flags.Bool("validate", false, "validate the config and exit")
+	applyFlags := server.RegisterConfigFlags(flags)
+	flags.Parse(os.Args[1:])
+
+	config := server.DefaultConfig()
+	if len(*configFile) > 0 {
+		if err := config.LoadFile(*configFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if err := config.LoadEnv(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := applyFlags(&config); err != nil {
+		log.Fatalln(err)
+	}
+	if err := config.Validate(); err != nil {
+		log.Fatalln(err)
+	}
+	if *validate {
+		fmt.Println("Config is valid")
+		return
+	}
+	if err := server.Run(config); err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ygaros/discovery-server/client"
+	"github.com/ygaros/discovery-server/dto"
+	proto "github.com/ygaros/discovery-server/gen/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const REQUEST_TIMEOUT = 10 * time.Second
+
+// backend talks to the discovery server over grpc or http.
+type backend interface {
+	Registry() (dto.RegistryDelta, error)
+	ListInstances(serviceName string) ([]dto.ServiceHeartBeat, error)
+	FindInstances(selector string) ([]dto.ServiceHeartBeat, error)
+	Register(service dto.Service) error
+	Deregister(service dto.Deregistration) error
+	SetStatus(service dto.ServiceStatus) error
+	Watch(ctx context.Context, serviceName string, revision uint64, send func(dto.ServiceEvent) error) error
+	Close() error
+}
+
+type grpcBackend struct {
+	conn      *grpc.ClientConn
+	discovery proto.DiscoveryClient
+}
+
+func (b *grpcBackend) Registry() (dto.RegistryDelta, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	delta, err := b.discovery.GetDelta(ctx, &proto.DeltaRequest{})
+	if err != nil {
+		return dto.RegistryDelta{}, err
+	}
+	result := dto.RegistryDelta{Revision: delta.Revision, Hash: delta.Hash}
+	for _, event := range delta.Events {
+		result.Events = append(result.Events, toServiceEvent(event))
+	}
+	return result, nil
+}
+
+func (b *grpcBackend) ListInstances(serviceName string) ([]dto.ServiceHeartBeat, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	response, err := b.discovery.ListInstances(ctx, &proto.GetServiceRequest{ServiceName: serviceName})
+	if err != nil {
+		return nil, err
+	}
+	return toServiceHeartBeats(response), nil
+}
+
+func (b *grpcBackend) FindInstances(selector string) ([]dto.ServiceHeartBeat, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	response, err := b.discovery.FindInstances(ctx, &proto.FindInstancesRequest{Selector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return toServiceHeartBeats(response), nil
+}
+
+func (b *grpcBackend) Register(service dto.Service) error {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	_, err := b.discovery.AddService(ctx, &proto.Service{
+		Name:     service.Name,
+		Url:      service.Url,
+		Secure:   service.Secure,
+		Status:   proto.InstanceStatus(proto.InstanceStatus_value[service.Status]),
+		Metadata: service.Metadata,
+		Tags:     service.Tags,
+		Ttl:      service.Ttl,
+	})
+	return err
+}
+
+func (b *grpcBackend) Deregister(service dto.Deregistration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	_, err := b.discovery.Deregister(ctx, &proto.DeregisterRequest{Id: service.Id, Url: service.Url, Secure: service.Secure})
+	return err
+}
+
+func (b *grpcBackend) SetStatus(service dto.ServiceStatus) error {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUEST_TIMEOUT)
+	defer cancel()
+	_, err := b.discovery.SetStatus(ctx, &proto.StatusRequest{
+		Url:    service.Url,
+		Secure: service.Secure,
+		Status: proto.InstanceStatus(proto.InstanceStatus_value[service.Status]),
+	})
+	return err
+}
+
+func (b *grpcBackend) Watch(ctx context.Context, serviceName string, revision uint64, send func(dto.ServiceEvent) error) error {
+	stream, err := b.discovery.Watch(ctx, &proto.WatchRequest{ServiceName: serviceName, Revision: revision})
+	if err != nil {
+		return err
+	}
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			// server ends streams when it shuts down
+			if ctx.Err() != nil || err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := send(toServiceEvent(event)); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *grpcBackend) Close() error {
+	return b.conn.Close()
+}
+
+func toServiceEvent(event *proto.WatchEvent) dto.ServiceEvent {
+	return dto.ServiceEvent{
+		Type:     event.Type.String(),
+		Revision: event.Revision,
+		Service:  dto.ToServiceHeartBeat(event.Service),
+	}
+}
+
+func toServiceHeartBeats(response *proto.ListServiceResponse) []dto.ServiceHeartBeat {
+	result := make([]dto.ServiceHeartBeat, 0, len(response.Services))
+	for _, service := range response.Services {
+		result = append(result, dto.ToServiceHeartBeat(service))
+	}
+	return result
+}
+
+type httpBackend struct {
+	url    string
+	client *http.Client
+	token  string
+}
+
+func (b *httpBackend) Registry() (delta dto.RegistryDelta, err error) {
+	err = b.do(http.MethodGet, "/delta?revision=0", nil, &delta)
+	return delta, err
+}
+
+func (b *httpBackend) ListInstances(serviceName string) (instances []dto.ServiceHeartBeat, err error) {
+	err = b.do(http.MethodGet, "/service/instances?serviceName="+url.QueryEscape(serviceName), nil, &instances)
+	return instances, err
+}
+
+func (b *httpBackend) FindInstances(selector string) (instances []dto.ServiceHeartBeat, err error) {
+	err = b.do(http.MethodGet, "/instances?selector="+url.QueryEscape(selector), nil, &instances)
+	return instances, err
+}
+
+func (b *httpBackend) Register(service dto.Service) error {
+	return b.do(http.MethodPost, "/register", service, nil)
+}
+
+func (b *httpBackend) Deregister(service dto.Deregistration) error {
+	return b.do(http.MethodDelete, "/register", service, nil)
+}
+
+func (b *httpBackend) SetStatus(service dto.ServiceStatus) error {
+	return b.do(http.MethodPut, "/status", service, nil)
+}
+
+// Watch follows the server-sent events feed.
+func (b *httpBackend) Watch(ctx context.Context, serviceName string, revision uint64, send func(dto.ServiceEvent) error) error {
+	query := url.Values{}
+	query.Set("serviceName", serviceName)
+	query.Set("revision", strconv.FormatUint(revision, 10))
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url+"/events?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	b.authorize(request)
+	// watching isnt limited by the request timeout
+	response, err := (&http.Client{Transport: b.client.Transport}).Do(request)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("[err] watch failed with %s", response.Status)
+	}
+	var eventType string
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data := strings.TrimPrefix(line, "data: ")
+			if eventType == "error" {
+				return fmt.Errorf("%s", data)
+			}
+			var event dto.ServiceEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				return err
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
+
+func (b *httpBackend) Close() error {
+	return nil
+}
+
+func (b *httpBackend) do(method string, path string, body interface{}, result interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		marshaled, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(marshaled)
+	}
+	request, err := http.NewRequest(method, b.url+path, payload)
+	if err != nil {
+		return err
+	}
+	b.authorize(request)
+	response, err := b.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("[err] %s %s failed with %s", method, path, response.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func (b *httpBackend) authorize(request *http.Request) {
+	if len(b.token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+b.token)
+	}
+}
+
+// newBackend connects over tls when tlsConfig isnt nil,
+// token is sent with every request when it isnt empty.
+func newBackend(transport string, address string, tlsConfig *tls.Config, token string) (backend, error) {
+	switch transport {
+	case "grpc":
+		if len(address) == 0 {
+			address = "localhost:7654"
+		}
+		creds := insecure.NewCredentials()
+		if tlsConfig != nil {
+			creds = credentials.NewTLS(tlsConfig)
+		}
+		options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+		if len(token) > 0 {
+			options = append(options, grpc.WithPerRPCCredentials(client.TokenCredentials(token)))
+		}
+		conn, err := grpc.Dial(address, options...)
+		if err != nil {
+			return nil, err
+		}
+		return &grpcBackend{conn: conn, discovery: proto.NewDiscoveryClient(conn)}, nil
+	case "http":
+		if len(address) == 0 {
+			address = "http://localhost:7655"
+		}
+		if !strings.Contains(address, "://") {
+			if tlsConfig != nil {
+				address = "https://" + address
+			} else {
+				address = "http://" + address
+			}
+		}
+		return &httpBackend{
+			url: strings.TrimSuffix(address, "/"),
+			client: &http.Client{
+				Timeout:   REQUEST_TIMEOUT,
+				Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			},
+			token: token,
+		}, nil
+	default:
+		return nil, fmt.Errorf("[err] unknown transport %s, grpc or http expected", transport)
+	}
+}
@@ -0,0 +1,501 @@
+// Command discoveryctl operates the discovery server registry.
+//
+//	discoveryctl [-server address] [-transport grpc|http] [-o table|json|yaml] [-token t] <command> [flags]
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/ygaros/discovery-server/dto"
+
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `Usage: discoveryctl [flags] <command> [command flags]
+
+Commands:
+  services                          list services with their instance counts
+  instances <service>|-selector s   list instances of a service or matching a selector
+  get <id|url>                      show one instance
+  register -name n -url u           register an instance
+  deregister <id|url>               deregister an instance
+  status <url> <status>             set status of an instance
+  watch [service]                   stream registry changes
+  export [-f file]                  write every instance
+  import [-f file]                  register every exported instance
+
+Flags:
+`
+
+const WATCH_ROW = "%-10s %-8s %-24s %-32s %s\n"
+
+type command func(b backend, out *printer, args []string) error
+
+var commands = map[string]command{
+	"services":   servicesCommand,
+	"instances":  instancesCommand,
+	"get":        getCommand,
+	"register":   registerCommand,
+	"deregister": deregisterCommand,
+	"status":     statusCommand,
+	"watch":      watchCommand,
+	"export":     exportCommand,
+	"import":     importCommand,
+}
+
+// options are the flags given before the command.
+type options struct {
+	address   string
+	transport string
+	output    string
+	caFile    string
+	certFile  string
+	keyFile   string
+	token     string
+}
+
+// parseArgs returns the options, command and its arguments, usage is
+// written to output when they are invalid.
+func parseArgs(args []string, output io.Writer) (options, command, []string, error) {
+	var o options
+	flags := flag.NewFlagSet("discoveryctl", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&o.address, "server", "", "server address, localhost:7654 for grpc and http://localhost:7655 for http by default")
+	flags.StringVar(&o.transport, "transport", "grpc", "grpc or http")
+	flags.StringVar(&o.output, "o", "table", "output format: table, json or yaml")
+	flags.StringVar(&o.caFile, "ca", "", "CA bundle verifying the server, enables tls")
+	flags.StringVar(&o.certFile, "cert", "", "client certificate for mutual tls")
+	flags.StringVar(&o.keyFile, "key", "", "client certificate key")
+	flags.StringVar(&o.token, "token", os.Getenv("DISCOVERY_TOKEN"), "bearer token, DISCOVERY_TOKEN by default")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return o, nil, nil, err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return o, nil, nil, errors.New("command is mandatory")
+	}
+	run, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(output, "unknown command %s\n\n", flags.Arg(0))
+		flags.Usage()
+		return o, nil, nil, fmt.Errorf("unknown command %s", flags.Arg(0))
+	}
+	return o, run, flags.Args()[1:], nil
+}
+
+func main() {
+	o, run, args, err := parseArgs(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	out, err := newPrinter(o.output, os.Stdout)
+	if err != nil {
+		fail(err)
+	}
+	tlsConfig, err := newTlsConfig(o.caFile, o.certFile, o.keyFile)
+	if err != nil {
+		fail(err)
+	}
+	b, err := newBackend(o.transport, o.address, tlsConfig, o.token)
+	if err != nil {
+		fail(err)
+	}
+	defer b.Close()
+	if err := run(b, out, args); err != nil {
+		fail(err)
+	}
+}
+
+// newTlsConfig returns nil without any of the files.
+func newTlsConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	if len(caFile) == 0 && len(certFile) == 0 {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caFile) > 0 {
+		content, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("there arent any certificates in %s", caFile)
+		}
+	}
+	if len(certFile) > 0 {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func servicesCommand(b backend, out *printer, _ []string) error {
+	registry, err := b.Registry()
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]map[string]int)
+	for _, event := range registry.Events {
+		if counts[event.Service.Name] == nil {
+			counts[event.Service.Name] = make(map[string]int)
+		}
+		counts[event.Service.Name][event.Service.Status]++
+	}
+	type service struct {
+		Name      string         `json:"name"`
+		Instances int            `json:"instances"`
+		Statuses  map[string]int `json:"statuses"`
+	}
+	var services []service
+	for name, statuses := range counts {
+		total := 0
+		for _, count := range statuses {
+			total += count
+		}
+		services = append(services, service{Name: name, Instances: total, Statuses: statuses})
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return out.print(services, []string{"NAME", "INSTANCES", "UP"}, func(row func(...interface{})) {
+		for _, service := range services {
+			row(service.Name, service.Instances, service.Statuses["UP"])
+		}
+	})
+}
+
+func instancesCommand(b backend, out *printer, args []string) error {
+	flags := flag.NewFlagSet("instances", flag.ContinueOnError)
+	selector := flags.String("selector", "", "selector e.g. 'version=2.*,zone in (a,b)'")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var instances []dto.ServiceHeartBeat
+	var err error
+	switch {
+	case len(*selector) > 0:
+		instances, err = b.FindInstances(*selector)
+	case flags.NArg() == 1:
+		instances, err = b.ListInstances(flags.Arg(0))
+	default:
+		return errors.New("service name or -selector is mandatory")
+	}
+	if err != nil {
+		return err
+	}
+	return printInstances(out, instances)
+}
+
+func getCommand(b backend, out *printer, args []string) error {
+	if len(args) != 1 {
+		return errors.New("instance id or url is mandatory")
+	}
+	registry, err := b.Registry()
+	if err != nil {
+		return err
+	}
+	for _, event := range registry.Events {
+		if matches(event.Service, args[0]) {
+			return out.print(event.Service, []string{"FIELD", "VALUE"}, func(row func(...interface{})) {
+				row("id", event.Service.Id)
+				row("name", event.Service.Name)
+				row("url", event.Service.Url)
+				row("status", event.Service.Status)
+				row("metadata", formatMetadata(event.Service.Metadata))
+				row("tags", strings.Join(event.Service.Tags, ","))
+				row("lastHeartBeat", event.Service.LastHeartBeat.Format(dto.TIME_FORMAT))
+			})
+		}
+	}
+	return fmt.Errorf("instance %s not found", args[0])
+}
+
+func registerCommand(b backend, _ *printer, args []string) error {
+	flags := flag.NewFlagSet("register", flag.ContinueOnError)
+	name := flags.String("name", "", "service name")
+	instanceUrl := flags.String("url", "", "instance url e.g. 10.0.0.5:8080")
+	secure := flags.Bool("secure", false, "https instance")
+	status := flags.String("status", "", "initial status, UP by default")
+	metadata := flags.String("metadata", "", "comma separated key=value pairs")
+	tags := flags.String("tags", "", "comma separated tags")
+	ttl := flags.Int64("ttl", 0, "seconds without heartbeat after which the instance expires")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if len(*name) == 0 || len(*instanceUrl) == 0 {
+		return errors.New("-name and -url are mandatory")
+	}
+	service := dto.Service{
+		Name:     *name,
+		Status:   strings.ToUpper(*status),
+		Metadata: parseMetadata(*metadata),
+		Tags:     splitList(*tags),
+		Ttl:      *ttl,
+	}
+	service.Url, service.Secure = splitUrl(*instanceUrl)
+	service.Secure = service.Secure || *secure
+	return b.Register(service)
+}
+
+func deregisterCommand(b backend, _ *printer, args []string) error {
+	if len(args) != 1 {
+		return errors.New("instance id or url is mandatory")
+	}
+	deregistration := dto.Deregistration{}
+	if strings.Contains(args[0], ":") || strings.Contains(args[0], ".") {
+		deregistration.Url, deregistration.Secure = splitUrl(args[0])
+	} else {
+		deregistration.Id = args[0]
+	}
+	return b.Deregister(deregistration)
+}
+
+func statusCommand(b backend, _ *printer, args []string) error {
+	if len(args) != 2 {
+		return errors.New("instance url and status are mandatory")
+	}
+	service := dto.ServiceStatus{Status: strings.ToUpper(args[1])}
+	service.Url, service.Secure = splitUrl(args[0])
+	return b.SetStatus(service)
+}
+
+func watchCommand(b backend, out *printer, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	revision := flags.Uint64("revision", 0, "replay changes after revision first")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if out.format == "table" {
+		// rows are printed as they come so columns are fixed width
+		fmt.Fprintf(out.writer, WATCH_ROW, "REVISION", "TYPE", "NAME", "URL", "STATUS")
+	}
+	return b.Watch(ctx, flags.Arg(0), *revision, func(event dto.ServiceEvent) error {
+		if out.format == "table" {
+			_, err := fmt.Fprintf(out.writer, WATCH_ROW, strconv.FormatUint(event.Revision, 10),
+				event.Type, event.Service.Name, event.Service.Url, event.Service.Status)
+			return err
+		}
+		return out.print(event, nil, nil)
+	})
+}
+
+func exportCommand(b backend, out *printer, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	file := flags.String("f", "", "file to write, stdout by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	registry, err := b.Registry()
+	if err != nil {
+		return err
+	}
+	instances := make([]dto.ServiceHeartBeat, 0, len(registry.Events))
+	for _, event := range registry.Events {
+		instances = append(instances, event.Service)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name+instances[i].Url < instances[j].Name+instances[j].Url
+	})
+	if len(*file) > 0 {
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out.writer = f
+	}
+	if out.format == "table" {
+		out.format = "json"
+	}
+	return out.print(instances, nil, nil)
+}
+
+func importCommand(b backend, _ *printer, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := flags.String("f", "", "file to read, stdin by default")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var input io.Reader = os.Stdin
+	if len(*file) > 0 {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+	content, err := io.ReadAll(input)
+	if err != nil {
+		return err
+	}
+	var instances []dto.ServiceHeartBeat
+	// yaml is a superset of json
+	if err := yaml.Unmarshal(content, &instances); err != nil {
+		return err
+	}
+	failed := 0
+	for _, instance := range instances {
+		service := dto.Service{
+			Name:     instance.Name,
+			Status:   instance.Status,
+			Metadata: instance.Metadata,
+			Tags:     instance.Tags,
+		}
+		service.Url, service.Secure = splitUrl(instance.Url)
+		if err := b.Register(service); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to import %s on %s: %v\n", instance.Name, instance.Url, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d instances werent imported", failed, len(instances))
+	}
+	return nil
+}
+
+func printInstances(out *printer, instances []dto.ServiceHeartBeat) error {
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Name+instances[i].Url < instances[j].Name+instances[j].Url
+	})
+	return out.print(instances, []string{"ID", "NAME", "URL", "STATUS", "TAGS", "LAST HEARTBEAT"}, func(row func(...interface{})) {
+		for _, instance := range instances {
+			row(instance.Id, instance.Name, instance.Url, instance.Status,
+				strings.Join(instance.Tags, ","), instance.LastHeartBeat.Format(dto.TIME_FORMAT))
+		}
+	})
+}
+
+func matches(instance dto.ServiceHeartBeat, idOrUrl string) bool {
+	if instance.Id == idOrUrl || instance.Url == idOrUrl {
+		return true
+	}
+	trimmed, _ := splitUrl(instance.Url)
+	return trimmed == idOrUrl
+}
+
+// splitUrl strips the scheme the server adds to registered urls itself.
+func splitUrl(instanceUrl string) (string, bool) {
+	if strings.HasPrefix(instanceUrl, "https://") {
+		return strings.TrimPrefix(instanceUrl, "https://"), true
+	}
+	return strings.TrimPrefix(instanceUrl, "http://"), false
+}
+
+func parseMetadata(value string) map[string]string {
+	if len(value) == 0 {
+		return nil
+	}
+	metadata := make(map[string]string)
+	for _, pair := range splitList(value) {
+		key, val, _ := strings.Cut(pair, "=")
+		metadata[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return metadata
+}
+
+func formatMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func splitList(value string) []string {
+	if len(value) == 0 {
+		return nil
+	}
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+type printer struct {
+	format string
+	writer io.Writer
+}
+
+// print writes value as json or yaml, rows of the table otherwise.
+// Table header is skipped without columns.
+func (p *printer) print(value interface{}, columns []string, rows func(row func(...interface{}))) error {
+	switch p.format {
+	case "json":
+		encoder := json.NewEncoder(p.writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case "yaml":
+		// through json so yaml keys match the json ones
+		marshaled, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		var generic interface{}
+		if err := json.Unmarshal(marshaled, &generic); err != nil {
+			return err
+		}
+		encoded, err := yaml.Marshal(generic)
+		if err != nil {
+			return err
+		}
+		if _, isList := generic.([]interface{}); !isList {
+			encoded = append([]byte("---\n"), encoded...)
+		}
+		_, err = p.writer.Write(encoded)
+		return err
+	}
+	table := tabwriter.NewWriter(p.writer, 0, 4, 2, ' ', 0)
+	if len(columns) > 0 {
+		fmt.Fprintln(table, strings.Join(columns, "\t"))
+	}
+	rows(func(values ...interface{}) {
+		cells := make([]string, len(values))
+		for i, value := range values {
+			cells[i] = fmt.Sprint(value)
+		}
+		fmt.Fprintln(table, strings.Join(cells, "\t"))
+	})
+	return table.Flush()
+}
+
+func newPrinter(format string, writer io.Writer) (*printer, error) {
+	switch format {
+	case "table", "json", "yaml":
+		return &printer{format: format, writer: writer}, nil
+	}
+	return nil, fmt.Errorf("unknown output %s, table, json or yaml expected", format)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ygaros/discovery-server/dto"
+	"github.com/ygaros/discovery-server/server"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		command string
+		options options
+		rest    []string
+		valid   bool
+	}{
+		{"defaults", []string{"services"}, "services",
+			options{transport: "grpc", output: "table"}, []string{}, true},
+		{"flags before command", []string{"-server", "10.0.0.1:7655", "-transport", "http", "-o", "yaml", "-token", "t", "instances", "orders"}, "instances",
+			options{address: "10.0.0.1:7655", transport: "http", output: "yaml", token: "t"}, []string{"orders"}, true},
+		{"command flags", []string{"register", "-name", "orders", "-url", "10.0.0.5:8080"}, "register",
+			options{transport: "grpc", output: "table"}, []string{"-name", "orders", "-url", "10.0.0.5:8080"}, true},
+		{"without command", []string{"-o", "json"}, "", options{}, nil, false},
+		{"unknown command", []string{"list"}, "", options{}, nil, false},
+		{"unknown flag", []string{"-verbose", "services"}, "", options{}, nil, false},
+	}
+	t.Setenv("DISCOVERY_TOKEN", "")
+	for _, test := range tests {
+		var usage bytes.Buffer
+		o, run, rest, err := parseArgs(test.args, &usage)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: parseArgs returned %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if err != nil {
+			if !strings.Contains(usage.String(), "Usage: discoveryctl") {
+				t.Errorf("%s: usage wasnt written, got %q", test.name, usage.String())
+			}
+			continue
+		}
+		if fmt.Sprintf("%p", run) != fmt.Sprintf("%p", commands[test.command]) {
+			t.Errorf("%s: parsed other command than %s", test.name, test.command)
+		}
+		if o != test.options || fmt.Sprint(rest) != fmt.Sprint(test.rest) {
+			t.Errorf("%s: parsed %+v with %v, want %+v with %v", test.name, o, rest, test.options, test.rest)
+		}
+	}
+
+	t.Setenv("DISCOVERY_TOKEN", "from-env")
+	if o, _, _, err := parseArgs([]string{"services"}, io.Discard); err != nil || o.token != "from-env" {
+		t.Errorf("token is %q, %v, want DISCOVERY_TOKEN", o.token, err)
+	}
+}
+
+// recordingBackend records registrations, other calls arent expected.
+type recordingBackend struct {
+	backend
+	registered []dto.Service
+}
+
+func (b *recordingBackend) Register(service dto.Service) error {
+	b.registered = append(b.registered, service)
+	return nil
+}
+
+func TestRegisterFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		want  dto.Service
+		valid bool
+	}{
+		{"mandatory flags", []string{"-name", "orders", "-url", "10.0.0.5:8080"},
+			dto.Service{Name: "orders", Url: "10.0.0.5:8080"}, true},
+		{"every flag", []string{"-name", "orders", "-url", "10.0.0.5:8080", "-secure", "-status", "starting",
+			"-metadata", "zone=a, version=2", "-tags", "blue,canary", "-ttl", "60"},
+			dto.Service{Name: "orders", Url: "10.0.0.5:8080", Secure: true, Status: "STARTING",
+				Metadata: map[string]string{"zone": "a", "version": "2"}, Tags: []string{"blue", "canary"}, Ttl: 60}, true},
+		{"https url", []string{"-name", "orders", "-url", "https://10.0.0.5"},
+			dto.Service{Name: "orders", Url: "10.0.0.5", Secure: true}, true},
+		{"without url", []string{"-name", "orders"}, dto.Service{}, false},
+		{"invalid ttl", []string{"-name", "orders", "-url", "10.0.0.5:8080", "-ttl", "minute"}, dto.Service{}, false},
+	}
+	for _, test := range tests {
+		b := &recordingBackend{}
+		err := registerCommand(b, nil, test.args)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: register returned %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if len(b.registered) != 1 || fmt.Sprintf("%+v", b.registered[0]) != fmt.Sprintf("%+v", test.want) {
+			t.Errorf("%s: registered %+v, want %+v", test.name, b.registered, test.want)
+		}
+	}
+}
+
+func TestPrinterFormats(t *testing.T) {
+	lastHeartBeat := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	instances := []dto.ServiceHeartBeat{
+		{Id: "2", Name: "payments", Url: "http://10.0.1.1:8080", Status: "DOWN", LastHeartBeat: lastHeartBeat},
+		{Id: "1", Name: "orders", Url: "http://10.0.0.5:8080", Status: "UP", Tags: []string{"blue", "canary"},
+			Metadata: map[string]string{"zone": "a"}, LastHeartBeat: lastHeartBeat},
+	}
+	formatted := lastHeartBeat.Format(dto.TIME_FORMAT)
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"table", "" +
+			"ID  NAME      URL                   STATUS  TAGS         LAST HEARTBEAT\n" +
+			"1   orders    http://10.0.0.5:8080  UP      blue,canary  " + formatted + "\n" +
+			"2   payments  http://10.0.1.1:8080  DOWN                 " + formatted + "\n"},
+		{"json", `[
+  {
+    "id": "1",
+    "name": "orders",
+    "url": "http://10.0.0.5:8080",
+    "status": "UP",
+    "metadata": {
+      "zone": "a"
+    },
+    "tags": [
+      "blue",
+      "canary"
+    ],
+    "lastHeartBeat": "2022-01-01T12:00:00Z"
+  },
+  {
+    "id": "2",
+    "name": "payments",
+    "url": "http://10.0.1.1:8080",
+    "status": "DOWN",
+    "lastHeartBeat": "2022-01-01T12:00:00Z"
+  }
+]
+`},
+		{"yaml", `- id: "1"
+  lastHeartBeat: "2022-01-01T12:00:00Z"
+  metadata:
+    zone: a
+  name: orders
+  status: UP
+  tags:
+    - blue
+    - canary
+  url: http://10.0.0.5:8080
+- id: "2"
+  lastHeartBeat: "2022-01-01T12:00:00Z"
+  name: payments
+  status: DOWN
+  url: http://10.0.1.1:8080
+`},
+	}
+	for _, test := range tests {
+		var output bytes.Buffer
+		out, err := newPrinter(test.format, &output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := printInstances(out, append([]dto.ServiceHeartBeat{}, instances...)); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != test.want {
+			t.Errorf("%s output is\n%s\nwant\n%s", test.format, output.String(), test.want)
+		}
+	}
+	if _, err := newPrinter("xml", io.Discard); err == nil {
+		t.Error("unknown output format was accepted")
+	}
+}
+
+// newTestHttpServer serves the http api routes discoveryctl uses.
+func newTestHttpServer(t *testing.T) (*httptest.Server, server.DiscoveryService) {
+	t.Helper()
+	dservice := server.NewDiscoveryServiceWithInMemoryStorage()
+	handler := server.NewHttpDiscoveryServer(&dservice)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			handler.Deregister(w, r)
+			return
+		}
+		handler.AddService(w, r)
+	})
+	mux.HandleFunc("/status", handler.SetStatus)
+	mux.HandleFunc("/delta", handler.GetDelta)
+	mux.HandleFunc("/service/instances", handler.ListInstances)
+	mux.HandleFunc("/instances", handler.FindInstances)
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s, dservice
+}
+
+// registryContents lists every instance without ids and heartbeats, sorted.
+func registryContents(t *testing.T, dservice server.DiscoveryService) []string {
+	t.Helper()
+	delta, err := dservice.GetDelta(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for _, event := range delta.Events {
+		service := event.Service
+		contents = append(contents, fmt.Sprintf("%s %s %s %s %v",
+			service.Name, service.Url, service.Status, formatMetadata(service.Metadata), service.Tags))
+	}
+	sort.Strings(contents)
+	return contents
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	source, exported := newTestHttpServer(t)
+	for _, service := range []dto.Service{
+		{Name: "orders", Url: "10.0.0.5:8080", Metadata: map[string]string{"zone": "a", "version": "2"}, Tags: []string{"blue"}},
+		{Name: "orders", Url: "10.0.0.6:8443", Secure: true, Status: "OUT_OF_SERVICE"},
+		{Name: "payments", Url: "10.0.1.1:8080", Status: "DOWN"},
+	} {
+		if err := exported.AddService(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := registryContents(t, exported)
+	for _, format := range []string{"table", "json", "yaml"} {
+		from, err := newBackend("http", source.URL, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(t.TempDir(), "registry")
+		out, _ := newPrinter(format, io.Discard)
+		if err := exportCommand(from, out, []string{"-f", file}); err != nil {
+			t.Fatalf("%s: export failed: %v", format, err)
+		}
+
+		target, imported := newTestHttpServer(t)
+		to, err := newBackend("http", strings.TrimPrefix(target.URL, "http://"), nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := importCommand(to, nil, []string{"-f", file}); err != nil {
+			t.Fatalf("%s: import failed: %v", format, err)
+		}
+		if got := registryContents(t, imported); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s: imported %q, want %q", format, got, want)
+		}
+		// importing again reports the duplicates
+		if err := importCommand(to, nil, []string{"-f", file}); err == nil {
+			t.Errorf("%s: importing the same instances again succeeded", format)
+		}
+	}
+}
+
+func TestHttpBackendWatchReportsErrors(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "id: 3\nevent: ADDED\ndata: {\"type\":\"ADDED\",\"revision\":3,\"service\":{\"name\":\"orders\"}}\n\n")
+		fmt.Fprint(w, "event: error\ndata: [err] revision 1 is compacted, oldest available 2\n\n")
+	}))
+	defer s.Close()
+	b, err := newBackend("http", s.URL, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []dto.ServiceEvent
+	err = b.Watch(context.Background(), "", 1, func(event dto.ServiceEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	if len(events) != 1 || events[0].Revision != 3 || events[0].Service.Name != "orders" {
+		t.Errorf("watched %+v, want ADDED of orders at 3", events)
+	}
+	if err == nil || !strings.Contains(err.Error(), "compacted") {
+		t.Errorf("watch returned %v, want the streamed error", err)
+	}
+}
@@ -0,0 +1,201 @@
+package discover
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	RANDOM               = "random"
+	ROUND_ROBIN          = "round-robin"
+	WEIGHTED_RANDOM      = "weighted-random"
+	POWER_OF_TWO_CHOICES = "power-of-two-choices"
+	CONSISTENT_HASH      = "consistent-hash"
+)
+
+// Metadata key holding instance weight for the weighted random balancer.
+const WEIGHT_METADATA_KEY = "weight"
+
+var ErrNoInstances = errors.New("[err] there arent any instances to pick from")
+
+// Balancer picks one of the registered instances of a service.
+// Key is supplied by the caller and may be empty.
+type Balancer interface {
+	Pick(serviceName string, instances []Service, key string) (*Service, error)
+}
+
+// WeightFunc returns relative weight of an instance, non positive weights
+// exclude the instance from weighted picks.
+type WeightFunc func(service Service) int
+
+func UniformWeight(Service) int {
+	return 1
+}
+
+// MetadataWeight reads weight from instance metadata, 1 when it's missing.
+func MetadataWeight(service Service) int {
+	weight, err := strconv.Atoi(service.Metadata[WEIGHT_METADATA_KEY])
+	if err != nil {
+		return 1
+	}
+	return weight
+}
+
+type randomBalancer struct{}
+
+func (b *randomBalancer) Pick(_ string, instances []Service, _ string) (*Service, error) {
+	if len(instances) == 0 {
+		return nil, ErrNoInstances
+	}
+	return &instances[rand.Intn(len(instances))], nil
+}
+
+type roundRobinBalancer struct {
+	next map[string]int
+	lock sync.Mutex
+}
+
+func (b *roundRobinBalancer) Pick(serviceName string, instances []Service, _ string) (*Service, error) {
+	if len(instances) == 0 {
+		return nil, ErrNoInstances
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	index := b.next[serviceName] % len(instances)
+	b.next[serviceName] = index + 1
+	return &instances[index], nil
+}
+
+type weightedRandomBalancer struct {
+	weight WeightFunc
+}
+
+func (b *weightedRandomBalancer) Pick(_ string, instances []Service, _ string) (*Service, error) {
+	total := 0
+	weights := make([]int, len(instances))
+	for i, instance := range instances {
+		if weight := b.weight(instance); weight > 0 {
+			weights[i] = weight
+			total += weight
+		}
+	}
+	if total == 0 {
+		return nil, ErrNoInstances
+	}
+	point := rand.Intn(total)
+	for i, weight := range weights {
+		if point < weight {
+			return &instances[i], nil
+		}
+		point -= weight
+	}
+	return &instances[len(instances)-1], nil
+}
+
+// powerOfTwoChoicesBalancer samples two instances
+// and picks the one handed out less often.
+type powerOfTwoChoicesBalancer struct {
+	picks map[string]map[uuid.UUID]uint64
+	lock  sync.Mutex
+}
+
+func (b *powerOfTwoChoicesBalancer) Pick(serviceName string, instances []Service, _ string) (*Service, error) {
+	if len(instances) == 0 {
+		return nil, ErrNoInstances
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	saved := b.picks[serviceName]
+	picks := make(map[uuid.UUID]uint64, len(instances))
+	for _, instance := range instances {
+		picks[instance.id] = saved[instance.id]
+	}
+	b.picks[serviceName] = picks
+
+	chosen := &instances[0]
+	if len(instances) > 1 {
+		first := rand.Intn(len(instances))
+		second := rand.Intn(len(instances) - 1)
+		if second >= first {
+			second++
+		}
+		chosen = &instances[first]
+		if picks[instances[second].id] < picks[chosen.id] {
+			chosen = &instances[second]
+		}
+	}
+	picks[chosen.id]++
+	return chosen, nil
+}
+
+// consistentHashBalancer uses rendezvous hashing so the same key
+// keeps landing on the same instance while it's registered.
+type consistentHashBalancer struct {
+	fallback Balancer
+}
+
+func (b *consistentHashBalancer) Pick(serviceName string, instances []Service, key string) (*Service, error) {
+	if key == "" {
+		return b.fallback.Pick(serviceName, instances, key)
+	}
+	if len(instances) == 0 {
+		return nil, ErrNoInstances
+	}
+	var chosen *Service
+	var highest uint64
+	for i := range instances {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte(instances[i].Url))
+		if score := hash.Sum64(); chosen == nil || score > highest {
+			chosen, highest = &instances[i], score
+		}
+	}
+	return chosen, nil
+}
+
+func NewRandomBalancer() Balancer {
+	return &randomBalancer{}
+}
+
+func NewRoundRobinBalancer() Balancer {
+	return &roundRobinBalancer{next: make(map[string]int)}
+}
+
+func NewWeightedRandomBalancer(weight WeightFunc) Balancer {
+	if weight == nil {
+		weight = UniformWeight
+	}
+	return &weightedRandomBalancer{weight: weight}
+}
+
+func NewPowerOfTwoChoicesBalancer() Balancer {
+	return &powerOfTwoChoicesBalancer{picks: make(map[string]map[uuid.UUID]uint64)}
+}
+
+// Callers without a key are balanced randomly.
+func NewConsistentHashBalancer() Balancer {
+	return &consistentHashBalancer{fallback: NewRandomBalancer()}
+}
+
+// Returns balancer registered under name, nil if there isnt any.
+func NewBalancer(name string) Balancer {
+	switch name {
+	case RANDOM, "":
+		return NewRandomBalancer()
+	case ROUND_ROBIN:
+		return NewRoundRobinBalancer()
+	case WEIGHTED_RANDOM:
+		return NewWeightedRandomBalancer(MetadataWeight)
+	case POWER_OF_TWO_CHOICES:
+		return NewPowerOfTwoChoicesBalancer()
+	case CONSISTENT_HASH:
+		return NewConsistentHashBalancer()
+	}
+	return nil
+}
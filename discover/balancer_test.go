@@ -0,0 +1,170 @@
+package discover
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testInstances(name string, size int) []Service {
+	instances := make([]Service, size)
+	for i := range instances {
+		instances[i] = NewService(name, fmt.Sprintf("localhost:%d", 8080+i), false)
+	}
+	return instances
+}
+
+func TestBalancersWithoutInstances(t *testing.T) {
+	for _, name := range []string{RANDOM, ROUND_ROBIN, WEIGHTED_RANDOM, POWER_OF_TWO_CHOICES, CONSISTENT_HASH} {
+		for _, key := range []string{"", "user-1"} {
+			_, err := NewBalancer(name).Pick("orders", nil, key)
+			if !errors.Is(err, ErrNoInstances) {
+				t.Errorf("%s with key %q returned %v, want %v", name, key, err, ErrNoInstances)
+			}
+		}
+	}
+}
+
+func TestNewBalancer(t *testing.T) {
+	tests := []struct {
+		name  string
+		known bool
+	}{
+		{"", true},
+		{RANDOM, true},
+		{ROUND_ROBIN, true},
+		{WEIGHTED_RANDOM, true},
+		{POWER_OF_TWO_CHOICES, true},
+		{CONSISTENT_HASH, true},
+		{"least-connections", false},
+	}
+	for _, test := range tests {
+		if got := NewBalancer(test.name) != nil; got != test.known {
+			t.Errorf("NewBalancer(%q) known = %v, want %v", test.name, got, test.known)
+		}
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	balancer := NewRoundRobinBalancer()
+	orders := testInstances("orders", 3)
+	payments := testInstances("payments", 2)
+	// every service keeps its own position
+	wantOrders := []int{0, 1, 2, 0, 1}
+	wantPayments := []int{0, 1, 0, 1, 0}
+	for i := range wantOrders {
+		picked, err := balancer.Pick("orders", orders, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if picked.Url != orders[wantOrders[i]].Url {
+			t.Errorf("orders pick %d is %s, want %s", i, picked.Url, orders[wantOrders[i]].Url)
+		}
+		picked, err = balancer.Pick("payments", payments, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if picked.Url != payments[wantPayments[i]].Url {
+			t.Errorf("payments pick %d is %s, want %s", i, picked.Url, payments[wantPayments[i]].Url)
+		}
+	}
+	// a shrunk instance list doesnt go out of range
+	if _, err := balancer.Pick("orders", orders[:1], ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWeightedRandomBalancer(t *testing.T) {
+	instances := testInstances("orders", 3)
+	instances[0].Metadata = map[string]string{WEIGHT_METADATA_KEY: "0"}
+	instances[1].Metadata = map[string]string{WEIGHT_METADATA_KEY: "3"}
+	instances[2].Metadata = map[string]string{WEIGHT_METADATA_KEY: "1"}
+	balancer := NewWeightedRandomBalancer(MetadataWeight)
+	picks := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		picked, err := balancer.Pick("orders", instances, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[picked.Url]++
+	}
+	if picks[instances[0].Url] != 0 {
+		t.Errorf("instance with weight 0 was picked %d times", picks[instances[0].Url])
+	}
+	if ratio := float64(picks[instances[1].Url]) / float64(picks[instances[2].Url]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("weight 3 to 1 was picked in ratio %.2f", ratio)
+	}
+
+	excluded := testInstances("orders", 2)
+	for i := range excluded {
+		excluded[i].Metadata = map[string]string{WEIGHT_METADATA_KEY: "-1"}
+	}
+	if _, err := balancer.Pick("orders", excluded, ""); !errors.Is(err, ErrNoInstances) {
+		t.Errorf("instances without weight returned %v, want %v", err, ErrNoInstances)
+	}
+}
+
+func TestMetadataWeight(t *testing.T) {
+	tests := []struct {
+		metadata map[string]string
+		want     int
+	}{
+		{nil, 1},
+		{map[string]string{WEIGHT_METADATA_KEY: "5"}, 5},
+		{map[string]string{WEIGHT_METADATA_KEY: "heavy"}, 1},
+		{map[string]string{WEIGHT_METADATA_KEY: "-2"}, -2},
+	}
+	for _, test := range tests {
+		if got := MetadataWeight(Service{Metadata: test.metadata}); got != test.want {
+			t.Errorf("MetadataWeight(%v) = %d, want %d", test.metadata, got, test.want)
+		}
+	}
+}
+
+func TestPowerOfTwoChoicesBalancer(t *testing.T) {
+	instances := testInstances("orders", 4)
+	balancer := NewPowerOfTwoChoicesBalancer()
+	picks := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		picked, err := balancer.Pick("orders", instances, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		picks[picked.Url]++
+	}
+	// the less picked of two samples keeps the spread tight
+	for _, instance := range instances {
+		if count := picks[instance.Url]; count < 90 || count > 110 {
+			t.Errorf("%s was picked %d times of 400", instance.Url, count)
+		}
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	instances := testInstances("orders", 5)
+	balancer := NewConsistentHashBalancer()
+	first, err := balancer.Pick("orders", instances, "user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		picked, _ := balancer.Pick("orders", instances, "user-1")
+		if picked.Url != first.Url {
+			t.Fatalf("key moved from %s to %s", first.Url, picked.Url)
+		}
+	}
+	// removing another instance keeps the key where it was
+	var remaining []Service
+	for _, instance := range instances {
+		if instance.Url == first.Url || len(remaining) < 2 {
+			remaining = append(remaining, instance)
+		}
+	}
+	picked, _ := balancer.Pick("orders", remaining, "user-1")
+	if picked.Url != first.Url {
+		t.Errorf("key moved from %s to %s after an other instance was removed", first.Url, picked.Url)
+	}
+	if _, err := balancer.Pick("orders", instances, ""); err != nil {
+		t.Errorf("pick without key failed: %v", err)
+	}
+}
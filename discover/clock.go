@@ -0,0 +1,75 @@
+package discover
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock drives lease expiry, ManualClock makes it deterministic in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var SystemClock Clock = systemClock{}
+
+// ManualClock only moves when advanced.
+type ManualClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []manualWaiter
+}
+
+type manualWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	deadline := c.now.Add(d)
+	if !deadline.After(c.now) {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, manualWaiter{deadline: deadline, c: ch})
+	return ch
+}
+
+// Advance moves the clock forward firing every After which is due.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.deadline.After(c.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		waiter.c <- c.now
+	}
+	c.waiters = pending
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
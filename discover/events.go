@@ -0,0 +1,327 @@
+package discover
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Number of past events kept for watchers resuming from a revision.
+	EVENT_HISTORY_SIZE = 4096
+	// Number of events buffered for a single watcher before it's dropped.
+	WATCHER_BUFFER_SIZE = 256
+)
+
+type EventType string
+
+const (
+	ADDED   EventType = "ADDED"
+	UPDATED EventType = "UPDATED"
+	REMOVED EventType = "REMOVED"
+)
+
+var ErrWatcherLagging = errors.New("[err] watcher couldnt keep up with registry changes")
+
+type Event struct {
+	Type     EventType
+	Revision uint64
+	Service  Service
+}
+
+// Watcher receives registry changes until it's closed.
+type Watcher struct {
+	serviceName string
+	events      chan Event
+	err         error
+	broadcaster *eventBroadcaster
+}
+
+// Events are closed when the watcher is closed or dropped for lagging behind.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns the reason the events were closed by the storage.
+func (w *Watcher) Err() error {
+	w.broadcaster.lock.Lock()
+	defer w.broadcaster.lock.Unlock()
+	return w.err
+}
+
+func (w *Watcher) Close() {
+	w.broadcaster.lock.Lock()
+	defer w.broadcaster.lock.Unlock()
+	w.broadcaster.drop(w, nil)
+}
+
+func (w *Watcher) matches(event Event) bool {
+	return w.serviceName == "" || w.serviceName == event.Service.Name
+}
+
+// Delta holds registry changes after a revision, only the latest
+// change of every instance is kept. ADDED and UPDATED replace the instance.
+type Delta struct {
+	Revision uint64
+	Events   []Event
+	// Hash of the whole registry at Revision, see RegistryHash.
+	Hash string
+}
+
+// eventBroadcaster numbers registry changes with revisions
+// and fans them out to watchers.
+type eventBroadcaster struct {
+	lock     sync.Mutex
+	revision uint64
+	// ring buffer of the latest events, next is overwritten once it's full
+	history  []Event
+	next     int
+	watchers map[*Watcher]struct{}
+	// revision every service last changed at
+	services map[string]uint64
+	// registry state at revision for full fetches and its hash
+	instances map[uuid.UUID]Service
+	hash      uint64
+	// changes instances as events and deltas show them, e.g. unhealthy ones
+	// DOWN, stored keeps them as they were published
+	view   func(service Service) Service
+	stored map[uuid.UUID]Service
+}
+
+// eventSource is implemented by storages publishing
+// their changes through an eventBroadcaster.
+type eventSource interface {
+	broadcaster() *eventBroadcaster
+}
+
+func (b *eventBroadcaster) publish(eventType EventType, service Service) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if eventType == REMOVED {
+		delete(b.stored, service.id)
+	} else {
+		b.stored[service.id] = service
+		service = b.show(service)
+	}
+	_, known := b.instances[service.id]
+	if eventType == REMOVED && !known {
+		return
+	}
+	if eventType == UPDATED && !known {
+		eventType = ADDED
+	}
+	b.emit(eventType, service)
+}
+
+// touch updates the instance without publishing it, e.g. on heartbeats
+// which dont change anything watchers or the registry hash care about.
+func (b *eventBroadcaster) touch(service Service) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.instances[service.id]; ok {
+		b.stored[service.id] = service
+		b.instances[service.id] = b.show(service)
+	}
+}
+
+// overlay sets view, refresh has to be called whenever its result changes.
+func (b *eventBroadcaster) overlay(view func(service Service) Service) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.view = view
+}
+
+// refresh publishes the instance as UPDATED when view changed its status.
+func (b *eventBroadcaster) refresh(serviceId uuid.UUID) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	service, ok := b.stored[serviceId]
+	if !ok {
+		return
+	}
+	if shown := b.show(service); shown.Status != b.instances[serviceId].Status {
+		b.emit(UPDATED, shown)
+	}
+}
+
+// show has to be called with lock held.
+func (b *eventBroadcaster) show(service Service) Service {
+	if b.view == nil {
+		return service
+	}
+	return b.view(service)
+}
+
+// emit has to be called with lock held.
+func (b *eventBroadcaster) emit(eventType EventType, service Service) {
+	b.revision++
+	b.services[service.Name] = b.revision
+	event := Event{Type: eventType, Revision: b.revision, Service: service}
+	if saved, ok := b.instances[service.id]; ok {
+		b.hash ^= InstanceHash(saved.id.String(), saved.Name, saved.Url, string(saved.Status))
+	}
+	if eventType == REMOVED {
+		delete(b.instances, service.id)
+	} else {
+		b.instances[service.id] = service
+		b.hash ^= InstanceHash(service.id.String(), service.Name, service.Url, string(service.Status))
+	}
+	if len(b.history) < EVENT_HISTORY_SIZE {
+		b.history = append(b.history, event)
+	} else {
+		b.history[b.next] = event
+		b.next = (b.next + 1) % EVENT_HISTORY_SIZE
+	}
+	for watcher := range b.watchers {
+		if !watcher.matches(event) {
+			continue
+		}
+		select {
+		case watcher.events <- event:
+		default:
+			b.drop(watcher, ErrWatcherLagging)
+		}
+	}
+}
+
+// watch subscribes to changes of serviceName, all services when empty.
+// Events newer than revision are replayed first, 0 means only new events.
+func (b *eventBroadcaster) watch(serviceName string, revision uint64) (*Watcher, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var missed []Event
+	if revision > 0 {
+		var err error
+		if missed, err = b.since(revision); err != nil {
+			return nil, err
+		}
+	}
+	watcher := &Watcher{
+		serviceName: serviceName,
+		broadcaster: b,
+	}
+	size := WATCHER_BUFFER_SIZE
+	if len(missed) > size {
+		size = len(missed) + WATCHER_BUFFER_SIZE
+	}
+	watcher.events = make(chan Event, size)
+	for _, event := range missed {
+		if watcher.matches(event) {
+			watcher.events <- event
+		}
+	}
+	b.watchers[watcher] = struct{}{}
+	return watcher, nil
+}
+
+func (b *eventBroadcaster) current() uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.revision
+}
+
+// serviceRevision returns revision serviceName last changed at,
+// the registry one when it's empty.
+func (b *eventBroadcaster) serviceRevision(serviceName string) uint64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if serviceName == "" {
+		return b.revision
+	}
+	return b.services[serviceName]
+}
+
+// delta returns changes after revision, every instance as ADDED when it's 0.
+func (b *eventBroadcaster) delta(revision uint64) (*Delta, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delta := &Delta{Revision: b.revision, Hash: formatHash(b.hash)}
+	if revision == 0 {
+		for _, service := range b.instances {
+			delta.Events = append(delta.Events, Event{Type: ADDED, Revision: b.revision, Service: service})
+		}
+		return delta, nil
+	}
+	events, err := b.since(revision)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[uuid.UUID]int)
+	for _, event := range events {
+		if index, ok := latest[event.Service.id]; ok {
+			delta.Events[index] = event
+			continue
+		}
+		latest[event.Service.id] = len(delta.Events)
+		delta.Events = append(delta.Events, event)
+	}
+	sort.Slice(delta.Events, func(i, j int) bool {
+		return delta.Events[i].Revision < delta.Events[j].Revision
+	})
+	return delta, nil
+}
+
+// since returns events after revision oldest first, lock has to be held.
+// Every revision is in the history until it's overwritten so they are
+// the last ones of the ring buffer.
+func (b *eventBroadcaster) since(revision uint64) ([]Event, error) {
+	if revision > b.revision {
+		return nil, fmt.Errorf("[err] revision %d is newer than current %d", revision, b.revision)
+	}
+	missed := b.revision - revision
+	if missed > uint64(len(b.history)) {
+		return nil, fmt.Errorf("[err] revision %d is compacted, oldest available %d", revision, b.revision-uint64(len(b.history)))
+	}
+	events := make([]Event, 0, missed)
+	for i := len(b.history) - int(missed); i < len(b.history); i++ {
+		events = append(events, b.history[(b.next+i)%len(b.history)])
+	}
+	return events, nil
+}
+
+// InstanceHash is the instance part of the registry hash.
+func InstanceHash(id string, name string, url string, status string) uint64 {
+	hash := fnv.New64a()
+	for _, field := range []string{id, name, url, status} {
+		hash.Write([]byte(field))
+		hash.Write([]byte{0})
+	}
+	return hash.Sum64()
+}
+
+// RegistryHash is a xor of InstanceHash of every instance, so clients
+// can compare their copy with the server one in any order.
+func RegistryHash(instances []Service) string {
+	var hash uint64
+	for _, instance := range instances {
+		hash ^= InstanceHash(instance.id.String(), instance.Name, instance.Url, string(instance.Status))
+	}
+	return formatHash(hash)
+}
+
+func formatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// drop has to be called with lock held.
+func (b *eventBroadcaster) drop(watcher *Watcher, err error) {
+	if _, ok := b.watchers[watcher]; !ok {
+		return
+	}
+	delete(b.watchers, watcher)
+	watcher.err = err
+	close(watcher.events)
+}
+
+func newEventBroadcaster() *eventBroadcaster {
+	return &eventBroadcaster{
+		watchers:  make(map[*Watcher]struct{}),
+		services:  make(map[string]uint64),
+		instances: make(map[uuid.UUID]Service),
+		stored:    make(map[uuid.UUID]Service),
+	}
+}
@@ -0,0 +1,143 @@
+package discover
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHeartBeatKeepsRevision(t *testing.T) {
+	s := NewMultiMapStorage()
+	service := NewService("orders", "localhost:8080", false)
+	if err := s.Add(service); err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := s.Watch("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	revision := s.Revision()
+	beat := service.LastHeartBeatCheck.Add(time.Second)
+	if err := s.UpdateLastHeartBeat(service, beat); err != nil {
+		t.Fatal(err)
+	}
+	if s.Revision() != revision {
+		t.Errorf("heartbeat moved revision from %d to %d", revision, s.Revision())
+	}
+	noEvent(t, watcher)
+	full, err := s.Delta(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(full.Events) != 1 || !full.Events[0].Service.LastHeartBeatCheck.Equal(beat) {
+		t.Errorf("full delta %+v doesnt have the last heartbeat %v", full.Events, beat)
+	}
+	if err := s.UpdateStatus(service.Id(), DOWN); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, watcher); event.Type != UPDATED || event.Revision != revision+1 {
+		t.Errorf("got %s at %d, want %s at %d", event.Type, event.Revision, UPDATED, revision+1)
+	}
+}
+
+func TestDeltaKeepsLatestChanges(t *testing.T) {
+	s := NewMultiMapStorage()
+	orders := NewService("orders", "localhost:8080", false)
+	payments := NewService("payments", "localhost:8081", false)
+	for _, service := range []Service{orders, payments} {
+		if err := s.Add(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.UpdateStatus(orders.Id(), DOWN); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove(payments.Name, payments.Id()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		revision uint64
+		want     []EventType
+	}{
+		{1, []EventType{UPDATED, REMOVED}},
+		{2, []EventType{UPDATED, REMOVED}},
+		{3, []EventType{REMOVED}},
+		{4, nil},
+	}
+	for _, test := range tests {
+		delta, err := s.Delta(test.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []EventType
+		for i, event := range delta.Events {
+			got = append(got, event.Type)
+			if i > 0 && event.Revision < delta.Events[i-1].Revision {
+				t.Errorf("delta after %d isnt ordered by revision", test.revision)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("delta after %d is %v, want %v", test.revision, got, test.want)
+		}
+		if delta.Revision != 4 {
+			t.Errorf("delta after %d is at revision %d, want 4", test.revision, delta.Revision)
+		}
+	}
+	if _, err := s.Delta(5); err == nil {
+		t.Error("delta after future revision didnt fail")
+	}
+	saved, err := s.GetById(orders.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	delta, _ := s.Delta(0)
+	if want := RegistryHash([]Service{*saved}); delta.Hash != want {
+		t.Errorf("hash is %s, want %s", delta.Hash, want)
+	}
+}
+
+func TestRegistryHashIgnoresOrder(t *testing.T) {
+	instances := testInstances("orders", 3)
+	reversed := []Service{instances[2], instances[1], instances[0]}
+	if RegistryHash(instances) != RegistryHash(reversed) {
+		t.Error("hash depends on the order of instances")
+	}
+	down := append([]Service(nil), instances...)
+	down[0].Status = DOWN
+	if RegistryHash(instances) == RegistryHash(down) {
+		t.Error("hash doesnt change with status")
+	}
+}
+
+func TestEventHistoryWrapsAround(t *testing.T) {
+	b := newEventBroadcaster()
+	service := NewService("orders", "localhost:8080", false)
+	b.publish(ADDED, service)
+	for i := 1; i < EVENT_HISTORY_SIZE+10; i++ {
+		b.publish(UPDATED, service)
+	}
+	current := b.current()
+	oldest := current - EVENT_HISTORY_SIZE
+	if _, err := b.delta(oldest - 1); err == nil {
+		t.Errorf("delta after overwritten revision %d didnt fail", oldest-1)
+	}
+	delta, err := b.delta(oldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Events) != 1 || delta.Events[0].Revision != current {
+		t.Errorf("delta after %d is %+v, want the latest event only", oldest, delta.Events)
+	}
+	watcher, err := b.watch("", current-3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	for revision := current - 2; revision <= current; revision++ {
+		if event := nextEvent(t, watcher); event.Revision != revision {
+			t.Errorf("replayed revision %d, want %d", event.Revision, revision)
+		}
+	}
+	noEvent(t, watcher)
+}
@@ -0,0 +1,450 @@
+package discover
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	SNAPSHOT_INTERVAL  = 5 * time.Minute
+	SNAPSHOT_THRESHOLD = 1000
+	// longest write-ahead log record, larger registrations are rejected
+	MAX_RECORD_SIZE = 4 << 20
+
+	walFileName      = "registry.wal"
+	snapshotFileName = "registry.snapshot"
+)
+
+const (
+	opAdd       = "add"
+	opRemove    = "remove"
+	opHeartBeat = "heartbeat"
+	opStatus    = "status"
+)
+
+// record is a single line of the write-ahead log. Snapshots are stored
+// as a json array of add records.
+type record struct {
+	Op            string            `json:"op"`
+	Id            uuid.UUID         `json:"id"`
+	Name          string            `json:"name,omitempty"`
+	Url           string            `json:"url,omitempty"`
+	Status        Status            `json:"status,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Ttl           time.Duration     `json:"ttl,omitempty"`
+	LastHeartBeat time.Time         `json:"lastHeartBeat"`
+}
+
+func toRecord(op string, service Service) record {
+	return record{
+		Op:            op,
+		Id:            service.id,
+		Name:          service.Name,
+		Url:           service.Url,
+		Status:        service.Status,
+		Metadata:      service.Metadata,
+		Tags:          service.Tags,
+		Ttl:           service.Ttl,
+		LastHeartBeat: service.LastHeartBeatCheck,
+	}
+}
+
+func (r record) toService() Service {
+	status := r.Status
+	if status == "" {
+		status = UP
+	}
+	return Service{
+		id:                 r.Id,
+		Name:               r.Name,
+		Url:                r.Url,
+		Status:             status,
+		Metadata:           r.Metadata,
+		Tags:               r.Tags,
+		Ttl:                r.Ttl,
+		LastHeartBeatCheck: r.LastHeartBeat,
+	}
+}
+
+// fileStorage keeps the registry in memory and persists every mutation
+// to an append-only log in dir. The log is periodically compacted into
+// a snapshot and both are replayed on startup.
+type fileStorage struct {
+	storage *multiMapStorage
+	dir     string
+	wal     *os.File
+	entries int
+	lock    sync.Mutex
+	quit    chan bool
+	once    sync.Once
+	err     error
+}
+
+func (s *fileStorage) Add(service Service) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.storage.Add(service); err != nil {
+		return err
+	}
+	if err := s.append(toRecord(opAdd, service)); err != nil {
+		// memory must not hold what the log doesnt
+		s.storage.Remove(service.Name, service.id)
+		return err
+	}
+	return nil
+}
+
+func (s *fileStorage) Remove(serviceName string, serviceId uuid.UUID) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(serviceName, serviceId)
+}
+
+// remove has to be called with lock held.
+func (s *fileStorage) remove(serviceName string, serviceId uuid.UUID) error {
+	saved, err := s.storage.GetById(serviceId)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.Remove(serviceName, serviceId); err != nil {
+		return err
+	}
+	if err := s.append(record{Op: opRemove, Id: serviceId, Name: serviceName}); err != nil {
+		s.storage.Add(*saved)
+		return err
+	}
+	return nil
+}
+
+func (s *fileStorage) Get(serviceName string) (*Service, error) {
+	return s.storage.Get(serviceName)
+}
+
+func (s *fileStorage) ListInstances(serviceName string) ([]Service, error) {
+	return s.storage.ListInstances(serviceName)
+}
+
+func (s *fileStorage) FindInstances(selector Selector) ([]Service, error) {
+	return s.storage.FindInstances(selector)
+}
+
+func (s *fileStorage) GetById(serviceId uuid.UUID) (*Service, error) {
+	return s.storage.GetById(serviceId)
+}
+
+func (s *fileStorage) GetByUrl(serviceUrl string) (*Service, error) {
+	return s.storage.GetByUrl(serviceUrl)
+}
+
+func (s *fileStorage) GetAllServices() ([]Service, error) {
+	return s.storage.GetAllServices()
+}
+
+func (s *fileStorage) Watch(serviceName string, revision uint64) (*Watcher, error) {
+	return s.storage.Watch(serviceName, revision)
+}
+
+func (s *fileStorage) Revision() uint64 {
+	return s.storage.events.current()
+}
+
+func (s *fileStorage) ServiceRevision(serviceName string) uint64 {
+	return s.storage.events.serviceRevision(serviceName)
+}
+
+func (s *fileStorage) Delta(revision uint64) (*Delta, error) {
+	return s.storage.events.delta(revision)
+}
+
+func (s *fileStorage) broadcaster() *eventBroadcaster {
+	return s.storage.events
+}
+
+func (s *fileStorage) Leases() *LeaseManager {
+	return s.storage.leases
+}
+
+func (s *fileStorage) UpdateLastHeartBeat(service Service, newTime time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	saved, err := s.storage.GetByUrl(service.Url)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.UpdateLastHeartBeat(service, newTime); err != nil {
+		return err
+	}
+	service.LastHeartBeatCheck = newTime
+	if err := s.append(toRecord(opHeartBeat, service)); err != nil {
+		s.storage.UpdateLastHeartBeat(service, saved.LastHeartBeatCheck)
+		return err
+	}
+	return nil
+}
+
+func (s *fileStorage) UpdateStatus(serviceId uuid.UUID, status Status) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	saved, err := s.storage.GetById(serviceId)
+	if err != nil {
+		return err
+	}
+	if err := s.storage.UpdateStatus(serviceId, status); err != nil {
+		return err
+	}
+	if err := s.append(record{Op: opStatus, Id: serviceId, Status: status}); err != nil {
+		s.storage.UpdateStatus(serviceId, saved.Status)
+		return err
+	}
+	return nil
+}
+
+// Snapshot compacts the write-ahead log into a new snapshot file.
+func (s *fileStorage) Snapshot() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.snapshot()
+}
+
+// Close writes a final snapshot and stops the compaction loop.
+// Later calls return the result of the first one.
+func (s *fileStorage) Close() error {
+	s.once.Do(func() {
+		close(s.quit)
+		s.storage.Close()
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if err := s.snapshot(); err != nil {
+			s.err = err
+			return
+		}
+		s.err = s.wal.Close()
+		s.wal = nil
+	})
+	return s.err
+}
+
+// append writes rec to the log. When it fails the log is cut back to
+// where it was so a torn record isnt followed by later ones.
+func (s *fileStorage) append(rec record) error {
+	if s.wal == nil {
+		return errors.New("[err] write-ahead log is closed")
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if len(line) >= MAX_RECORD_SIZE {
+		return fmt.Errorf("[err] write-ahead log record of %d bytes exceeds %d", len(line), MAX_RECORD_SIZE)
+	}
+	info, err := s.wal.Stat()
+	if err != nil {
+		return fmt.Errorf("[err] failed to append to write-ahead log: %w", err)
+	}
+	if _, err := s.wal.Write(append(line, '\n')); err != nil {
+		s.wal.Truncate(info.Size())
+		return fmt.Errorf("[err] failed to append to write-ahead log: %w", err)
+	}
+	if err := s.wal.Sync(); err != nil {
+		s.wal.Truncate(info.Size())
+		return fmt.Errorf("[err] failed to sync write-ahead log: %w", err)
+	}
+	s.entries++
+	if s.entries >= SNAPSHOT_THRESHOLD {
+		// the record is already durable, a failed compaction is retried later
+		if err := s.snapshot(); err != nil {
+			log.Println(err)
+		}
+	}
+	return nil
+}
+
+func (s *fileStorage) snapshot() error {
+	if s.wal == nil {
+		return errors.New("[err] write-ahead log is closed")
+	}
+	var records []record
+	for _, service := range s.storage.instances() {
+		records = append(records, toRecord(opAdd, service))
+	}
+	content, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, snapshotFileName)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, content); err != nil {
+		return fmt.Errorf("[err] failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("[err] failed to replace snapshot: %w", err)
+	}
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("[err] failed to truncate write-ahead log: %w", err)
+	}
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.entries = 0
+	log.Printf("Snapshot of %d services written to %s\n", len(records), path)
+	return nil
+}
+
+func (s *fileStorage) compact(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+func (s *fileStorage) restore() error {
+	content, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err == nil && len(content) > 0 {
+		var records []record
+		if err := json.Unmarshal(content, &records); err != nil {
+			return fmt.Errorf("[err] corrupted snapshot: %w", err)
+		}
+		for _, rec := range records {
+			s.replay(rec)
+		}
+		log.Printf("Restored %d services from snapshot\n", len(records))
+	}
+
+	wal, err := os.Open(filepath.Join(s.dir, walFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer wal.Close()
+	scanner := bufio.NewScanner(wal)
+	scanner.Buffer(make([]byte, 64*1024), MAX_RECORD_SIZE+1)
+	replayed := 0
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			if scanner.Scan() {
+				return fmt.Errorf("[err] corrupted write-ahead log entry %d: %w", replayed+1, err)
+			}
+			// a torn write at the tail of the log, everything before it is valid
+			log.Printf("Skipping torn write-ahead log entry %d: %v\n", replayed+1, err)
+			break
+		}
+		s.replay(rec)
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("[err] failed to read write-ahead log: %w", err)
+	}
+	log.Printf("Replayed %d write-ahead log entries\n", replayed)
+	return nil
+}
+
+func (s *fileStorage) replay(rec record) {
+	switch rec.Op {
+	case opAdd:
+		// the latest registration of an url wins
+		if saved, err := s.storage.GetByUrl(rec.Url); err == nil {
+			s.storage.Remove(saved.Name, saved.id)
+		}
+		s.storage.Add(rec.toService())
+	case opRemove:
+		s.storage.Remove(rec.Name, rec.Id)
+	case opHeartBeat:
+		if saved, err := s.storage.GetById(rec.Id); err == nil {
+			s.storage.UpdateLastHeartBeat(*saved, rec.LastHeartBeat)
+		}
+	case opStatus:
+		s.storage.UpdateStatus(rec.Id, rec.Status)
+	}
+}
+
+// expire evicts through the write-ahead log so expired instances arent
+// restored on startup. Heartbeats take the lock too, one which arrived
+// after the lease was popped renews it instead.
+func (s *fileStorage) expire(serviceName string, serviceId uuid.UUID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if saved, err := s.storage.GetById(serviceId); err == nil &&
+		s.storage.leases.regrant(serviceName, serviceId, saved.Ttl, saved.LastHeartBeatCheck) {
+		return
+	}
+	if err := s.remove(serviceName, serviceId); err != nil {
+		log.Println(err)
+	} else {
+		log.Printf("Deleted unhealthy service %s\n", serviceId)
+	}
+}
+
+func writeFileSync(path string, content []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Creates storage persisted in dir. Registrations are appended to
+// a write-ahead log, compacted into a snapshot every SNAPSHOT_INTERVAL
+// and replayed on startup.
+func NewFileStorage(dir string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &fileStorage{
+		dir:  dir,
+		quit: make(chan bool),
+	}
+	s.storage = newExpiringMultiMapStorage(SystemClock, s.expire)
+	// instances restored already expired are evicted once the log is open
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.restore(); err != nil {
+		s.storage.Close()
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		s.storage.Close()
+		return nil, err
+	}
+	s.wal = wal
+	if err := s.snapshot(); err != nil {
+		s.storage.Close()
+		wal.Close()
+		return nil, err
+	}
+	go s.compact(SNAPSHOT_INTERVAL)
+	return s, nil
+}
@@ -0,0 +1,179 @@
+package discover
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileStorageRestoresRegistry(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := NewService("orders", "localhost:8080", false)
+	service.Metadata = map[string]string{"zone": "a"}
+	if err := storage.Add(service); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.UpdateStatus(service.Id(), OUT_OF_SERVICE); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.(*fileStorage).Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.(*fileStorage).Close()
+	saved, err := restored.GetById(service.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Url != service.Url || saved.Status != OUT_OF_SERVICE || saved.Metadata["zone"] != "a" {
+		t.Errorf("restored %+v, want %+v with status %s", *saved, service, OUT_OF_SERVICE)
+	}
+}
+
+func TestFileStorageLogsExpiry(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.(*fileStorage).Close()
+	service := NewService("orders", "localhost:8080", false)
+	service.Ttl = 50 * time.Millisecond
+	if err := storage.Add(service); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := storage.GetById(service.Id()); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("service didnt expire")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	storage.(*fileStorage).lock.Lock()
+	defer storage.(*fileStorage).lock.Unlock()
+
+	// a crash now must not bring the expired instance back
+	wal, err := os.Open(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	var ops []string
+	scanner := bufio.NewScanner(wal)
+	for scanner.Scan() {
+		var rec record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Id == service.Id() {
+			ops = append(ops, rec.Op)
+		}
+	}
+	if len(ops) != 2 || ops[0] != opAdd || ops[1] != opRemove {
+		t.Errorf("write-ahead log of the instance is %v, want [%s %s]", ops, opAdd, opRemove)
+	}
+}
+
+func TestFileStorageCloseTwice(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.(*fileStorage).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.(*fileStorage).Close(); err != nil {
+		t.Errorf("second Close returned %v", err)
+	}
+}
+
+func TestFileStorageRollsBackFailedAppend(t *testing.T) {
+	storage, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := storage.(*fileStorage)
+	registered := NewService("orders", "localhost:8080", false)
+	if err := s.Add(registered); err != nil {
+		t.Fatal(err)
+	}
+	// writes to the log fail from now on
+	s.wal.Close()
+	defer func() { s.wal = nil }()
+
+	if err := s.Add(NewService("orders", "localhost:8081", false)); err == nil {
+		t.Error("Add succeeded without the write-ahead log")
+	}
+	if _, err := s.GetByUrl("http://localhost:8081"); err == nil {
+		t.Error("instance that isnt in the write-ahead log was registered")
+	}
+	if err := s.UpdateStatus(registered.Id(), DOWN); err == nil {
+		t.Error("UpdateStatus succeeded without the write-ahead log")
+	}
+	if err := s.Remove(registered.Name, registered.Id()); err == nil {
+		t.Error("Remove succeeded without the write-ahead log")
+	}
+	saved, err := s.GetById(registered.Id())
+	if err != nil {
+		t.Fatalf("instance removed without the write-ahead log: %v", err)
+	}
+	if saved.Status != UP {
+		t.Errorf("status changed to %s without the write-ahead log", saved.Status)
+	}
+}
+
+func TestFileStorageReplay(t *testing.T) {
+	add := func(url string, metadata map[string]string) string {
+		service := NewService("orders", url, false)
+		service.Metadata = metadata
+		line, _ := json.Marshal(toRecord(opAdd, service))
+		return string(line) + "\n"
+	}
+	large := map[string]string{"certificate": strings.Repeat("a", 256*1024)}
+	tests := []struct {
+		name      string
+		wal       string
+		instances int
+		valid     bool
+	}{
+		{"empty", "", 0, true},
+		{"records", add("localhost:8080", nil) + add("localhost:8081", nil), 2, true},
+		{"large record", add("localhost:8080", large), 1, true},
+		{"torn tail", add("localhost:8080", nil) + `{"op":"add","na`, 1, true},
+		{"corrupted in the middle", add("localhost:8080", nil) + "{\"op\":\n" + add("localhost:8081", nil), 0, false},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, walFileName), []byte(test.wal), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		storage, err := NewFileStorage(dir)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: NewFileStorage returned %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		instances := storage.(*fileStorage).storage.instances()
+		if len(instances) != test.instances {
+			t.Errorf("%s: restored %d instances, want %d", test.name, len(instances), test.instances)
+		}
+		storage.(*fileStorage).Close()
+	}
+}
@@ -0,0 +1,359 @@
+package discover
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	HEALTH_CHECK_HTTP = "http"
+	HEALTH_CHECK_TCP  = "tcp"
+	HEALTH_CHECK_GRPC = "grpc"
+
+	DEFAULT_HEALTH_CHECK_PATH      = "/health"
+	DEFAULT_HEALTH_CHECK_INTERVAL  = 10 * time.Second
+	DEFAULT_HEALTH_CHECK_TIMEOUT   = 2 * time.Second
+	DEFAULT_HEALTH_CHECK_THRESHOLD = 3
+
+	healthCheckConcurrency = 16
+)
+
+type HealthCheckConfig struct {
+	// One of HEALTH_CHECK_HTTP, HEALTH_CHECK_TCP or HEALTH_CHECK_GRPC.
+	Type string
+	// Path requested by http checks.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	// Consecutive failures after which an instance is considered down.
+	Threshold int
+}
+
+func (c *HealthCheckConfig) withDefaults() HealthCheckConfig {
+	config := *c
+	if config.Type == "" {
+		config.Type = HEALTH_CHECK_HTTP
+	}
+	if config.Path == "" {
+		config.Path = DEFAULT_HEALTH_CHECK_PATH
+	}
+	if config.Interval <= 0 {
+		config.Interval = DEFAULT_HEALTH_CHECK_INTERVAL
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DEFAULT_HEALTH_CHECK_TIMEOUT
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = DEFAULT_HEALTH_CHECK_THRESHOLD
+	}
+	return config
+}
+
+type probe func(ctx context.Context, service Service) error
+
+// healthCheckedStorage actively probes every registered instance and reports
+// the ones which failed Threshold checks in a row as DOWN, Get skips them.
+// They stay registered and are back with their own status once a check passes.
+// Watchers and deltas see them UPDATED when they fail and when they recover.
+type healthCheckedStorage struct {
+	Storage
+	config   HealthCheckConfig
+	probe    probe
+	failures map[uuid.UUID]int
+	lock     sync.RWMutex
+	quit     chan bool
+	once     sync.Once
+	events   *eventBroadcaster
+}
+
+func (s *healthCheckedStorage) Get(serviceName string) (*Service, error) {
+	instances, err := s.Storage.ListInstances(serviceName)
+	if err != nil {
+		return &Service{}, err
+	}
+	healthy := s.healthy(instances)
+	if len(healthy) == 0 {
+		return &Service{}, fmt.Errorf("%w named %s which is healthy", ErrNotFound, serviceName)
+	}
+	return &healthy[rand.Intn(len(healthy))], nil
+}
+
+func (s *healthCheckedStorage) ListInstances(serviceName string) ([]Service, error) {
+	instances, err := s.Storage.ListInstances(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return s.show(instances), nil
+}
+
+// FindInstances matches statuses as they are reported, DOWN of unhealthy instances.
+func (s *healthCheckedStorage) FindInstances(selector Selector) ([]Service, error) {
+	var candidates []Service
+	var err error
+	if name, ok := selector.ServiceName(); ok {
+		candidates, _ = s.Storage.ListInstances(name)
+	} else if candidates, err = s.Storage.FindInstances(Selector{}); err != nil {
+		return nil, err
+	}
+	result := make([]Service, 0)
+	for _, instance := range s.show(candidates) {
+		if selector.Matches(instance) {
+			result = append(result, instance)
+		}
+	}
+	return result, nil
+}
+
+func (s *healthCheckedStorage) GetAllServices() ([]Service, error) {
+	services, err := s.Storage.GetAllServices()
+	if err != nil {
+		return services, err
+	}
+	return s.show(services), nil
+}
+
+// Healthy reports whether the instance passed its recent checks.
+func (s *healthCheckedStorage) Healthy(serviceId uuid.UUID) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.failures[serviceId] < s.config.Threshold
+}
+
+// Close stops the health checks and closes the wrapped storage.
+func (s *healthCheckedStorage) Close() error {
+	s.once.Do(func() { close(s.quit) })
+	if closer, ok := s.Storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// show reports unhealthy instances as DOWN.
+func (s *healthCheckedStorage) show(instances []Service) []Service {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	shown := make([]Service, 0, len(instances))
+	for _, instance := range instances {
+		if s.failures[instance.id] >= s.config.Threshold {
+			instance.Status = DOWN
+		}
+		shown = append(shown, instance)
+	}
+	return shown
+}
+
+func (s *healthCheckedStorage) healthy(instances []Service) []Service {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	healthy := make([]Service, 0, len(instances))
+	for _, instance := range instances {
+		if s.failures[instance.id] < s.config.Threshold {
+			healthy = append(healthy, instance)
+		}
+	}
+	return healthy
+}
+
+func (s *healthCheckedStorage) run() {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+			s.checkAll()
+		}
+	}
+}
+
+func (s *healthCheckedStorage) checkAll() {
+	instances := allInstances(s.Storage)
+	results := make([]error, len(instances))
+	var wg sync.WaitGroup
+	limit := make(chan struct{}, healthCheckConcurrency)
+	for i := range instances {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-limit }()
+			ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+			defer cancel()
+			results[i] = s.probe(ctx, instances[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var changed []uuid.UUID
+	s.lock.Lock()
+	failures := make(map[uuid.UUID]int, len(instances))
+	for i, instance := range instances {
+		previous := s.failures[instance.id]
+		if results[i] == nil {
+			if previous >= s.config.Threshold {
+				log.Printf("Service %s on %s is healthy again\n", instance.Name, instance.Url)
+				changed = append(changed, instance.id)
+			}
+			continue
+		}
+		failures[instance.id] = previous + 1
+		if previous+1 == s.config.Threshold {
+			log.Printf("Service %s on %s is down after %d failed checks: %v\n",
+				instance.Name, instance.Url, s.config.Threshold, results[i])
+			changed = append(changed, instance.id)
+		}
+	}
+	s.failures = failures
+	s.lock.Unlock()
+	// the broadcaster asks Healthy so the lock cant be held
+	for _, serviceId := range changed {
+		s.events.refresh(serviceId)
+	}
+}
+
+// allInstances returns every registered instance of every service.
+func allInstances(storage Storage) []Service {
+	services, err := storage.GetAllServices()
+	if err != nil {
+		return nil
+	}
+	var result []Service
+	seen := make(map[string]bool)
+	for _, service := range services {
+		if seen[service.Name] {
+			continue
+		}
+		seen[service.Name] = true
+		if instances, err := storage.ListInstances(service.Name); err == nil {
+			result = append(result, instances...)
+		}
+	}
+	return result
+}
+
+func httpProbe(path string) probe {
+	client := &http.Client{}
+	return func(ctx context.Context, service Service) error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			strings.TrimSuffix(service.Url, "/")+path, nil)
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= http.StatusBadRequest {
+			return fmt.Errorf("[err] health check responded with %s", response.Status)
+		}
+		return nil
+	}
+}
+
+func tcpProbe(ctx context.Context, service Service) error {
+	host, _, err := hostPort(service.Url)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func grpcProbe(ctx context.Context, service Service) error {
+	host, secure, err := hostPort(service.Url)
+	if err != nil {
+		return err
+	}
+	creds := insecure.NewCredentials()
+	if secure {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	// connects in the background, the deadline of ctx bounds the whole check
+	conn, err := grpc.Dial(host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	response, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if response.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("[err] health check responded with %s", response.Status)
+	}
+	return nil
+}
+
+// hostPort extracts address to dial from the registered url,
+// defaulting the port by scheme.
+func hostPort(serviceUrl string) (string, bool, error) {
+	parsed, err := url.Parse(serviceUrl)
+	if err != nil {
+		return "", false, err
+	}
+	secure := parsed.Scheme == "https"
+	if parsed.Port() != "" {
+		return parsed.Host, secure, nil
+	}
+	if secure {
+		return net.JoinHostPort(parsed.Hostname(), "443"), secure, nil
+	}
+	return net.JoinHostPort(parsed.Hostname(), "80"), secure, nil
+}
+
+// Wraps storage with active health checks of every registered instance.
+// Storage has to publish its changes, every storage of this package does.
+func NewHealthCheckedStorage(storage Storage, config HealthCheckConfig) (Storage, error) {
+	source, ok := storage.(eventSource)
+	if !ok {
+		return nil, fmt.Errorf("[err] health checks arent supported by storage %T", storage)
+	}
+	config = config.withDefaults()
+	s := &healthCheckedStorage{
+		Storage:  storage,
+		config:   config,
+		failures: make(map[uuid.UUID]int),
+		quit:     make(chan bool),
+	}
+	switch config.Type {
+	case HEALTH_CHECK_HTTP:
+		s.probe = httpProbe(config.Path)
+	case HEALTH_CHECK_TCP:
+		s.probe = tcpProbe
+	case HEALTH_CHECK_GRPC:
+		s.probe = grpcProbe
+	default:
+		return nil, fmt.Errorf("[err] unknown health check type %s", config.Type)
+	}
+	s.events = source.broadcaster()
+	s.events.overlay(func(service Service) Service {
+		if !s.Healthy(service.id) {
+			service.Status = DOWN
+		}
+		return service
+	})
+	go s.run()
+	return s, nil
+}
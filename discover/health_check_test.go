@@ -0,0 +1,224 @@
+package discover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newTestHealthChecked checks instances only when checkAll is called,
+// the ones in down fail their probes.
+func newTestHealthChecked(t *testing.T, storage Storage) (*healthCheckedStorage, func(down ...Service)) {
+	t.Helper()
+	wrapped, err := NewHealthCheckedStorage(storage, HealthCheckConfig{
+		Type:      HEALTH_CHECK_TCP,
+		Interval:  time.Hour,
+		Threshold: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := wrapped.(*healthCheckedStorage)
+	t.Cleanup(func() { s.Close() })
+	var lock sync.Mutex
+	failing := make(map[uuid.UUID]bool)
+	s.probe = func(_ context.Context, service Service) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if failing[service.id] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	return s, func(down ...Service) {
+		lock.Lock()
+		defer lock.Unlock()
+		failing = make(map[uuid.UUID]bool)
+		for _, service := range down {
+			failing[service.id] = true
+		}
+	}
+}
+
+func nextEvent(t *testing.T, watcher *Watcher) Event {
+	t.Helper()
+	select {
+	case event := <-watcher.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("there wasnt any event")
+		return Event{}
+	}
+}
+
+func noEvent(t *testing.T, watcher *Watcher) {
+	t.Helper()
+	select {
+	case event := <-watcher.Events():
+		t.Fatalf("unexpected %s of %s", event.Type, event.Service.Url)
+	default:
+	}
+}
+
+func TestHealthCheckReportsUnhealthyInstancesDown(t *testing.T) {
+	s, down := newTestHealthChecked(t, NewMultiMapStorage())
+	healthy := NewService("orders", "localhost:8080", false)
+	failing := NewService("orders", "localhost:8081", false)
+	for _, service := range []Service{healthy, failing} {
+		if err := s.Add(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := s.Revision()
+	watcher, err := s.Watch("orders", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	down(failing)
+	s.checkAll()
+	noEvent(t, watcher)
+	if !s.Healthy(failing.id) {
+		t.Fatal("instance is down before reaching the threshold")
+	}
+	s.checkAll()
+	if s.Healthy(failing.id) {
+		t.Fatal("instance is healthy after reaching the threshold")
+	}
+	if event := nextEvent(t, watcher); event.Type != UPDATED || event.Service.id != failing.id || event.Service.Status != DOWN {
+		t.Fatalf("got %s of %s %s, want %s of %s %s", event.Type, event.Service.Url, event.Service.Status, UPDATED, failing.Url, DOWN)
+	}
+	instances, err := s.ListInstances("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[uuid.UUID]Status)
+	for _, instance := range instances {
+		statuses[instance.id] = instance.Status
+	}
+	if len(statuses) != 2 || statuses[healthy.id] != UP || statuses[failing.id] != DOWN {
+		t.Errorf("ListInstances returned %v, want %s UP and %s DOWN", instances, healthy.Url, failing.Url)
+	}
+	selector, _ := ParseSelector("status=DOWN")
+	found, err := s.FindInstances(selector)
+	if err != nil || len(found) != 1 || found[0].id != failing.id {
+		t.Errorf("FindInstances of DOWN returned %v %v, want only %s", found, err, failing.Url)
+	}
+	for i := 0; i < 10; i++ {
+		if picked, err := s.Get("orders"); err != nil || picked.id != healthy.id {
+			t.Fatalf("Get returned %v %v, want only %s", picked, err, healthy.Url)
+		}
+	}
+	full, err := s.Delta(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shown := failing
+	shown.Status = DOWN
+	if want := RegistryHash([]Service{healthy, shown}); len(full.Events) != 2 || full.Hash != want {
+		t.Errorf("full delta has %d instances with hash %s, want 2 with %s", len(full.Events), full.Hash, want)
+	}
+	delta, err := s.Delta(before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delta.Events) != 1 || delta.Events[0].Type != UPDATED || delta.Events[0].Service.Status != DOWN {
+		t.Errorf("delta is %+v, want %s of %s %s", delta.Events, UPDATED, failing.Url, DOWN)
+	}
+
+	// unhealthy instances stay DOWN whatever status they are given
+	if err := s.UpdateStatus(failing.id, OUT_OF_SERVICE); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, watcher); event.Service.Status != DOWN {
+		t.Errorf("status change of unhealthy instance published %s, want %s", event.Service.Status, DOWN)
+	}
+	down()
+	s.checkAll()
+	event := nextEvent(t, watcher)
+	if event.Type != UPDATED || event.Service.id != failing.id || event.Service.Status != OUT_OF_SERVICE {
+		t.Errorf("got %s of %s %s, want %s with %s", event.Type, event.Service.Url, event.Service.Status, UPDATED, OUT_OF_SERVICE)
+	}
+}
+
+func TestHealthCheckForgetsRemovedInstances(t *testing.T) {
+	s, down := newTestHealthChecked(t, NewMultiMapStorage())
+	service := NewService("orders", "localhost:8080", false)
+	if err := s.Add(service); err != nil {
+		t.Fatal(err)
+	}
+	down(service)
+	s.checkAll()
+	s.checkAll()
+	watcher, err := s.Watch("", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	if err := s.Remove(service.Name, service.id); err != nil {
+		t.Fatal(err)
+	}
+	if event := nextEvent(t, watcher); event.Type != REMOVED {
+		t.Errorf("got %s of unhealthy instance, want %s", event.Type, REMOVED)
+	}
+	down()
+	s.checkAll()
+	noEvent(t, watcher)
+	if full, _ := s.Delta(0); len(full.Events) != 0 {
+		t.Errorf("removed instance came back in %+v", full.Events)
+	}
+}
+
+func TestHealthCheckSupportsEveryStorage(t *testing.T) {
+	storages := map[string]Storage{
+		"multi map": NewMultiMapStorage(),
+		"slice":     NewInMemoryStorage(),
+	}
+	for name, storage := range storages {
+		s, down := newTestHealthChecked(t, storage)
+		service := NewService("orders", "localhost:8080", false)
+		if err := s.Add(service); err != nil {
+			t.Fatal(err)
+		}
+		watcher, err := s.Watch("orders", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		down(service)
+		s.checkAll()
+		s.checkAll()
+		if event := nextEvent(t, watcher); event.Service.id != service.id {
+			t.Errorf("%s: got %s of %s, want the unhealthy instance", name, event.Type, event.Service.Url)
+		}
+		watcher.Close()
+	}
+
+	// storages without events cant tell watchers about health changes
+	if _, err := NewHealthCheckedStorage(struct{ Storage }{NewMultiMapStorage()}, HealthCheckConfig{}); err == nil {
+		t.Error("health checks of storage without events were accepted")
+	}
+}
+
+func TestHealthCheckCloseTwice(t *testing.T) {
+	s, _ := newTestHealthChecked(t, NewMultiMapStorage())
+	s.Close()
+	s.Close()
+}
+
+func TestGrpcProbeIsBoundByTimeout(t *testing.T) {
+	// nothing answers on a blackholed address, only the deadline ends the check
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := grpcProbe(ctx, NewService("orders", "10.255.255.1:8080", false)); err == nil {
+		t.Error("probe of unreachable instance passed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("probe took %v with a 200ms deadline", elapsed)
+	}
+}
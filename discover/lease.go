@@ -0,0 +1,274 @@
+package discover
+
+import (
+	"container/heap"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type lease struct {
+	id       uuid.UUID
+	name     string
+	ttl      time.Duration
+	deadline time.Time
+	index    int
+}
+
+// leaseHeap is a min-heap of leases ordered by deadline.
+type leaseHeap []*lease
+
+func (h leaseHeap) Len() int           { return len(h) }
+func (h leaseHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h leaseHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *leaseHeap) Push(x interface{}) {
+	l := x.(*lease)
+	l.index = len(*h)
+	*h = append(*h, l)
+}
+func (h *leaseHeap) Pop() interface{} {
+	old := *h
+	l := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	l.index = -1
+	return l
+}
+
+// LeaseManager tracks expiry deadlines of every registered instance
+// and evicts the expired ones from a single loop.
+type LeaseManager struct {
+	clock  Clock
+	expire func(serviceName string, serviceId uuid.UUID)
+	leases leaseHeap
+	index  map[uuid.UUID]*lease
+	lock   sync.Mutex
+	wake   chan struct{}
+	quit   chan struct{}
+	once   sync.Once
+	// used for instances without their own ttl
+	defaultTtl time.Duration
+
+	preservation selfPreservation
+}
+
+// Grant starts lease of the instance which expires ttl after lastHeartBeat,
+// default ttl is used when ttl isnt positive.
+func (m *LeaseManager) Grant(serviceName string, serviceId uuid.UUID, ttl time.Duration, lastHeartBeat time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.grant(serviceName, serviceId, ttl, lastHeartBeat)
+}
+
+// grant has to be called with lock held.
+func (m *LeaseManager) grant(serviceName string, serviceId uuid.UUID, ttl time.Duration, lastHeartBeat time.Time) {
+	if ttl <= 0 {
+		ttl = m.defaultTtl
+	}
+	if saved, ok := m.index[serviceId]; ok {
+		saved.ttl = ttl
+		m.reschedule(saved, lastHeartBeat.Add(ttl))
+		return
+	}
+	l := &lease{id: serviceId, name: serviceName, ttl: ttl, deadline: lastHeartBeat.Add(ttl)}
+	m.index[serviceId] = l
+	heap.Push(&m.leases, l)
+	if l.index == 0 {
+		m.notify()
+	}
+}
+
+// Renew extends lease of the instance by its ttl from lastHeartBeat.
+func (m *LeaseManager) Renew(serviceId uuid.UUID, lastHeartBeat time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if saved, ok := m.index[serviceId]; ok {
+		m.reschedule(saved, lastHeartBeat.Add(saved.ttl))
+		m.preservation.renewed(m.clock.Now())
+	}
+}
+
+// postpone tracks lease of an instance expire couldnt evict again, e.g. on
+// raft followers, it expires after delay unless it's granted meanwhile.
+func (m *LeaseManager) postpone(serviceName string, serviceId uuid.UUID, ttl time.Duration, delay time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.index[serviceId]; ok {
+		return
+	}
+	if ttl <= 0 {
+		ttl = m.defaultTtl
+	}
+	l := &lease{id: serviceId, name: serviceName, ttl: ttl, deadline: m.clock.Now().Add(delay)}
+	m.index[serviceId] = l
+	heap.Push(&m.leases, l)
+	if l.index == 0 {
+		m.notify()
+	}
+}
+
+// regrant grants the lease again when the instance was heartbeated after
+// ReapExpired popped it, expire has to call it under the lock heartbeats take.
+func (m *LeaseManager) regrant(serviceName string, serviceId uuid.UUID, ttl time.Duration, lastHeartBeat time.Time) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ttl <= 0 {
+		ttl = m.defaultTtl
+	}
+	if !lastHeartBeat.Add(ttl).After(m.clock.Now()) {
+		return false
+	}
+	m.grant(serviceName, serviceId, ttl, lastHeartBeat)
+	return true
+}
+
+// Revoke forgets lease of the instance e.g. after deregistration.
+func (m *LeaseManager) Revoke(serviceId uuid.UUID) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if saved, ok := m.index[serviceId]; ok {
+		heap.Remove(&m.leases, saved.index)
+		delete(m.index, serviceId)
+	}
+}
+
+// Deadline returns when the instance expires unless it's renewed.
+func (m *LeaseManager) Deadline(serviceId uuid.UUID) (time.Time, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if saved, ok := m.index[serviceId]; ok {
+		return saved.deadline, true
+	}
+	return time.Time{}, false
+}
+
+// ReapExpired evicts every instance whose deadline has passed
+// and returns how many were evicted, nothing is evicted in self-preservation.
+func (m *LeaseManager) ReapExpired() int {
+	now := m.clock.Now()
+	var expired []*lease
+	m.lock.Lock()
+	if m.preservation.status(len(m.index), now).Active {
+		m.lock.Unlock()
+		return 0
+	}
+	for len(m.leases) > 0 && !m.leases[0].deadline.After(now) {
+		l := heap.Pop(&m.leases).(*lease)
+		delete(m.index, l.id)
+		expired = append(expired, l)
+	}
+	m.lock.Unlock()
+	for _, l := range expired {
+		log.Printf("Service %s %s unhealthy -> performing deletion\n", l.name, l.id)
+		m.expire(l.name, l.id)
+	}
+	return len(expired)
+}
+
+// EnableSelfPreservation suspends eviction whenever fewer heartbeats than
+// expected arrived in the last minute, see SelfPreservationConfig.
+func (m *LeaseManager) EnableSelfPreservation(config SelfPreservationConfig) {
+	m.preservation.enable(config, m.clock.Now())
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.notify()
+}
+
+func (m *LeaseManager) DisableSelfPreservation() {
+	m.preservation.disable()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.notify()
+}
+
+func (m *LeaseManager) SelfPreservation() SelfPreservationStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.preservation.status(len(m.index), m.clock.Now())
+}
+
+// Stop ends the eviction loop.
+func (m *LeaseManager) Stop() {
+	m.once.Do(func() { close(m.quit) })
+}
+
+func (m *LeaseManager) reschedule(l *lease, deadline time.Time) {
+	wasFirst := l.index == 0
+	l.deadline = deadline
+	heap.Fix(&m.leases, l.index)
+	if l.index == 0 && !wasFirst {
+		m.notify()
+	}
+}
+
+// notify wakes the loop when the earliest deadline moved, lock has to be held.
+func (m *LeaseManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *LeaseManager) run() {
+	for {
+		var timer <-chan time.Time
+		m.lock.Lock()
+		if len(m.leases) > 0 {
+			now := m.clock.Now()
+			deadline := m.leases[0].deadline
+			if !deadline.After(now) && m.preservation.status(len(m.index), now).Active {
+				// eviction is suspended until renewal rate is measured again
+				deadline = m.preservation.nextBucket()
+			}
+			timer = m.clock.After(deadline.Sub(now))
+		}
+		m.lock.Unlock()
+		select {
+		case <-m.quit:
+			return
+		case <-m.wake:
+		case <-timer:
+			m.ReapExpired()
+		}
+	}
+}
+
+// SetDefaultTtl changes ttl of instances registered without one, DELETION_TIME
+// when ttl isnt positive. Leases granted before keep their ttl.
+func (m *LeaseManager) SetDefaultTtl(ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = DELETION_TIME
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.defaultTtl = ttl
+}
+
+func (m *LeaseManager) DefaultTtl() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.defaultTtl
+}
+
+// Creates lease manager calling expire for every evicted instance.
+func NewLeaseManager(clock Clock, expire func(serviceName string, serviceId uuid.UUID)) *LeaseManager {
+	if clock == nil {
+		clock = SystemClock
+	}
+	m := &LeaseManager{
+		clock:      clock,
+		expire:     expire,
+		defaultTtl: DELETION_TIME,
+		index:      make(map[uuid.UUID]*lease),
+		wake:       make(chan struct{}, 1),
+		quit:       make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
@@ -0,0 +1,199 @@
+package discover
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newTestLeases returns lease manager which expires only when ReapExpired
+// is called, the returned ids are the evicted ones.
+func newTestLeases(t *testing.T) (*LeaseManager, *ManualClock, *[]uuid.UUID) {
+	t.Helper()
+	clock := NewManualClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	var expired []uuid.UUID
+	m := NewLeaseManager(clock, func(_ string, serviceId uuid.UUID) {
+		expired = append(expired, serviceId)
+	})
+	m.Stop()
+	return m, clock, &expired
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		defaultTtl time.Duration
+		// renewed this long after the grant when positive
+		renewAfter time.Duration
+		advance    time.Duration
+		expired    bool
+	}{
+		{"default ttl not reached", 0, 0, 0, DELETION_TIME - time.Second, false},
+		{"default ttl reached", 0, 0, 0, DELETION_TIME, true},
+		{"changed default ttl", 0, 30 * time.Second, 0, 30 * time.Second, true},
+		{"own ttl overrides default", 10 * time.Second, 0, 0, 10 * time.Second, true},
+		{"own ttl longer than default", 5 * time.Minute, 0, 0, DELETION_TIME + time.Second, false},
+		{"own ttl overrides changed default", 10 * time.Second, time.Minute, 0, 10 * time.Second, true},
+		{"renewal extends lease", 10 * time.Second, 0, 8 * time.Second, 15 * time.Second, false},
+		{"renewed lease expires after ttl", 10 * time.Second, 0, 8 * time.Second, 18 * time.Second, true},
+		{"renewed default ttl", 0, 0, time.Minute, DELETION_TIME + time.Second, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m, clock, expired := newTestLeases(t)
+			if test.defaultTtl > 0 {
+				m.SetDefaultTtl(test.defaultTtl)
+			}
+			id := uuid.New()
+			m.Grant("orders", id, test.ttl, clock.Now())
+			if test.renewAfter > 0 {
+				clock.Advance(test.renewAfter)
+				m.Renew(id, clock.Now())
+				clock.Advance(test.advance - test.renewAfter)
+			} else {
+				clock.Advance(test.advance)
+			}
+			reaped := m.ReapExpired()
+			if got := reaped == 1 && len(*expired) == 1 && (*expired)[0] == id; got != test.expired {
+				t.Errorf("expired = %v after %v, want %v", got, test.advance, test.expired)
+			}
+			if _, ok := m.Deadline(id); ok == test.expired {
+				t.Errorf("lease tracked = %v after reaping, want %v", ok, !test.expired)
+			}
+		})
+	}
+}
+
+func TestLeaseReapsInDeadlineOrder(t *testing.T) {
+	m, clock, expired := newTestLeases(t)
+	first, second, kept := uuid.New(), uuid.New(), uuid.New()
+	m.Grant("orders", second, 20*time.Second, clock.Now())
+	m.Grant("orders", kept, time.Minute, clock.Now())
+	m.Grant("orders", first, 10*time.Second, clock.Now())
+	clock.Advance(30 * time.Second)
+	if reaped := m.ReapExpired(); reaped != 2 {
+		t.Fatalf("reaped %d leases, want 2", reaped)
+	}
+	if (*expired)[0] != first || (*expired)[1] != second {
+		t.Errorf("leases expired in order %v, want %v", *expired, []uuid.UUID{first, second})
+	}
+	if reaped := m.ReapExpired(); reaped != 0 {
+		t.Errorf("reaped %d leases again", reaped)
+	}
+}
+
+func TestLeaseRegrantAndRevoke(t *testing.T) {
+	m, clock, expired := newTestLeases(t)
+	regranted, revoked := uuid.New(), uuid.New()
+	m.Grant("orders", regranted, 10*time.Second, clock.Now())
+	m.Grant("orders", revoked, 10*time.Second, clock.Now())
+	// granting again replaces ttl of the lease
+	m.Grant("orders", regranted, time.Minute, clock.Now())
+	m.Revoke(revoked)
+	clock.Advance(30 * time.Second)
+	m.Renew(regranted, clock.Now())
+	if deadline, _ := m.Deadline(regranted); !deadline.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("renewed deadline is %v, want ttl of the last grant", deadline)
+	}
+	if reaped := m.ReapExpired(); reaped != 0 {
+		t.Errorf("reaped %v", *expired)
+	}
+}
+
+func TestLeaseLoopEvicts(t *testing.T) {
+	clock := NewManualClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	expired := make(chan uuid.UUID, 1)
+	m := NewLeaseManager(clock, func(_ string, serviceId uuid.UUID) {
+		expired <- serviceId
+	})
+	defer m.Stop()
+	id := uuid.New()
+	m.Grant("orders", id, 10*time.Second, clock.Now())
+	clock.Advance(10 * time.Second)
+	select {
+	case got := <-expired:
+		if got != id {
+			t.Errorf("evicted %s, want %s", got, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("lease wasnt evicted by the loop")
+	}
+}
+
+func TestStorageExpiresByClock(t *testing.T) {
+	clock := NewManualClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	s := NewMultiMapStorageWithClock(clock)
+	service := NewService("orders", "localhost:8080", false)
+	service.Ttl = 10 * time.Second
+	service.LastHeartBeatCheck = clock.Now()
+	if err := s.Add(service); err != nil {
+		t.Fatal(err)
+	}
+	s.Leases().Stop()
+	clock.Advance(8 * time.Second)
+	if err := s.UpdateLastHeartBeat(service, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(8 * time.Second)
+	if s.Leases().ReapExpired() != 0 {
+		t.Fatal("heartbeat didnt renew the lease")
+	}
+	clock.Advance(2 * time.Second)
+	if s.Leases().ReapExpired() != 1 {
+		t.Fatal("lease didnt expire ttl after the last heartbeat")
+	}
+	if _, err := s.GetById(service.Id()); err == nil {
+		t.Error("expired instance is still registered")
+	}
+}
+
+func TestExpireKeepsInstanceHeartbeatedAfterReap(t *testing.T) {
+	clock := NewManualClock(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC))
+	file, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.(*fileStorage).Close()
+	tests := []struct {
+		name    string
+		storage Storage
+		now     func() time.Time
+		expire  func(serviceName string, serviceId uuid.UUID)
+	}{
+		{"multi map", NewMultiMapStorageWithClock(clock), clock.Now, nil},
+		{"slice", NewInMemoryStorageWithClock(clock), clock.Now, nil},
+		{"file", file, time.Now, file.(*fileStorage).expire},
+	}
+	tests[0].expire = tests[0].storage.(*multiMapStorage).expire
+	tests[1].expire = tests[1].storage.(*inMemoryStorage).expire
+	for _, test := range tests {
+		leases := test.storage.Leases()
+		leases.Stop()
+		for i, heartbeated := range []bool{false, true} {
+			service := NewService("orders", fmt.Sprintf("localhost:%d", 8080+i), false)
+			service.Ttl = 10 * time.Second
+			service.LastHeartBeatCheck = test.now().Add(-11 * time.Second)
+			if err := test.storage.Add(service); err != nil {
+				t.Fatal(err)
+			}
+			// ReapExpired popped the lease, the heartbeat arrives before expire
+			leases.Revoke(service.Id())
+			if heartbeated {
+				if err := test.storage.UpdateLastHeartBeat(service, test.now()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			test.expire(service.Name, service.Id())
+			_, err := test.storage.GetById(service.Id())
+			if kept := err == nil; kept != heartbeated {
+				t.Errorf("%s: instance heartbeated %v kept = %v", test.name, heartbeated, kept)
+			}
+			if _, granted := leases.Deadline(service.Id()); granted != heartbeated {
+				t.Errorf("%s: instance heartbeated %v has lease = %v", test.name, heartbeated, granted)
+			}
+		}
+	}
+}
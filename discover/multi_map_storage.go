@@ -14,6 +14,10 @@ import (
 type serviceMimified struct {
 	id                 uuid.UUID
 	url                string
+	status             Status
+	metadata           map[string]string
+	tags               []string
+	ttl                time.Duration
 	lastHeartBeatCheck time.Time
 }
 
@@ -21,6 +25,10 @@ func toMimified(service Service) serviceMimified {
 	return serviceMimified{
 		id:                 service.id,
 		url:                service.Url,
+		status:             service.Status,
+		metadata:           service.Metadata,
+		tags:               service.Tags,
+		ttl:                service.Ttl,
 		lastHeartBeatCheck: service.LastHeartBeatCheck,
 	}
 }
@@ -29,6 +37,10 @@ func toService(servMini serviceMimified, name string) Service {
 		Name:               name,
 		id:                 servMini.id,
 		Url:                servMini.url,
+		Status:             servMini.status,
+		Metadata:           servMini.metadata,
+		Tags:               servMini.tags,
+		Ttl:                servMini.ttl,
 		LastHeartBeatCheck: servMini.lastHeartBeatCheck,
 	}
 }
@@ -36,50 +48,99 @@ func toService(servMini serviceMimified, name string) Service {
 type multiMapStorage struct {
 	services map[string][]serviceMimified
 	lock     sync.RWMutex
+	events   *eventBroadcaster
+	leases   *LeaseManager
 }
 
 func (s *multiMapStorage) Add(service Service) error {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if !s.checkIfDuplicate(service) {
 		if s.services[service.Name] == nil {
 			s.services[service.Name] = make([]serviceMimified, 0)
 		}
 		s.services[service.Name] =
 			append(s.services[service.Name], toMimified(service))
-		s.deleteIfOlderThan(service, DELETION_TIME)
+		s.events.publish(ADDED, service)
+		s.leases.Grant(service.Name, service.id, service.Ttl, service.LastHeartBeatCheck)
 		return nil
 	}
 	// return nil
-	return fmt.Errorf("[err] duplicate found for %s", service.Url)
+	return fmt.Errorf("%w for %s", ErrDuplicate, service.Url)
 }
 
 func (s *multiMapStorage) Remove(serviceName string, serviceId uuid.UUID) error {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(serviceId)
+}
+
+// remove has to be called with lock held.
+func (s *multiMapStorage) remove(serviceId uuid.UUID) error {
 	for name, services := range s.services {
 		for index, service := range services {
 			if service.id == serviceId {
 				slice := s.services[name]
 				slice[index] = slice[len(slice)-1]
 				s.services[name] = slice[:len(slice)-1]
+				s.leases.Revoke(serviceId)
+				s.events.publish(REMOVED, toService(service, name))
 				return nil
 			}
 		}
 	}
-	return fmt.Errorf("[err] service %v doesnt exists", serviceId)
+	return fmt.Errorf("%w with id %v", ErrNotFound, serviceId)
 }
 
 func (s *multiMapStorage) Get(serviceName string) (*Service, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	services := s.services[serviceName]
 	size := len(services)
 	if size == 0 {
-		return &Service{}, fmt.Errorf("[err] there arent any services %s", serviceName)
+		return &Service{}, fmt.Errorf("%w named %s", ErrNotFound, serviceName)
 	}
 	parsedService := toService(services[rand.Intn(size)], serviceName)
 	return &parsedService, nil
 }
+func (s *multiMapStorage) ListInstances(serviceName string) ([]Service, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	services := s.services[serviceName]
+	if len(services) == 0 {
+		return nil, fmt.Errorf("%w named %s", ErrNotFound, serviceName)
+	}
+	result := make([]Service, 0, len(services))
+	for _, service := range services {
+		result = append(result, toService(service, serviceName))
+	}
+	return result, nil
+}
+
+func (s *multiMapStorage) FindInstances(selector Selector) ([]Service, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make([]Service, 0)
+	find := func(name string, services []serviceMimified) {
+		for _, service := range services {
+			if parsed := toService(service, name); selector.Matches(parsed) {
+				result = append(result, parsed)
+			}
+		}
+	}
+	if name, ok := selector.ServiceName(); ok {
+		find(name, s.services[name])
+		return result, nil
+	}
+	for name, services := range s.services {
+		find(name, services)
+	}
+	return result, nil
+}
+
 func (s *multiMapStorage) GetById(serviceId uuid.UUID) (*Service, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	for name, services := range s.services {
 		for _, service := range services {
 			if service.id == serviceId {
@@ -88,10 +149,12 @@ func (s *multiMapStorage) GetById(serviceId uuid.UUID) (*Service, error) {
 			}
 		}
 	}
-	return &Service{}, fmt.Errorf("[err] service %v doesnt exists", serviceId)
+	return &Service{}, fmt.Errorf("%w with id %v", ErrNotFound, serviceId)
 }
 
 func (s *multiMapStorage) GetByUrl(serviceUrl string) (*Service, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	for name, services := range s.services {
 		for _, service := range services {
 			if service.url == serviceUrl {
@@ -100,10 +163,12 @@ func (s *multiMapStorage) GetByUrl(serviceUrl string) (*Service, error) {
 			}
 		}
 	}
-	return &Service{}, fmt.Errorf("[err] service with url %s doesnt exists", serviceUrl)
+	return &Service{}, fmt.Errorf("%w with url %s", ErrNotFound, serviceUrl)
 }
 
 func (s *multiMapStorage) GetAllServices() (result []Service, err error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	for name, services := range s.services {
 		size := len(services)
 		if size > 0 {
@@ -116,51 +181,95 @@ func (s *multiMapStorage) GetAllServices() (result []Service, err error) {
 	return result, err
 }
 
+func (s *multiMapStorage) instances() (result []Service) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for name, services := range s.services {
+		for _, service := range services {
+			result = append(result, toService(service, name))
+		}
+	}
+	return result
+}
+
 func (s *multiMapStorage) UpdateLastHeartBeat(service Service, newTime time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	for idx, savedService := range s.services[service.Name] {
 		if savedService.url == service.Url {
 			log.Printf("Updating time on %s with url %s matching %s at index %d\n", service.Name, savedService.url, service.Url, idx)
 			s.services[service.Name][idx].lastHeartBeatCheck = newTime
+			s.leases.Renew(savedService.id, newTime)
+			s.events.touch(toService(s.services[service.Name][idx], service.Name))
 			return nil
 		}
 	}
-	return fmt.Errorf("[err] service %s doesnt exists", service.Name)
+	return fmt.Errorf("%w with url %s", ErrNotFound, service.Url)
 }
 
-func (s *multiMapStorage) deleteIfOlderThan(service Service, duration time.Duration) {
-	log.Printf("Starting deletion procedure for unhealthy services %s 1/1.5min\n", service.id)
-	quit := make(chan bool)
-	go func(quit chan bool) {
-		ticker := time.NewTicker(duration)
-		for tick := range ticker.C {
-			select {
-			case <-quit:
-				return
-			default:
-				s.performDeletion(quit, service, duration, tick)
+func (s *multiMapStorage) UpdateStatus(serviceId uuid.UUID, status Status) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, services := range s.services {
+		for idx, service := range services {
+			if service.id == serviceId {
+				log.Printf("Updating status on %s with url %s to %s\n", name, service.url, status)
+				s.services[name][idx].status = status
+				s.events.publish(UPDATED, toService(s.services[name][idx], name))
+				return nil
 			}
 		}
-	}(quit)
-
-}
-
-//TODO fix deletion after checked for unhealthy in multiValueMap and Slice implementation.
-func (s *multiMapStorage) performDeletion(
-	quit chan bool,
-	service Service,
-	duration time.Duration,
-	tick time.Time) {
-	saved, err := s.GetById(service.id)
-	if err == nil && saved.LastHeartBeatCheck.Add(duration).Before(tick) {
-		err := s.Remove(service.Name, service.id)
-		if err != nil {
-			log.Println(err)
-		} else {
-			log.Printf("Deleted unhealthy service %s\n", service.id)
-			quit <- true
+	}
+	return fmt.Errorf("%w with id %v", ErrNotFound, serviceId)
+}
+
+func (s *multiMapStorage) Watch(serviceName string, revision uint64) (*Watcher, error) {
+	return s.events.watch(serviceName, revision)
+}
+
+func (s *multiMapStorage) Revision() uint64 {
+	return s.events.current()
+}
+
+func (s *multiMapStorage) ServiceRevision(serviceName string) uint64 {
+	return s.events.serviceRevision(serviceName)
+}
+
+func (s *multiMapStorage) Delta(revision uint64) (*Delta, error) {
+	return s.events.delta(revision)
+}
+
+func (s *multiMapStorage) broadcaster() *eventBroadcaster {
+	return s.events
+}
+
+func (s *multiMapStorage) Leases() *LeaseManager {
+	return s.leases
+}
+
+// Close stops evicting expired services.
+func (s *multiMapStorage) Close() error {
+	s.leases.Stop()
+	return nil
+}
+
+// expire checks the heartbeat again under the lock, one which arrived after
+// the lease was popped renews it instead of the instance being evicted.
+func (s *multiMapStorage) expire(serviceName string, serviceId uuid.UUID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, service := range s.services[serviceName] {
+		if service.id == serviceId && s.leases.regrant(serviceName, serviceId, service.ttl, service.lastHeartBeatCheck) {
+			return
 		}
 	}
+	if err := s.remove(serviceId); err != nil {
+		log.Println(err)
+	} else {
+		log.Printf("Deleted unhealthy service %s\n", serviceId)
+	}
 }
+
 func (s *multiMapStorage) checkIfDuplicate(service Service) bool {
 	for _, savedService := range s.services[service.Name] {
 		if savedService.url == service.Url {
@@ -170,7 +279,28 @@ func (s *multiMapStorage) checkIfDuplicate(service Service) bool {
 	return false
 }
 func NewMultiMapStorage() Storage {
-	return &multiMapStorage{
+	return newMultiMapStorage(SystemClock)
+}
+
+// Storage expiring services by the given clock.
+func NewMultiMapStorageWithClock(clock Clock) Storage {
+	return newMultiMapStorage(clock)
+}
+
+func newMultiMapStorage(clock Clock) *multiMapStorage {
+	return newExpiringMultiMapStorage(clock, nil)
+}
+
+// newExpiringMultiMapStorage lets storages wrapping it evict expired
+// instances through their own Remove, nil expire removes them directly.
+func newExpiringMultiMapStorage(clock Clock, expire func(serviceName string, serviceId uuid.UUID)) *multiMapStorage {
+	s := &multiMapStorage{
 		services: make(map[string][]serviceMimified),
+		events:   newEventBroadcaster(),
+	}
+	if expire == nil {
+		expire = s.expire
 	}
+	s.leases = NewLeaseManager(clock, expire)
+	return s
 }
@@ -0,0 +1,502 @@
+package discover
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const (
+	RAFT_APPLY_TIMEOUT = 5 * time.Second
+	RAFT_DIAL_TIMEOUT  = 5 * time.Second
+	// How often followers check leases expired on their copy of the registry,
+	// they are only evicted by the leader.
+	RAFT_EXPIRY_RETRY = 5 * time.Second
+
+	raftRetainSnapshots = 2
+	raftMaxPool         = 3
+)
+
+// RaftPeer describes a single member of the discovery cluster.
+type RaftPeer struct {
+	NodeId string
+	// Address of the raft transport.
+	RaftAddr string
+	// Address on which the node accepts writes forwarded by followers.
+	RpcAddr string
+}
+
+type RaftConfig struct {
+	RaftPeer
+	// Directory for the raft log and snapshots, in memory when empty.
+	Dir string
+	// Bootstrap the cluster with Peers. Safe to set on every node,
+	// it's ignored once the node has state.
+	Bootstrap bool
+	Peers     []RaftPeer
+	// Forwarded writes are served with ServerTls and sent to the leader with
+	// ClientTls, followers without a verified client certificate are refused.
+	// They are plain tcp when ServerTls is nil.
+	ServerTls *tls.Config
+	ClientTls *tls.Config
+}
+
+// raftStorage replicates every mutation through the raft log.
+// Reads are served from the local copy of the registry,
+// writes on followers are forwarded to the leader.
+// Every node tracks leases, expired instances are removed
+// through the log by the leader only so replicas dont drift apart.
+type raftStorage struct {
+	storage  *multiMapStorage
+	raft     *raft.Raft
+	store    *raftboltdb.BoltStore
+	rpcAddrs map[raft.ServerID]string
+	listener net.Listener
+	tls      *tls.Config
+	clients  map[string]*rpc.Client
+	lock     sync.Mutex
+}
+
+func (s *raftStorage) Add(service Service) error {
+	return s.apply(toRecord(opAdd, service))
+}
+
+func (s *raftStorage) Remove(serviceName string, serviceId uuid.UUID) error {
+	return s.apply(record{Op: opRemove, Id: serviceId, Name: serviceName})
+}
+
+func (s *raftStorage) Get(serviceName string) (*Service, error) {
+	return s.storage.Get(serviceName)
+}
+
+func (s *raftStorage) ListInstances(serviceName string) ([]Service, error) {
+	return s.storage.ListInstances(serviceName)
+}
+
+func (s *raftStorage) FindInstances(selector Selector) ([]Service, error) {
+	return s.storage.FindInstances(selector)
+}
+
+func (s *raftStorage) GetById(serviceId uuid.UUID) (*Service, error) {
+	return s.storage.GetById(serviceId)
+}
+
+func (s *raftStorage) GetByUrl(serviceUrl string) (*Service, error) {
+	return s.storage.GetByUrl(serviceUrl)
+}
+
+func (s *raftStorage) GetAllServices() ([]Service, error) {
+	return s.storage.GetAllServices()
+}
+
+func (s *raftStorage) Watch(serviceName string, revision uint64) (*Watcher, error) {
+	return s.storage.Watch(serviceName, revision)
+}
+
+func (s *raftStorage) Revision() uint64 {
+	return s.storage.events.current()
+}
+
+func (s *raftStorage) ServiceRevision(serviceName string) uint64 {
+	return s.storage.events.serviceRevision(serviceName)
+}
+
+func (s *raftStorage) Delta(revision uint64) (*Delta, error) {
+	return s.storage.events.delta(revision)
+}
+
+func (s *raftStorage) broadcaster() *eventBroadcaster {
+	return s.storage.events
+}
+
+func (s *raftStorage) Leases() *LeaseManager {
+	return s.storage.leases
+}
+
+func (s *raftStorage) UpdateLastHeartBeat(service Service, newTime time.Time) error {
+	service.LastHeartBeatCheck = newTime
+	return s.apply(toRecord(opHeartBeat, service))
+}
+
+func (s *raftStorage) UpdateStatus(serviceId uuid.UUID, status Status) error {
+	return s.apply(record{Op: opStatus, Id: serviceId, Status: status})
+}
+
+func (s *raftStorage) expire(serviceName string, serviceId uuid.UUID) {
+	service, err := s.storage.GetById(serviceId)
+	if err != nil {
+		return
+	}
+	if s.leader() {
+		// heartbeats applied after the lease expired arent renewing it
+		ttl := service.Ttl
+		if ttl <= 0 {
+			ttl = s.storage.leases.DefaultTtl()
+		}
+		if service.LastHeartBeatCheck.Add(ttl).After(s.storage.leases.clock.Now()) {
+			s.storage.leases.Grant(serviceName, serviceId, service.Ttl, service.LastHeartBeatCheck)
+			return
+		}
+		err := s.apply(record{Op: opRemove, Id: serviceId, Name: serviceName})
+		if err == nil {
+			log.Printf("Deleted unhealthy service %s\n", serviceId)
+			return
+		}
+		log.Println(err)
+	}
+	s.storage.leases.postpone(serviceName, serviceId, service.Ttl, RAFT_EXPIRY_RETRY)
+}
+
+func (s *raftStorage) leader() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.raft != nil && s.raft.State() == raft.Leader
+}
+
+// Leader returns the raft address of the current leader or empty string.
+func (s *raftStorage) Leader() string {
+	addr, _ := s.raft.LeaderWithID()
+	return string(addr)
+}
+
+// Close leaves the cluster and stops accepting forwarded writes.
+func (s *raftStorage) Close() error {
+	s.listener.Close()
+	s.lock.Lock()
+	for addr, client := range s.clients {
+		client.Close()
+		delete(s.clients, addr)
+	}
+	s.lock.Unlock()
+	s.storage.Close()
+	err := s.raft.Shutdown().Error()
+	if s.store != nil {
+		if closeErr := s.store.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (s *raftStorage) apply(rec record) error {
+	if s.raft.State() != raft.Leader {
+		return s.forward(rec)
+	}
+	command, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	future := s.raft.Apply(command, RAFT_APPLY_TIMEOUT)
+	if err := future.Error(); err != nil {
+		return fmt.Errorf("[err] failed to replicate %s of %v: %w", rec.Op, rec.Id, err)
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (s *raftStorage) forward(rec record) error {
+	_, leaderId := s.raft.LeaderWithID()
+	if leaderId == "" {
+		return errors.New("[err] there isnt any raft leader elected")
+	}
+	addr, ok := s.rpcAddrs[leaderId]
+	if !ok {
+		return fmt.Errorf("[err] unknown rpc address of leader %s", leaderId)
+	}
+	client, err := s.client(addr)
+	if err != nil {
+		return err
+	}
+	command, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	err = client.Call("Registry.Apply", command, new(bool))
+	if errors.Is(err, rpc.ErrShutdown) {
+		s.dropClient(addr)
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		// keeps storage errors recognizable after crossing the rpc
+		for _, known := range []error{ErrDuplicate, ErrNotFound, ErrUnknownStatus} {
+			if strings.HasPrefix(err.Error(), known.Error()) {
+				return fmt.Errorf("%w%s", known, strings.TrimPrefix(err.Error(), known.Error()))
+			}
+		}
+		return errors.New(err.Error())
+	}
+	return err
+}
+
+func (s *raftStorage) client(addr string) (*rpc.Client, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if client, ok := s.clients[addr]; ok {
+		return client, nil
+	}
+	var conn net.Conn
+	var err error
+	if s.tls != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: RAFT_DIAL_TIMEOUT}, "tcp", addr, s.tls)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, RAFT_DIAL_TIMEOUT)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[err] failed to reach leader on %s: %w", addr, err)
+	}
+	client := rpc.NewClient(conn)
+	s.clients[addr] = client
+	return client, nil
+}
+
+func (s *raftStorage) dropClient(addr string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if client, ok := s.clients[addr]; ok {
+		client.Close()
+		delete(s.clients, addr)
+	}
+}
+
+// serve accepts followers forwarding writes, over tls only those
+// presenting a certificate verified by the listener config.
+func (s *raftStorage) serve(server *rpc.Server) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				tlsConn.SetDeadline(time.Now().Add(RAFT_DIAL_TIMEOUT))
+				err := tlsConn.Handshake()
+				if err == nil && len(tlsConn.ConnectionState().VerifiedChains) == 0 {
+					err = errors.New("[err] there isnt any verified client certificate")
+				}
+				if err != nil {
+					log.Printf("Refused forwarded writes from %s: %v\n", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+				tlsConn.SetDeadline(time.Time{})
+			}
+			server.ServeConn(conn)
+		}()
+	}
+}
+
+// Registry is the rpc endpoint receiving writes forwarded by followers.
+type Registry struct {
+	storage *raftStorage
+}
+
+func (r *Registry) Apply(command []byte, applied *bool) error {
+	if r.storage.raft.State() != raft.Leader {
+		return errors.New("[err] node isnt a raft leader anymore")
+	}
+	var rec record
+	if err := json.Unmarshal(command, &rec); err != nil {
+		return err
+	}
+	if err := r.storage.apply(rec); err != nil {
+		return err
+	}
+	*applied = true
+	return nil
+}
+
+// registryFSM applies replicated records to the local registry.
+type registryFSM struct {
+	storage *multiMapStorage
+}
+
+func (f *registryFSM) Apply(entry *raft.Log) interface{} {
+	var rec record
+	if err := json.Unmarshal(entry.Data, &rec); err != nil {
+		return fmt.Errorf("[err] malformed raft entry %d: %w", entry.Index, err)
+	}
+	switch rec.Op {
+	case opAdd:
+		return f.storage.Add(rec.toService())
+	case opRemove:
+		return f.storage.Remove(rec.Name, rec.Id)
+	case opHeartBeat:
+		return f.storage.UpdateLastHeartBeat(rec.toService(), rec.LastHeartBeat)
+	case opStatus:
+		return f.storage.UpdateStatus(rec.Id, rec.Status)
+	}
+	return fmt.Errorf("[err] unknown raft operation %s", rec.Op)
+}
+
+func (f *registryFSM) Snapshot() (raft.FSMSnapshot, error) {
+	var records []record
+	for _, service := range f.storage.instances() {
+		records = append(records, toRecord(opAdd, service))
+	}
+	return &registrySnapshot{records: records}, nil
+}
+
+func (f *registryFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+	var records []record
+	if err := json.NewDecoder(snapshot).Decode(&records); err != nil {
+		return fmt.Errorf("[err] corrupted raft snapshot: %w", err)
+	}
+	for _, service := range f.storage.instances() {
+		f.storage.Remove(service.Name, service.id)
+	}
+	for _, rec := range records {
+		f.storage.Add(rec.toService())
+	}
+	log.Printf("Restored %d services from raft snapshot\n", len(records))
+	return nil
+}
+
+type registrySnapshot struct {
+	records []record
+}
+
+func (s *registrySnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.records); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *registrySnapshot) Release() {}
+
+// newRaftStores keeps the log in memory when dir is empty,
+// otherwise it returns the bolt store to close on shutdown.
+func newRaftStores(dir string) (raft.LogStore, raft.StableStore, raft.SnapshotStore, *raftboltdb.BoltStore, error) {
+	if dir == "" {
+		store := raft.NewInmemStore()
+		return store, store, raft.NewInmemSnapshotStore(), nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(dir, raftRetainSnapshots, os.Stderr)
+	if err != nil {
+		store.Close()
+		return nil, nil, nil, nil, err
+	}
+	return store, store, snapshots, store, nil
+}
+
+// Creates storage replicated with raft between config.Peers.
+// Every node of the cluster has to list the same peers.
+func NewRaftStorage(config RaftConfig) (Storage, error) {
+	s := &raftStorage{
+		rpcAddrs: make(map[raft.ServerID]string),
+		tls:      config.ClientTls,
+		clients:  make(map[string]*rpc.Client),
+	}
+	peers := config.Peers
+	if !containsPeer(peers, config.NodeId) {
+		peers = append(peers, config.RaftPeer)
+	}
+	servers := make([]raft.Server, 0, len(peers))
+	for _, peer := range peers {
+		s.rpcAddrs[raft.ServerID(peer.NodeId)] = peer.RpcAddr
+		servers = append(servers, raft.Server{
+			ID:      raft.ServerID(peer.NodeId),
+			Address: raft.ServerAddress(peer.RaftAddr),
+		})
+	}
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(config.NodeId)
+	advertise, err := net.ResolveTCPAddr("tcp", config.RaftAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := raft.NewTCPTransport(config.RaftAddr, advertise, raftMaxPool, RAFT_DIAL_TIMEOUT, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	logs, stable, snapshots, store, err := newRaftStores(config.Dir)
+	if err != nil {
+		transport.Close()
+		return nil, err
+	}
+	s.store = store
+	closeStores := func() {
+		transport.Close()
+		if store != nil {
+			store.Close()
+		}
+	}
+	if config.Bootstrap {
+		err := raft.BootstrapCluster(raftConfig, logs, stable, snapshots, transport,
+			raft.Configuration{Servers: servers})
+		if err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			closeStores()
+			return nil, err
+		}
+	}
+	s.storage = newExpiringMultiMapStorage(SystemClock, s.expire)
+	node, err := raft.NewRaft(raftConfig, &registryFSM{storage: s.storage}, logs, stable, snapshots, transport)
+	if err != nil {
+		s.storage.Close()
+		closeStores()
+		return nil, err
+	}
+	// leases may expire while the log is replayed
+	s.lock.Lock()
+	s.raft = node
+	s.lock.Unlock()
+
+	server := rpc.NewServer()
+	if err := server.Register(&Registry{storage: s}); err != nil {
+		s.storage.Close()
+		s.raft.Shutdown()
+		if store != nil {
+			store.Close()
+		}
+		return nil, err
+	}
+	s.listener, err = net.Listen("tcp", config.RpcAddr)
+	if err != nil {
+		s.storage.Close()
+		s.raft.Shutdown()
+		if store != nil {
+			store.Close()
+		}
+		return nil, err
+	}
+	if config.ServerTls != nil {
+		s.listener = tls.NewListener(s.listener, config.ServerTls)
+	}
+	go s.serve(server)
+	log.Printf("Raft node %s started on %s, forwarding on %s\n", config.NodeId, config.RaftAddr, config.RpcAddr)
+	return s, nil
+}
+
+func containsPeer(peers []RaftPeer, nodeId string) bool {
+	for _, peer := range peers {
+		if peer.NodeId == nodeId {
+			return true
+		}
+	}
+	return false
+}
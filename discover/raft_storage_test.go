@@ -0,0 +1,298 @@
+package discover
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// startCluster starts raft nodes talking over loopback and waits for a leader.
+func startCluster(t *testing.T, size int) []*raftStorage {
+	t.Helper()
+	return startClusterWith(t, size, RaftConfig{})
+}
+
+// startClusterWith starts nodes with tls settings of base.
+func startClusterWith(t *testing.T, size int, base RaftConfig) []*raftStorage {
+	t.Helper()
+	peers := make([]RaftPeer, size)
+	for i := range peers {
+		peers[i] = RaftPeer{
+			NodeId:   fmt.Sprintf("node%d", i),
+			RaftAddr: freeAddress(t),
+			RpcAddr:  freeAddress(t),
+		}
+	}
+	nodes := make([]*raftStorage, size)
+	for i, peer := range peers {
+		config := base
+		config.RaftPeer, config.Bootstrap, config.Peers = peer, true, peers
+		storage, err := NewRaftStorage(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i] = storage.(*raftStorage)
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Close()
+		}
+	})
+	eventually(t, 10*time.Second, "leader wasnt elected", func() bool {
+		return leaderOf(nodes) != nil
+	})
+	return nodes
+}
+
+func leaderOf(nodes []*raftStorage) *raftStorage {
+	for _, node := range nodes {
+		if node.leader() {
+			return node
+		}
+	}
+	return nil
+}
+
+func followerOf(nodes []*raftStorage) *raftStorage {
+	for _, node := range nodes {
+		if !node.leader() {
+			return node
+		}
+	}
+	return nil
+}
+
+func eventually(t *testing.T, timeout time.Duration, message string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// converged checks every node has the same registry at the same revision.
+func converged(nodes []*raftStorage) bool {
+	first, err := nodes[0].Delta(0)
+	if err != nil {
+		return false
+	}
+	for _, node := range nodes[1:] {
+		delta, err := node.Delta(0)
+		if err != nil || delta.Revision != first.Revision || delta.Hash != first.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRaftStorageReplicatesWrites(t *testing.T) {
+	nodes := startCluster(t, 3)
+	follower := followerOf(nodes)
+
+	service := NewService("orders", "localhost:8080", false)
+	service.Ttl = time.Minute
+	if err := follower.Add(service); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Add(service); !errors.Is(err, ErrDuplicate) {
+		t.Errorf("forwarded duplicate returned %v, want %v", err, ErrDuplicate)
+	}
+	beat := service.LastHeartBeatCheck.Add(time.Second).Round(0)
+	if err := follower.UpdateLastHeartBeat(service, beat); err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.UpdateStatus(service.Id(), DOWN); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, "writes didnt reach every node", func() bool {
+		return converged(nodes)
+	})
+	for _, node := range nodes {
+		saved, err := node.GetById(service.Id())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if saved.Status != DOWN || !saved.LastHeartBeatCheck.Equal(beat) {
+			t.Errorf("node has %s %v, want %s %v", saved.Status, saved.LastHeartBeatCheck, DOWN, beat)
+		}
+	}
+}
+
+func TestRaftStorageExpiryConverges(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := leaderOf(nodes)
+
+	expiring := NewService("orders", "localhost:8080", false)
+	expiring.Ttl = 300 * time.Millisecond
+	kept := NewService("payments", "localhost:8081", false)
+	kept.Ttl = time.Minute
+	for _, service := range []Service{expiring, kept} {
+		if err := leader.Add(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eventually(t, 10*time.Second, "expired instance wasnt removed from every node", func() bool {
+		for _, node := range nodes {
+			if _, err := node.GetById(expiring.Id()); err == nil {
+				return false
+			}
+		}
+		return converged(nodes)
+	})
+	for _, node := range nodes {
+		if _, err := node.GetById(kept.Id()); err != nil {
+			t.Errorf("instance which didnt expire is missing: %v", err)
+		}
+	}
+}
+
+func TestRaftFollowerDoesntEvict(t *testing.T) {
+	nodes := startCluster(t, 3)
+	leader := leaderOf(nodes)
+	follower := followerOf(nodes)
+
+	service := NewService("orders", "localhost:8080", false)
+	service.Ttl = time.Minute
+	if err := leader.Add(service); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, "instance wasnt replicated", func() bool {
+		_, err := follower.GetById(service.Id())
+		return err == nil
+	})
+	follower.storage.leases.Revoke(service.Id())
+	follower.expire(service.Name, service.Id())
+	if _, err := follower.GetById(service.Id()); err != nil {
+		t.Fatal("follower removed the instance by itself")
+	}
+	deadline, ok := follower.storage.leases.Deadline(service.Id())
+	if !ok || deadline.Sub(time.Now()) > RAFT_EXPIRY_RETRY {
+		t.Errorf("follower lease is %v %v, want it retried within %v", deadline, ok, RAFT_EXPIRY_RETRY)
+	}
+}
+
+// testCertificate issues a certificate for 127.0.0.1 signed by parent,
+// self signed CA when parent is nil.
+func testCertificate(t *testing.T, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "discovery"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	issuer, signer := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		issuer, signer = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestRaftStorageForwardsOverTls(t *testing.T) {
+	ca := testCertificate(t, nil)
+	node := testCertificate(t, &ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	nodes := startClusterWith(t, 3, RaftConfig{
+		ServerTls: &tls.Config{
+			Certificates: []tls.Certificate{node},
+			ClientCAs:    pool,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		},
+		ClientTls: &tls.Config{Certificates: []tls.Certificate{node}, RootCAs: pool},
+	})
+	service := NewService("orders", "localhost:8080", false)
+	if err := followerOf(nodes).Add(service); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, "forwarded write didnt reach every node", func() bool {
+		return converged(nodes)
+	})
+
+	// followers without a client certificate arent served
+	leader := leaderOf(nodes)
+	conn, err := tls.Dial("tcp", leader.listener.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	command, _ := json.Marshal(toRecord(opAdd, NewService("orders", "localhost:8081", false)))
+	if err := client.Call("Registry.Apply", command, new(bool)); err == nil {
+		t.Error("write forwarded without a client certificate was applied")
+	}
+	if _, err := leader.GetByUrl("http://localhost:8081"); err == nil {
+		t.Error("instance forwarded without a client certificate was registered")
+	}
+}
+
+func TestRaftStorageCloseReleasesLog(t *testing.T) {
+	dir := t.TempDir()
+	peer := RaftPeer{NodeId: "node0", RaftAddr: freeAddress(t), RpcAddr: freeAddress(t)}
+	storage, err := NewRaftStorage(RaftConfig{RaftPeer: peer, Dir: dir, Bootstrap: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.(*raftStorage).Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the bolt store is locked until it's closed
+	reopened := make(chan error, 1)
+	go func() {
+		storage, err := NewRaftStorage(RaftConfig{RaftPeer: peer, Dir: dir})
+		if err == nil {
+			err = storage.(*raftStorage).Close()
+		}
+		reopened <- err
+	}()
+	select {
+	case err := <-reopened:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("raft log is still locked after Close")
+	}
+}
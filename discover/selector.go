@@ -0,0 +1,181 @@
+package discover
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Selector filters instances by their name, url, status, metadata and tags.
+// Expression is a comma separated list of requirements which all have to match:
+//
+//	key=value, key!=value    value may contain * wildcards e.g. version=2.*
+//	key in (a,b)             value is one of listed
+//	key notin (a,b)          value isnt any of listed
+//	key                      tag or metadata key is present
+//	!key                     tag or metadata key is absent
+//
+// Keys name, url and status match instance fields, others match metadata.
+type Selector struct {
+	requirements []requirement
+}
+
+type operator int
+
+const (
+	opEquals operator = iota
+	opNotEquals
+	opIn
+	opNotIn
+	opExists
+	opNotExists
+)
+
+type requirement struct {
+	key      string
+	operator operator
+	values   []*regexp.Regexp
+	// set when the requirement is an exact name match
+	exact string
+}
+
+var (
+	inPattern    = regexp.MustCompile(`^([^\s!=()]+)\s+in\s*\((.*)\)$`)
+	notInPattern = regexp.MustCompile(`^([^\s!=()]+)\s+notin\s*\((.*)\)$`)
+	keyPattern   = regexp.MustCompile(`^[^\s!=(),]+$`)
+)
+
+func ParseSelector(expression string) (Selector, error) {
+	var selector Selector
+	for _, term := range splitTerms(expression) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		req, err := parseRequirement(term)
+		if err != nil {
+			return Selector{}, err
+		}
+		selector.requirements = append(selector.requirements, req)
+	}
+	return selector, nil
+}
+
+func parseRequirement(term string) (requirement, error) {
+	if match := notInPattern.FindStringSubmatch(term); match != nil {
+		return newRequirement(match[1], opNotIn, strings.Split(match[2], ","))
+	}
+	if match := inPattern.FindStringSubmatch(term); match != nil {
+		return newRequirement(match[1], opIn, strings.Split(match[2], ","))
+	}
+	if index := strings.Index(term, "!="); index > 0 {
+		return newRequirement(term[:index], opNotEquals, []string{term[index+2:]})
+	}
+	if index := strings.Index(term, "="); index > 0 {
+		value := strings.TrimPrefix(term[index+1:], "=")
+		return newRequirement(term[:index], opEquals, []string{value})
+	}
+	if strings.HasPrefix(term, "!") {
+		return newRequirement(term[1:], opNotExists, nil)
+	}
+	return newRequirement(term, opExists, nil)
+}
+
+func newRequirement(key string, operator operator, values []string) (requirement, error) {
+	key = strings.TrimSpace(key)
+	if !keyPattern.MatchString(key) {
+		return requirement{}, fmt.Errorf("[err] invalid selector key %q", key)
+	}
+	req := requirement{key: key, operator: operator}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		pattern, err := regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(value), `\*`, ".*") + "$")
+		if err != nil {
+			return requirement{}, err
+		}
+		req.values = append(req.values, pattern)
+		if key == "name" && operator == opEquals && !strings.Contains(value, "*") {
+			req.exact = value
+		}
+	}
+	return req, nil
+}
+
+// splitTerms splits expression on commas outside of parentheses.
+func splitTerms(expression string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, char := range expression {
+		switch char {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, expression[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, expression[start:])
+}
+
+// ServiceName returns the service name when the selector requires exact one,
+// so storages can skip scanning other services.
+func (s Selector) ServiceName() (string, bool) {
+	for _, req := range s.requirements {
+		if req.exact != "" {
+			return req.exact, true
+		}
+	}
+	return "", false
+}
+
+func (s Selector) Matches(service Service) bool {
+	for _, req := range s.requirements {
+		if !req.matches(service) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r requirement) matches(service Service) bool {
+	value, present := lookup(service, r.key)
+	switch r.operator {
+	case opExists:
+		return present
+	case opNotExists:
+		return !present
+	case opEquals, opIn:
+		return present && matchesAny(r.values, value)
+	case opNotEquals, opNotIn:
+		return !present || !matchesAny(r.values, value)
+	}
+	return false
+}
+
+func lookup(service Service, key string) (string, bool) {
+	switch key {
+	case "name":
+		return service.Name, true
+	case "url":
+		return service.Url, true
+	case "status":
+		return string(service.Status), true
+	}
+	if value, ok := service.Metadata[key]; ok {
+		return value, true
+	}
+	return "", service.HasTag(key)
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, pattern := range patterns {
+		if pattern.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package discover
+
+import "testing"
+
+func TestParseSelectorErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		valid      bool
+	}{
+		{"", true},
+		{" , ", true},
+		{"version=2.*", true},
+		{"version==2", true},
+		{"env in (prod, staging), !canary", true},
+		{"env notin (dev)", true},
+		{"=prod", false},
+		{"!=prod", false},
+		{"!", false},
+		{"env in prod", false},
+		{"my env=prod", false},
+	}
+	for _, test := range tests {
+		_, err := ParseSelector(test.expression)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("ParseSelector(%q) returned %v, want valid %v", test.expression, err, test.valid)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	service := NewService("orders", "localhost:8080", false)
+	service.Status = DOWN
+	service.Metadata = map[string]string{"version": "2.1.0", "env": "prod"}
+	service.Tags = []string{"canary"}
+	tests := []struct {
+		expression string
+		want       bool
+	}{
+		{"", true},
+		{"name=orders", true},
+		{"name=payments", false},
+		{"name=ord*", true},
+		{"url=http://localhost:*", true},
+		{"url=localhost:*", false},
+		{"status=DOWN", true},
+		{"status!=UP", true},
+		{"version=2.*", true},
+		{"version=2.1", false},
+		{"version==2.1.0", true},
+		{"env!=prod", false},
+		{"zone!=eu", true},
+		{"env in (staging, prod)", true},
+		{"env in (staging,dev)", false},
+		{"zone in (eu)", false},
+		{"env notin (staging, dev)", true},
+		{"env notin (prod)", false},
+		{"zone notin (eu)", true},
+		{"canary", true},
+		{"env", true},
+		{"!canary", false},
+		{"!zone", true},
+		{"name=orders, env in (prod), !zone", true},
+		{"name=orders, env in (prod), zone", false},
+	}
+	for _, test := range tests {
+		selector, err := ParseSelector(test.expression)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q) failed: %v", test.expression, err)
+		}
+		if got := selector.Matches(service); got != test.want {
+			t.Errorf("%q matches = %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestSelectorServiceName(t *testing.T) {
+	tests := []struct {
+		expression string
+		name       string
+		exact      bool
+	}{
+		{"name=orders", "orders", true},
+		{"env=prod, name=orders", "orders", true},
+		{"name=ord*", "", false},
+		{"name!=orders", "", false},
+		{"name in (orders)", "", false},
+		{"env=prod", "", false},
+	}
+	for _, test := range tests {
+		selector, err := ParseSelector(test.expression)
+		if err != nil {
+			t.Fatalf("ParseSelector(%q) failed: %v", test.expression, err)
+		}
+		if name, exact := selector.ServiceName(); name != test.name || exact != test.exact {
+			t.Errorf("%q ServiceName() = %q %v, want %q %v", test.expression, name, exact, test.name, test.exact)
+		}
+	}
+}
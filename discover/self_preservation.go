@@ -0,0 +1,135 @@
+package discover
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	RENEWAL_PERCENT_THRESHOLD = 0.85
+	RENEWAL_INTERVAL          = 30 * time.Second
+	RENEWAL_RATE_WINDOW       = time.Minute
+)
+
+type SelfPreservationConfig struct {
+	// Fraction of expected renewals per minute below which eviction
+	// is suspended, RENEWAL_PERCENT_THRESHOLD when 0.
+	Threshold float64
+	// How often every instance is expected to heartbeat, RENEWAL_INTERVAL when 0.
+	RenewalInterval time.Duration
+}
+
+type SelfPreservationStatus struct {
+	Enabled bool `json:"enabled"`
+	// Eviction is suspended while active.
+	Active                    bool `json:"active"`
+	ExpectedRenewalsPerMinute int  `json:"expectedRenewalsPerMinute"`
+	RenewalsLastMinute        int  `json:"renewalsLastMinute"`
+}
+
+// selfPreservation counts heartbeats in one minute buckets like eureka does,
+// when fewer renewals than expected arrived in the last minute the server
+// is more likely partitioned from its clients than they are all down.
+type selfPreservation struct {
+	config      SelfPreservationConfig
+	enabled     bool
+	active      bool
+	bucketStart time.Time
+	current     int
+	lastMinute  int
+	// lastMinute is meaningless until the first whole minute passed
+	measured bool
+	lock     sync.Mutex
+}
+
+func (c *SelfPreservationConfig) withDefaults() SelfPreservationConfig {
+	config := *c
+	if config.Threshold <= 0 {
+		config.Threshold = RENEWAL_PERCENT_THRESHOLD
+	}
+	if config.RenewalInterval <= 0 {
+		config.RenewalInterval = RENEWAL_INTERVAL
+	}
+	return config
+}
+
+func (p *selfPreservation) enable(config SelfPreservationConfig, now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.config = config.withDefaults()
+	if !p.enabled {
+		p.enabled = true
+		p.bucketStart = now
+		p.current, p.lastMinute, p.measured = 0, 0, false
+	}
+}
+
+func (p *selfPreservation) disable() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.enabled = false
+	p.active = false
+}
+
+func (p *selfPreservation) renewed(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabled {
+		return
+	}
+	p.roll(now)
+	p.current++
+}
+
+// status evaluates whether eviction has to be suspended for instances leases.
+func (p *selfPreservation) status(instances int, now time.Time) SelfPreservationStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.enabled {
+		return SelfPreservationStatus{}
+	}
+	p.roll(now)
+	expected := int(float64(instances) *
+		float64(RENEWAL_RATE_WINDOW) / float64(p.config.RenewalInterval) *
+		p.config.Threshold)
+	active := p.measured && expected > 0 && p.lastMinute < expected
+	if active != p.active {
+		if active {
+			log.Printf("Self-preservation mode activated: %d renewals in the last minute, expected %d, eviction suspended\n",
+				p.lastMinute, expected)
+		} else {
+			log.Printf("Self-preservation mode deactivated: %d renewals in the last minute, expected %d, eviction resumed\n",
+				p.lastMinute, expected)
+		}
+		p.active = active
+	}
+	return SelfPreservationStatus{
+		Enabled:                   true,
+		Active:                    active,
+		ExpectedRenewalsPerMinute: expected,
+		RenewalsLastMinute:        p.lastMinute,
+	}
+}
+
+// nextBucket returns when renewals of the current minute become the last minute ones.
+func (p *selfPreservation) nextBucket() time.Time {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.bucketStart.Add(RENEWAL_RATE_WINDOW)
+}
+
+func (p *selfPreservation) roll(now time.Time) {
+	elapsed := now.Sub(p.bucketStart)
+	if elapsed < RENEWAL_RATE_WINDOW {
+		return
+	}
+	if elapsed < 2*RENEWAL_RATE_WINDOW {
+		p.lastMinute = p.current
+	} else {
+		p.lastMinute = 0
+	}
+	p.current = 0
+	p.measured = true
+	p.bucketStart = p.bucketStart.Add(elapsed.Truncate(RENEWAL_RATE_WINDOW))
+}
@@ -0,0 +1,81 @@
+package discover
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSelfPreservationExpectedRenewals(t *testing.T) {
+	tests := []struct {
+		instances int
+		config    SelfPreservationConfig
+		want      int
+	}{
+		{0, SelfPreservationConfig{}, 0},
+		{1, SelfPreservationConfig{}, 1},
+		{10, SelfPreservationConfig{}, 17},
+		{10, SelfPreservationConfig{Threshold: 0.5}, 10},
+		{10, SelfPreservationConfig{RenewalInterval: 10 * time.Second}, 51},
+		{3, SelfPreservationConfig{Threshold: 1, RenewalInterval: 20 * time.Second}, 9},
+		{4, SelfPreservationConfig{Threshold: 0.5, RenewalInterval: 2 * time.Minute}, 1},
+	}
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		var p selfPreservation
+		p.enable(test.config, now)
+		if got := p.status(test.instances, now).ExpectedRenewalsPerMinute; got != test.want {
+			t.Errorf("%d instances with %+v expect %d renewals, want %d", test.instances, test.config, got, test.want)
+		}
+	}
+}
+
+func TestSelfPreservationActivation(t *testing.T) {
+	tests := []struct {
+		name string
+		// renewals in the first minute
+		renewals int
+		// how long after enabling the status is evaluated
+		after  time.Duration
+		active bool
+	}{
+		{"not measured yet", 0, 59 * time.Second, false},
+		{"enough renewals", 17, time.Minute, false},
+		{"too few renewals", 16, time.Minute, true},
+		{"no renewals", 0, time.Minute + time.Second, true},
+		// the minute without renewals is the last one
+		{"renewals got stale", 17, 2 * time.Minute, true},
+	}
+	start := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		var p selfPreservation
+		p.enable(SelfPreservationConfig{}, start)
+		for i := 0; i < test.renewals; i++ {
+			p.renewed(start.Add(time.Duration(i) * time.Second))
+		}
+		status := p.status(10, start.Add(test.after))
+		if status.Active != test.active {
+			t.Errorf("%s: active = %v with %d renewals, want %v", test.name, status.Active, status.RenewalsLastMinute, test.active)
+		}
+	}
+}
+
+func TestSelfPreservationSuspendsEviction(t *testing.T) {
+	m, clock, expired := newTestLeases(t)
+	m.EnableSelfPreservation(SelfPreservationConfig{})
+	for i := 0; i < 10; i++ {
+		m.Grant("orders", uuid.New(), 30*time.Second, clock.Now())
+	}
+	clock.Advance(time.Minute)
+	if reaped := m.ReapExpired(); reaped != 0 {
+		t.Fatalf("reaped %d leases in self-preservation", reaped)
+	}
+	if status := m.SelfPreservation(); !status.Active || status.ExpectedRenewalsPerMinute != 17 {
+		t.Errorf("status is %+v, want active expecting 17 renewals", status)
+	}
+	m.DisableSelfPreservation()
+	if reaped := m.ReapExpired(); reaped != 10 || len(*expired) != 10 {
+		t.Errorf("reaped %d leases after disabling self-preservation, want 10", reaped)
+	}
+}
@@ -1,7 +1,9 @@
 package discover
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,11 +14,39 @@ const (
 	HTTP  = "http://"
 )
 
+type Status string
+
+const (
+	STARTING       Status = "STARTING"
+	UP             Status = "UP"
+	DOWN           Status = "DOWN"
+	OUT_OF_SERVICE Status = "OUT_OF_SERVICE"
+)
+
+// ErrUnknownStatus is returned by ParseStatus for names of no Status.
+var ErrUnknownStatus = errors.New("[err] unknown status")
+
+// Parses status name, empty name is UP.
+func ParseStatus(name string) (Status, error) {
+	switch status := Status(strings.ToUpper(name)); status {
+	case "":
+		return UP, nil
+	case STARTING, UP, DOWN, OUT_OF_SERVICE:
+		return status, nil
+	}
+	return "", fmt.Errorf("%w %s", ErrUnknownStatus, name)
+}
+
 type Service struct {
-	id                 uuid.UUID
-	Name               string    `json:"name"`
-	Url                string    `json:"url"`
-	LastHeartBeatCheck time.Time `json:"lastHeartBeatCheck"`
+	id       uuid.UUID
+	Name     string            `json:"name"`
+	Url      string            `json:"url"`
+	Status   Status            `json:"status"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	// Time after the last heartbeat when the service expires, DELETION_TIME when zero.
+	Ttl                time.Duration `json:"ttl,omitempty"`
+	LastHeartBeatCheck time.Time     `json:"lastHeartBeatCheck"`
 }
 
 func NewService(name string, url string, secure bool) Service {
@@ -24,9 +54,32 @@ func NewService(name string, url string, secure bool) Service {
 		id:                 uuid.New(),
 		Name:               name,
 		Url:                PrepareUrl(url, secure),
+		Status:             UP,
 		LastHeartBeatCheck: time.Now(),
 	}
 }
+
+// Recreates service registered on another node, url is already prepared.
+func RestoreService(name string, url string, lastHeartBeat time.Time) Service {
+	return Service{
+		id:                 uuid.New(),
+		Name:               name,
+		Url:                url,
+		Status:             UP,
+		LastHeartBeatCheck: lastHeartBeat,
+	}
+}
+func (s Service) Id() uuid.UUID {
+	return s.id
+}
+func (s Service) HasTag(tag string) bool {
+	for _, saved := range s.Tags {
+		if saved == tag {
+			return true
+		}
+	}
+	return false
+}
 func PrepareUrl(url string, secure bool) string {
 	if secure {
 		return fmt.Sprintf("%s%s", HTTPS, url)
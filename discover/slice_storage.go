@@ -13,113 +13,200 @@ import (
 type inMemoryStorage struct {
 	services []Service
 	lock     sync.RWMutex
+	events   *eventBroadcaster
+	leases   *LeaseManager
 }
 
 func (s *inMemoryStorage) Add(service Service) error {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	if serv, err := s.Get(service.Name); err != nil {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if serv := s.get(service.Name); serv == nil {
 		s.services = append(s.services, service)
-		s.deleteIfOlderThan(service, DELETION_TIME)
+		s.events.publish(ADDED, service)
+		s.leases.Grant(service.Name, service.id, service.Ttl, service.LastHeartBeatCheck)
 		return nil
 	} else {
-		return fmt.Errorf("[err] cannot replace old instance of that service %s", serv.Name)
+		return fmt.Errorf("%w for %s, cannot replace old instance of that service", ErrDuplicate, serv.Name)
 	}
 }
 
 func (s *inMemoryStorage) Remove(serviceName string, serviceId uuid.UUID) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	return s.remove(serviceId)
+}
+
+// remove has to be called with lock held.
+func (s *inMemoryStorage) remove(serviceId uuid.UUID) error {
 	for index, service := range s.services {
 		if service.id == serviceId {
 			s.services[index] = s.services[len(s.services)-1]
 			s.services = s.services[:len(s.services)-1]
+			s.leases.Revoke(serviceId)
+			s.events.publish(REMOVED, service)
 			return nil
 		}
 	}
-	return fmt.Errorf("[err] service with id = %v not found", serviceId)
+	return fmt.Errorf("%w with id %v", ErrNotFound, serviceId)
 }
 
 func (s *inMemoryStorage) Get(serviceName string) (*Service, error) {
-	for i := 0; i < len(s.services); i++ {
-		service := &s.services[i]
-		if service.Name == serviceName {
-			return service, nil
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if service := s.get(serviceName); service != nil {
+		found := *service
+		return &found, nil
+	}
+	return &Service{}, fmt.Errorf("%w named %s", ErrNotFound, serviceName)
+}
+
+func (s *inMemoryStorage) ListInstances(serviceName string) ([]Service, error) {
+	service, err := s.Get(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return []Service{*service}, nil
+}
+
+func (s *inMemoryStorage) FindInstances(selector Selector) ([]Service, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	result := make([]Service, 0)
+	for _, service := range s.services {
+		if selector.Matches(service) {
+			result = append(result, service)
 		}
 	}
-	return &Service{}, fmt.Errorf("[err] service %s not found", serviceName)
+	return result, nil
 }
 
 func (s *inMemoryStorage) GetById(serviceId uuid.UUID) (*Service, error) {
-	for i := 0; i < len(s.services); i++ {
-		service := &s.services[i]
-		if service.id == serviceId {
-			return service, nil
-		}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if service := s.getById(serviceId); service != nil {
+		found := *service
+		return &found, nil
 	}
-	return &Service{}, fmt.Errorf("[err] service %s not found", serviceId)
+	return &Service{}, fmt.Errorf("%w with id %v", ErrNotFound, serviceId)
 }
 
 func (s *inMemoryStorage) GetByUrl(serviceUrl string) (*Service, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	for i := 0; i < len(s.services); i++ {
-		service := &s.services[i]
+		service := s.services[i]
 		if service.Url == serviceUrl {
-			return service, nil
+			return &service, nil
 		}
 	}
-	return &Service{}, fmt.Errorf("[err] service with url %s not found", serviceUrl)
+	return &Service{}, fmt.Errorf("%w with url %s", ErrNotFound, serviceUrl)
 }
 
 func (s *inMemoryStorage) GetAllServices() ([]Service, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 	if s.services != nil {
-		return s.services, nil
+		return append([]Service(nil), s.services...), nil
 	}
 	return nil, errors.New("[err] there arent any discovered services")
 }
 
 func (s *inMemoryStorage) UpdateLastHeartBeat(service Service, newTime time.Time) error {
-	serv, err := s.Get(service.Name)
-	if err != nil {
-		return err
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	serv := s.get(service.Name)
+	if serv == nil {
+		return fmt.Errorf("%w named %s", ErrNotFound, service.Name)
 	}
 	serv.LastHeartBeatCheck = newTime
+	s.leases.Renew(serv.id, newTime)
+	s.events.touch(*serv)
 	return nil
 }
 
-func (s *inMemoryStorage) deleteIfOlderThan(service Service, duration time.Duration) {
-	log.Printf("Starting deletion procedure for unhealthy services %s 1/1.5min\n", service.id)
-	quit := make(chan bool)
-	go func(quit chan bool) {
-		ticker := time.NewTicker(duration)
-		for tick := range ticker.C {
-			select {
-			case <-quit:
-				return
-			default:
-				s.performDeletion(quit, service, duration, tick)
-			}
+func (s *inMemoryStorage) UpdateStatus(serviceId uuid.UUID, status Status) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	serv := s.getById(serviceId)
+	if serv == nil {
+		return fmt.Errorf("%w with id %v", ErrNotFound, serviceId)
+	}
+	serv.Status = status
+	s.events.publish(UPDATED, *serv)
+	return nil
+}
+
+func (s *inMemoryStorage) Watch(serviceName string, revision uint64) (*Watcher, error) {
+	return s.events.watch(serviceName, revision)
+}
+
+func (s *inMemoryStorage) Revision() uint64 {
+	return s.events.current()
+}
+
+func (s *inMemoryStorage) ServiceRevision(serviceName string) uint64 {
+	return s.events.serviceRevision(serviceName)
+}
+
+func (s *inMemoryStorage) Delta(revision uint64) (*Delta, error) {
+	return s.events.delta(revision)
+}
+
+func (s *inMemoryStorage) broadcaster() *eventBroadcaster {
+	return s.events
+}
+
+func (s *inMemoryStorage) Leases() *LeaseManager {
+	return s.leases
+}
+
+// Close stops evicting expired services.
+func (s *inMemoryStorage) Close() error {
+	s.leases.Stop()
+	return nil
+}
+
+func (s *inMemoryStorage) get(serviceName string) *Service {
+	for i := 0; i < len(s.services); i++ {
+		if s.services[i].Name == serviceName {
+			return &s.services[i]
 		}
-	}(quit)
-}
-
-func (s *inMemoryStorage) performDeletion(
-	quit chan bool,
-	service Service,
-	duration time.Duration,
-	tick time.Time) {
-	saved, err := s.GetById(service.id)
-	if err == nil && saved.LastHeartBeatCheck.Add(duration).Before(tick) {
-		log.Printf("Service %s unhealthy -> performing deletion\n", service.id)
-		err := s.Remove(service.Name, service.id)
-		if err != nil {
-			log.Println(err)
-		} else {
-			log.Printf("Stoping deletion procedure for unhealthy services %s 1/1.5min\n", service.id)
-			quit <- true
+	}
+	return nil
+}
+
+func (s *inMemoryStorage) getById(serviceId uuid.UUID) *Service {
+	for i := 0; i < len(s.services); i++ {
+		if s.services[i].id == serviceId {
+			return &s.services[i]
 		}
 	}
+	return nil
+}
+
+// expire checks the heartbeat again under the lock, one which arrived after
+// the lease was popped renews it instead of the instance being evicted.
+func (s *inMemoryStorage) expire(serviceName string, serviceId uuid.UUID) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if service := s.getById(serviceId); service != nil &&
+		s.leases.regrant(serviceName, serviceId, service.Ttl, service.LastHeartBeatCheck) {
+		return
+	}
+	if err := s.remove(serviceId); err != nil {
+		log.Println(err)
+	} else {
+		log.Printf("Deleted unhealthy service %s\n", serviceId)
+	}
 }
 
 func NewInMemoryStorage() Storage {
-	return &inMemoryStorage{}
+	return NewInMemoryStorageWithClock(SystemClock)
+}
+
+// Storage expiring services by the given clock.
+func NewInMemoryStorageWithClock(clock Clock) Storage {
+	s := &inMemoryStorage{events: newEventBroadcaster()}
+	s.leases = NewLeaseManager(clock, s.expire)
+	return s
 }
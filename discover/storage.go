@@ -1,6 +1,7 @@
 package discover
 
 import (
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,12 +9,32 @@ import (
 
 const DELETION_TIME = 90 * time.Second
 
+var (
+	// ErrDuplicate is returned by Add when the instance is already registered.
+	ErrDuplicate = errors.New("[err] duplicate found")
+	// ErrNotFound is returned when the instance or service isnt registered.
+	ErrNotFound = errors.New("[err] service not found")
+)
+
 type Storage interface {
 	Add(service Service) error
 	Remove(serviceName string, serviceId uuid.UUID) error
 	Get(serviceName string) (*Service, error)
+	ListInstances(serviceName string) ([]Service, error)
+	FindInstances(selector Selector) ([]Service, error)
 	GetById(serviceId uuid.UUID) (*Service, error)
 	GetByUrl(serviceUrl string) (*Service, error)
 	GetAllServices() ([]Service, error)
 	UpdateLastHeartBeat(service Service, newTime time.Time) error
+	UpdateStatus(serviceId uuid.UUID, status Status) error
+	Watch(serviceName string, revision uint64) (*Watcher, error)
+	// Revision is incremented on every change of the registry.
+	Revision() uint64
+	// ServiceRevision is the revision serviceName last changed at, its
+	// instances were added, removed or changed status. Revision when empty.
+	ServiceRevision(serviceName string) uint64
+	// Delta returns changes after revision, the whole registry when it's 0.
+	Delta(revision uint64) (*Delta, error)
+	// Leases expiring the stored instances.
+	Leases() *LeaseManager
 }
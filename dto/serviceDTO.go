@@ -1,26 +1,136 @@
 package dto
 
 import (
+	"fmt"
 	"time"
 
+	"github.com/ygaros/discovery-server/discover"
 	proto "github.com/ygaros/discovery-server/gen/proto"
 )
 
+// Layout of lastHeartBeat sent over grpc.
+const TIME_FORMAT = "2006-01-02 15:04:05.999999999 -0700 MST"
+
 type Service struct {
 	Name   string `json:"name"`
 	Url    string `json:"url"`
 	Secure bool   `json:"secure"`
+	// Initial status, UP when empty.
+	Status   string            `json:"status,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+	// Seconds without heartbeat after which instance expires,
+	// discover.DELETION_TIME when 0.
+	Ttl int64 `json:"ttl,omitempty"`
 }
 type ServiceHeartBeat struct {
-	Name          string    `json:"name"`
-	Url           string    `json:"url"`
-	LastHeartBeat time.Time `json:"lastHeartBeat"`
+	Id            string            `json:"id"`
+	Name          string            `json:"name"`
+	Url           string            `json:"url"`
+	Status        string            `json:"status"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	LastHeartBeat time.Time         `json:"lastHeartBeat"`
+}
+type Deregistration struct {
+	// Instance is looked up by id when it's set, by url otherwise.
+	Id     string `json:"id,omitempty"`
+	Url    string `json:"url,omitempty"`
+	Secure bool   `json:"secure"`
+}
+type ServiceStatus struct {
+	Url    string `json:"url"`
+	Secure bool   `json:"secure"`
+	Status string `json:"status"`
+}
+
+type ServiceEvent struct {
+	Type     string           `json:"type"`
+	Revision uint64           `json:"revision"`
+	Service  ServiceHeartBeat `json:"service"`
+}
+
+// Changes after the requested revision, the whole registry
+// as ADDED events when it was 0.
+type RegistryDelta struct {
+	Revision uint64         `json:"revision"`
+	Hash     string         `json:"hash"`
+	Events   []ServiceEvent `json:"events"`
+}
+
+// RegistryHash of the client copy of the registry has to match
+// RegistryDelta.Hash after applying the delta, full fetch is needed otherwise.
+func RegistryHash(instances []ServiceHeartBeat) string {
+	var hash uint64
+	for _, instance := range instances {
+		hash ^= discover.InstanceHash(instance.Id, instance.Name, instance.Url, instance.Status)
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+type SelfPreservation struct {
+	Enabled bool `json:"enabled"`
+	// Expired instances arent evicted while active.
+	Active                    bool `json:"active"`
+	ExpectedRenewalsPerMinute int  `json:"expectedRenewalsPerMinute"`
+	RenewalsLastMinute        int  `json:"renewalsLastMinute"`
+}
+
+const (
+	REPLICATE_REGISTER  = "register"
+	REPLICATE_HEARTBEAT = "heartbeat"
+	REPLICATE_CANCEL    = "cancel"
+	REPLICATE_STATUS    = "status"
+)
+
+type ReplicationEvent struct {
+	Action        string            `json:"action"`
+	Name          string            `json:"name"`
+	Url           string            `json:"url"`
+	Status        string            `json:"status"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Ttl           int64             `json:"ttl,omitempty"`
+	LastHeartBeat time.Time         `json:"lastHeartBeat"`
 }
 
 func ToService(service *proto.Service) Service {
 	return Service{
-		Name:   service.Name,
-		Url:    service.Url,
-		Secure: service.Secure,
+		Name:     service.Name,
+		Url:      service.Url,
+		Secure:   service.Secure,
+		Status:   service.Status.String(),
+		Metadata: service.Metadata,
+		Tags:     service.Tags,
+		Ttl:      service.Ttl,
+	}
+}
+
+func ToServiceHeartBeat(service *proto.ServiceWithHeartBeat) ServiceHeartBeat {
+	lastHeartBeat, _ := time.Parse(TIME_FORMAT, service.LastHeartBeat)
+	return ServiceHeartBeat{
+		Id:            service.Id,
+		Name:          service.Name,
+		Url:           service.Url,
+		Status:        service.Status.String(),
+		Metadata:      service.Metadata,
+		Tags:          service.Tags,
+		LastHeartBeat: lastHeartBeat,
+	}
+}
+
+func ToDeregistration(request *proto.DeregisterRequest) Deregistration {
+	return Deregistration{
+		Id:     request.Id,
+		Url:    request.Url,
+		Secure: request.Secure,
+	}
+}
+
+func ToServiceStatus(request *proto.StatusRequest) ServiceStatus {
+	return ServiceStatus{
+		Url:    request.Url,
+		Secure: request.Secure,
+		Status: request.Status.String(),
 	}
 }
@@ -22,10 +22,17 @@ const _ = grpc.SupportPackageIsVersion7
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type DiscoveryClient interface {
-	AddService(ctx context.Context, in *Service, opts ...grpc.CallOption) (*Empty, error)
+	AddService(ctx context.Context, in *Service, opts ...grpc.CallOption) (*Registration, error)
+	Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*Empty, error)
 	ListServices(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListServiceResponse, error)
 	HeartBeat(ctx context.Context, in *Service, opts ...grpc.CallOption) (*Empty, error)
 	GetService(ctx context.Context, in *GetServiceRequest, opts ...grpc.CallOption) (*ServiceWithHeartBeat, error)
+	ListInstances(ctx context.Context, in *GetServiceRequest, opts ...grpc.CallOption) (*ListServiceResponse, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Discovery_WatchClient, error)
+	SetStatus(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*Empty, error)
+	FindInstances(ctx context.Context, in *FindInstancesRequest, opts ...grpc.CallOption) (*ListServiceResponse, error)
+	GetSelfPreservation(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*SelfPreservation, error)
+	GetDelta(ctx context.Context, in *DeltaRequest, opts ...grpc.CallOption) (*DeltaResponse, error)
 }
 
 type discoveryClient struct {
@@ -36,8 +43,8 @@ func NewDiscoveryClient(cc grpc.ClientConnInterface) DiscoveryClient {
 	return &discoveryClient{cc}
 }
 
-func (c *discoveryClient) AddService(ctx context.Context, in *Service, opts ...grpc.CallOption) (*Empty, error) {
-	out := new(Empty)
+func (c *discoveryClient) AddService(ctx context.Context, in *Service, opts ...grpc.CallOption) (*Registration, error) {
+	out := new(Registration)
 	err := c.cc.Invoke(ctx, "/Discovery/AddService", in, out, opts...)
 	if err != nil {
 		return nil, err
@@ -45,6 +52,15 @@ func (c *discoveryClient) AddService(ctx context.Context, in *Service, opts ...g
 	return out, nil
 }
 
+func (c *discoveryClient) Deregister(ctx context.Context, in *DeregisterRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/Discovery/Deregister", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *discoveryClient) ListServices(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*ListServiceResponse, error) {
 	out := new(ListServiceResponse)
 	err := c.cc.Invoke(ctx, "/Discovery/ListServices", in, out, opts...)
@@ -72,14 +88,98 @@ func (c *discoveryClient) GetService(ctx context.Context, in *GetServiceRequest,
 	return out, nil
 }
 
+func (c *discoveryClient) ListInstances(ctx context.Context, in *GetServiceRequest, opts ...grpc.CallOption) (*ListServiceResponse, error) {
+	out := new(ListServiceResponse)
+	err := c.cc.Invoke(ctx, "/Discovery/ListInstances", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *discoveryClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (Discovery_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Discovery_ServiceDesc.Streams[0], "/Discovery/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &discoveryWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Discovery_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type discoveryWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *discoveryWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *discoveryClient) SetStatus(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/Discovery/SetStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *discoveryClient) FindInstances(ctx context.Context, in *FindInstancesRequest, opts ...grpc.CallOption) (*ListServiceResponse, error) {
+	out := new(ListServiceResponse)
+	err := c.cc.Invoke(ctx, "/Discovery/FindInstances", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *discoveryClient) GetSelfPreservation(ctx context.Context, in *Empty, opts ...grpc.CallOption) (*SelfPreservation, error) {
+	out := new(SelfPreservation)
+	err := c.cc.Invoke(ctx, "/Discovery/GetSelfPreservation", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *discoveryClient) GetDelta(ctx context.Context, in *DeltaRequest, opts ...grpc.CallOption) (*DeltaResponse, error) {
+	out := new(DeltaResponse)
+	err := c.cc.Invoke(ctx, "/Discovery/GetDelta", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DiscoveryServer is the server API for Discovery service.
 // All implementations must embed UnimplementedDiscoveryServer
 // for forward compatibility
 type DiscoveryServer interface {
-	AddService(context.Context, *Service) (*Empty, error)
+	AddService(context.Context, *Service) (*Registration, error)
+	Deregister(context.Context, *DeregisterRequest) (*Empty, error)
 	ListServices(context.Context, *Empty) (*ListServiceResponse, error)
 	HeartBeat(context.Context, *Service) (*Empty, error)
 	GetService(context.Context, *GetServiceRequest) (*ServiceWithHeartBeat, error)
+	ListInstances(context.Context, *GetServiceRequest) (*ListServiceResponse, error)
+	Watch(*WatchRequest, Discovery_WatchServer) error
+	SetStatus(context.Context, *StatusRequest) (*Empty, error)
+	FindInstances(context.Context, *FindInstancesRequest) (*ListServiceResponse, error)
+	GetSelfPreservation(context.Context, *Empty) (*SelfPreservation, error)
+	GetDelta(context.Context, *DeltaRequest) (*DeltaResponse, error)
 	mustEmbedUnimplementedDiscoveryServer()
 }
 
@@ -87,9 +187,12 @@ type DiscoveryServer interface {
 type UnimplementedDiscoveryServer struct {
 }
 
-func (UnimplementedDiscoveryServer) AddService(context.Context, *Service) (*Empty, error) {
+func (UnimplementedDiscoveryServer) AddService(context.Context, *Service) (*Registration, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method AddService not implemented")
 }
+func (UnimplementedDiscoveryServer) Deregister(context.Context, *DeregisterRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Deregister not implemented")
+}
 func (UnimplementedDiscoveryServer) ListServices(context.Context, *Empty) (*ListServiceResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListServices not implemented")
 }
@@ -99,6 +202,24 @@ func (UnimplementedDiscoveryServer) HeartBeat(context.Context, *Service) (*Empty
 func (UnimplementedDiscoveryServer) GetService(context.Context, *GetServiceRequest) (*ServiceWithHeartBeat, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetService not implemented")
 }
+func (UnimplementedDiscoveryServer) ListInstances(context.Context, *GetServiceRequest) (*ListServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListInstances not implemented")
+}
+func (UnimplementedDiscoveryServer) Watch(*WatchRequest, Discovery_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedDiscoveryServer) SetStatus(context.Context, *StatusRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetStatus not implemented")
+}
+func (UnimplementedDiscoveryServer) FindInstances(context.Context, *FindInstancesRequest) (*ListServiceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FindInstances not implemented")
+}
+func (UnimplementedDiscoveryServer) GetSelfPreservation(context.Context, *Empty) (*SelfPreservation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSelfPreservation not implemented")
+}
+func (UnimplementedDiscoveryServer) GetDelta(context.Context, *DeltaRequest) (*DeltaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDelta not implemented")
+}
 func (UnimplementedDiscoveryServer) mustEmbedUnimplementedDiscoveryServer() {}
 
 // UnsafeDiscoveryServer may be embedded to opt out of forward compatibility for this service.
@@ -130,6 +251,24 @@ func _Discovery_AddService_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Discovery_Deregister_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeregisterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoveryServer).Deregister(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Discovery/Deregister",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoveryServer).Deregister(ctx, req.(*DeregisterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Discovery_ListServices_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(Empty)
 	if err := dec(in); err != nil {
@@ -184,6 +323,117 @@ func _Discovery_GetService_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Discovery_ListInstances_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServiceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoveryServer).ListInstances(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Discovery/ListInstances",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoveryServer).ListInstances(ctx, req.(*GetServiceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Discovery_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DiscoveryServer).Watch(m, &discoveryWatchServer{stream})
+}
+
+type Discovery_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type discoveryWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *discoveryWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Discovery_SetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoveryServer).SetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Discovery/SetStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoveryServer).SetStatus(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Discovery_FindInstances_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FindInstancesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoveryServer).FindInstances(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Discovery/FindInstances",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoveryServer).FindInstances(ctx, req.(*FindInstancesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Discovery_GetSelfPreservation_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoveryServer).GetSelfPreservation(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Discovery/GetSelfPreservation",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoveryServer).GetSelfPreservation(ctx, req.(*Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Discovery_GetDelta_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeltaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DiscoveryServer).GetDelta(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Discovery/GetDelta",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DiscoveryServer).GetDelta(ctx, req.(*DeltaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Discovery_ServiceDesc is the grpc.ServiceDesc for Discovery service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -195,6 +445,10 @@ var Discovery_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "AddService",
 			Handler:    _Discovery_AddService_Handler,
 		},
+		{
+			MethodName: "Deregister",
+			Handler:    _Discovery_Deregister_Handler,
+		},
 		{
 			MethodName: "ListServices",
 			Handler:    _Discovery_ListServices_Handler,
@@ -207,7 +461,33 @@ var Discovery_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetService",
 			Handler:    _Discovery_GetService_Handler,
 		},
+		{
+			MethodName: "ListInstances",
+			Handler:    _Discovery_ListInstances_Handler,
+		},
+		{
+			MethodName: "SetStatus",
+			Handler:    _Discovery_SetStatus_Handler,
+		},
+		{
+			MethodName: "FindInstances",
+			Handler:    _Discovery_FindInstances_Handler,
+		},
+		{
+			MethodName: "GetSelfPreservation",
+			Handler:    _Discovery_GetSelfPreservation_Handler,
+		},
+		{
+			MethodName: "GetDelta",
+			Handler:    _Discovery_GetDelta_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _Discovery_Watch_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "discovery.proto",
 }
@@ -0,0 +1,199 @@
+// Package resolver lets grpc clients dial registered services by name:
+//
+//	conn, err := grpc.Dial("discovery:///orders", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//
+// Every UP instance of the service is resolved and kept up to date by watching
+// the discovery server, calls are balanced over them with round robin.
+// The discovery server address can be given as the target authority,
+// discovery://10.0.0.1:7654/orders, DEFAULT_ADDRESS is used otherwise.
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	proto "github.com/ygaros/discovery-server/gen/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcresolver "google.golang.org/grpc/resolver"
+)
+
+const (
+	SCHEME          = "discovery"
+	DEFAULT_ADDRESS = "localhost:7654"
+	// Delay before resolving again after the discovery server failed.
+	RETRY_INTERVAL = 5 * time.Second
+	serviceConfig  = `{"loadBalancingConfig":[{"round_robin":{}}]}`
+)
+
+func init() {
+	grpcresolver.Register(NewBuilder(DEFAULT_ADDRESS))
+}
+
+type builder struct {
+	address     string
+	dialOptions []grpc.DialOption
+}
+
+// NewBuilder creates builder resolving through the discovery server on address,
+// it's passed to grpc.WithResolvers to override the registered one.
+// Insecure credentials are used unless dialOptions say otherwise.
+func NewBuilder(address string, dialOptions ...grpc.DialOption) grpcresolver.Builder {
+	return &builder{address: address, dialOptions: dialOptions}
+}
+
+func (b *builder) Scheme() string {
+	return SCHEME
+}
+
+func (b *builder) Build(target grpcresolver.Target, cc grpcresolver.ClientConn, _ grpcresolver.BuildOptions) (grpcresolver.Resolver, error) {
+	serviceName := strings.TrimPrefix(target.URL.Path, "/")
+	if len(serviceName) == 0 {
+		serviceName = target.URL.Opaque
+	}
+	if len(serviceName) == 0 {
+		return nil, fmt.Errorf("[err] service name is missing in %s", target.URL.String())
+	}
+	address := b.address
+	if len(target.URL.Host) > 0 {
+		address = target.URL.Host
+	}
+	options := append([]grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}, b.dialOptions...)
+	conn, err := grpc.Dial(address, options...)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &discoveryResolver{
+		serviceName: serviceName,
+		cc:          cc,
+		conn:        conn,
+		client:      proto.NewDiscoveryClient(conn),
+		ctx:         ctx,
+		cancel:      cancel,
+		instances:   make(map[string]*proto.ServiceWithHeartBeat),
+	}
+	r.done.Add(1)
+	go r.run()
+	return r, nil
+}
+
+type discoveryResolver struct {
+	serviceName string
+	cc          grpcresolver.ClientConn
+	conn        *grpc.ClientConn
+	client      proto.DiscoveryClient
+	ctx         context.Context
+	cancel      context.CancelFunc
+	done        sync.WaitGroup
+	// instances of the service by id
+	instances map[string]*proto.ServiceWithHeartBeat
+}
+
+// ResolveNow does nothing, addresses are already updated as they change.
+func (r *discoveryResolver) ResolveNow(grpcresolver.ResolveNowOptions) {}
+
+func (r *discoveryResolver) Close() {
+	r.cancel()
+	r.done.Wait()
+	r.conn.Close()
+}
+
+func (r *discoveryResolver) run() {
+	defer r.done.Done()
+	for {
+		err := r.watch()
+		if r.ctx.Err() != nil {
+			return
+		}
+		log.Printf("Resolving %s failed, retrying in %v: %v\n", r.serviceName, RETRY_INTERVAL, err)
+		r.cc.ReportError(err)
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(RETRY_INTERVAL):
+		}
+	}
+}
+
+// watch lists the instances and follows their changes until the stream fails.
+func (r *discoveryResolver) watch() error {
+	// unknown service is listed empty with the registry revision, so it's
+	// resolved to no addresses until its instances are watched registering
+	response, err := r.client.ListInstances(r.ctx, &proto.GetServiceRequest{ServiceName: r.serviceName})
+	if err != nil {
+		return err
+	}
+	r.instances = make(map[string]*proto.ServiceWithHeartBeat)
+	for _, instance := range response.GetServices() {
+		r.instances[instance.Id] = instance
+	}
+	stream, err := r.client.Watch(r.ctx, &proto.WatchRequest{
+		ServiceName: r.serviceName,
+		Revision:    response.GetRevision(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := r.update(); err != nil {
+		return err
+	}
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if event.Type == proto.EventType_REMOVED {
+			delete(r.instances, event.Service.Id)
+		} else {
+			r.instances[event.Service.Id] = event.Service
+		}
+		if err := r.update(); err != nil {
+			return err
+		}
+	}
+}
+
+// update pushes addresses of UP instances to grpc.
+func (r *discoveryResolver) update() error {
+	var addresses []grpcresolver.Address
+	for _, instance := range r.instances {
+		if instance.Status != proto.InstanceStatus_UP {
+			continue
+		}
+		address, err := hostPort(instance.Url)
+		if err != nil {
+			log.Printf("Skipping %s of %s: %v\n", instance.Url, r.serviceName, err)
+			continue
+		}
+		addresses = append(addresses, grpcresolver.Address{Addr: address})
+	}
+	err := r.cc.UpdateState(grpcresolver.State{
+		Addresses:     addresses,
+		ServiceConfig: r.cc.ParseServiceConfig(serviceConfig),
+	})
+	if err == balancer.ErrBadResolverState && len(addresses) == 0 {
+		// balancer rejects empty lists, it's not a reason to reconnect
+		return nil
+	}
+	return err
+}
+
+// hostPort strips the scheme added to registered urls.
+func hostPort(instanceUrl string) (string, error) {
+	parsed, err := url.Parse(instanceUrl)
+	if err != nil {
+		return "", err
+	}
+	if len(parsed.Host) == 0 {
+		return "", fmt.Errorf("[err] %s has no host", instanceUrl)
+	}
+	return parsed.Host, nil
+}
@@ -0,0 +1,175 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ygaros/discovery-server/dto"
+	proto "github.com/ygaros/discovery-server/gen/proto"
+	"github.com/ygaros/discovery-server/server"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcresolver "google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// newTestServer serves grpc discovery on a local port, it returns the address.
+func newTestServer(t *testing.T) (server.DiscoveryService, string) {
+	t.Helper()
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listen.Addr().String()
+	listen.Close()
+	dservice := server.NewDiscoveryServiceWithInMemoryStorage()
+	grpcServer := server.NewDiscoveryGrpcServer(&dservice)
+	go grpcServer.ServeAddress(address)
+	t.Cleanup(func() { grpcServer.Shutdown(context.Background()) })
+	return dservice, address
+}
+
+// recordingConn records address lists the resolver pushes.
+type recordingConn struct {
+	grpcresolver.ClientConn
+	states chan []string
+}
+
+func (c *recordingConn) UpdateState(state grpcresolver.State) error {
+	addresses := make([]string, 0, len(state.Addresses))
+	for _, address := range state.Addresses {
+		addresses = append(addresses, address.Addr)
+	}
+	sort.Strings(addresses)
+	c.states <- addresses
+	return nil
+}
+
+func (c *recordingConn) ReportError(error) {}
+
+func (c *recordingConn) ParseServiceConfig(string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+// await waits until the resolver pushes want, the states before it are skipped.
+func (c *recordingConn) await(t *testing.T, want []string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	var last []string
+	for {
+		select {
+		case last = <-c.states:
+			if fmt.Sprint(last) == fmt.Sprint(want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("resolved %v, want %v", last, want)
+		}
+	}
+}
+
+func TestResolverFollowsRegistry(t *testing.T) {
+	dservice, address := newTestServer(t)
+	if err := dservice.AddService(dto.Service{Name: "orders", Url: "127.0.0.1:9001"}); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := url.Parse("discovery:///orders")
+	cc := &recordingConn{states: make(chan []string, 100)}
+	resolver, err := NewBuilder(address).Build(grpcresolver.Target{URL: *target}, cc, grpcresolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	cc.await(t, []string{"127.0.0.1:9001"})
+
+	tests := []struct {
+		name   string
+		change func() error
+		want   []string
+	}{
+		{"registration", func() error {
+			return dservice.AddService(dto.Service{Name: "orders", Url: "127.0.0.1:9002"})
+		}, []string{"127.0.0.1:9001", "127.0.0.1:9002"}},
+		{"other service", func() error {
+			return dservice.AddService(dto.Service{Name: "payments", Url: "127.0.0.1:9003"})
+		}, nil},
+		{"status DOWN", func() error {
+			return dservice.SetStatus(dto.ServiceStatus{Url: "127.0.0.1:9001", Status: "DOWN"})
+		}, []string{"127.0.0.1:9002"}},
+		{"status UP", func() error {
+			return dservice.SetStatus(dto.ServiceStatus{Url: "127.0.0.1:9001", Status: "UP"})
+		}, []string{"127.0.0.1:9001", "127.0.0.1:9002"}},
+		{"deregistration", func() error {
+			return dservice.Deregister(dto.Deregistration{Url: "127.0.0.1:9002"})
+		}, []string{"127.0.0.1:9001"}},
+		{"last deregistration", func() error {
+			return dservice.Deregister(dto.Deregistration{Url: "127.0.0.1:9001"})
+		}, []string{}},
+	}
+	for _, test := range tests {
+		if err := test.change(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if test.want == nil {
+			select {
+			case state := <-cc.states:
+				t.Errorf("%s: resolved %v, want nothing pushed", test.name, state)
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+		cc.await(t, test.want)
+	}
+}
+
+func TestResolverWaitsForUnknownService(t *testing.T) {
+	dservice, address := newTestServer(t)
+	// watching from revision 0 follows changes after it's subscribed only,
+	// the registration below has to be replayed from a later revision
+	if err := dservice.AddService(dto.Service{Name: "payments", Url: "127.0.0.1:9003"}); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := url.Parse("discovery:///orders")
+	cc := &recordingConn{states: make(chan []string, 100)}
+	resolver, err := NewBuilder(address).Build(grpcresolver.Target{URL: *target}, cc, grpcresolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resolver.Close()
+	cc.await(t, []string{})
+	if err := dservice.AddService(dto.Service{Name: "orders", Url: "127.0.0.1:9001"}); err != nil {
+		t.Fatal(err)
+	}
+	cc.await(t, []string{"127.0.0.1:9001"})
+}
+
+func TestDialResolvesRegisteredService(t *testing.T) {
+	dservice, address := newTestServer(t)
+	// the discovery server itself is the service dialed by name
+	if err := dservice.AddService(dto.Service{Name: "discovery", Url: address}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "discovery:///discovery",
+		grpc.WithResolvers(NewBuilder(address)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	response, err := proto.NewDiscoveryClient(conn).ListInstances(ctx, &proto.GetServiceRequest{ServiceName: "discovery"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Services) != 1 {
+		t.Errorf("listed %d instances through the resolved connection, want 1", len(response.Services))
+	}
+}
@@ -0,0 +1,453 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Permissions granted by acl rules, each one includes the previous ones.
+	PERMISSION_READ      = "read"
+	PERMISSION_HEARTBEAT = "heartbeat"
+	PERMISSION_REGISTER  = "register"
+	PERMISSION_ADMIN     = "admin"
+
+	// Reads of the whole registry need permission on ALL_SERVICES,
+	// only a * pattern grants it.
+	ALL_SERVICES = "*"
+
+	// How often tokens and jwks files are checked for changes.
+	AUTH_RELOAD_INTERVAL = time.Minute
+	// Clock skew tolerated when checking jwt exp and nbf.
+	JWT_LEEWAY = 30 * time.Second
+)
+
+var permissionLevels = map[string]int{
+	PERMISSION_READ:      1,
+	PERMISSION_HEARTBEAT: 2,
+	PERMISSION_REGISTER:  3,
+	PERMISSION_ADMIN:     4,
+}
+
+var (
+	errUnauthenticated  = errors.New("[err] valid token is required")
+	errPermissionDenied = errors.New("[err] permission denied")
+)
+
+// aclRule grants permission on service names matching pattern, written as
+// permission:pattern e.g. register:orders or read:* (see path.Match).
+type aclRule struct {
+	level   int
+	pattern string
+}
+
+func parseAclRules(rules []string) ([]aclRule, error) {
+	parsed := make([]aclRule, 0, len(rules))
+	for _, rule := range rules {
+		permission, pattern, ok := strings.Cut(strings.TrimSpace(rule), ":")
+		level, known := permissionLevels[permission]
+		if !ok || !known || len(pattern) == 0 {
+			return nil, fmt.Errorf("[err] acl rule %q isnt read|heartbeat|register|admin:pattern", rule)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("[err] invalid pattern of acl rule %q: %w", rule, err)
+		}
+		parsed = append(parsed, aclRule{level: level, pattern: pattern})
+	}
+	return parsed, nil
+}
+
+// identity of the caller, nil one is allowed everything
+// as requests arent authenticated.
+type identity struct {
+	name      string
+	anonymous bool
+	rules     []aclRule
+}
+
+func (i *identity) allows(permission string, serviceName string) bool {
+	if i == nil {
+		return true
+	}
+	level := permissionLevels[permission]
+	for _, rule := range i.rules {
+		if rule.level < level {
+			continue
+		}
+		if matched, _ := path.Match(rule.pattern, serviceName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// check fails with errUnauthenticated for anonymous callers
+// and errPermissionDenied for the others.
+func (i *identity) check(permission string, serviceName string) error {
+	if i.allows(permission, serviceName) {
+		return nil
+	}
+	if i.anonymous {
+		return fmt.Errorf("%w to %s %s", errUnauthenticated, permission, serviceName)
+	}
+	return fmt.Errorf("%w: %s cant %s %s", errPermissionDenied, i.name, permission, serviceName)
+}
+
+// checkAny is used by reads filtered by service, they need read on at least one.
+func (i *identity) checkAny() error {
+	if i == nil || len(i.rules) > 0 {
+		return nil
+	}
+	return i.check(PERMISSION_READ, ALL_SERVICES)
+}
+
+// checkInstance checks permission on the instance registered with id or on url.
+// Instances the caller cant read fail with discover.ErrNotFound as unknown ones
+// do, a denial would tell the caller they exist.
+func (i *identity) checkInstance(dservice DiscoveryService, permission string, id string, url string, secure bool) error {
+	if i == nil {
+		return nil
+	}
+	instance, err := dservice.Lookup(id, url, secure)
+	if err != nil && !errors.Is(err, discover.ErrNotFound) {
+		// invalid ids fail as they would otherwise
+		return i.checkAny()
+	}
+	if err != nil || !i.allows(PERMISSION_READ, instance.Name) {
+		if err := i.checkAny(); err != nil {
+			return err
+		}
+		if len(id) > 0 {
+			return fmt.Errorf("%w with id %s", discover.ErrNotFound, id)
+		}
+		return fmt.Errorf("%w with url %s", discover.ErrNotFound, discover.PrepareUrl(url, secure))
+	}
+	return i.check(permission, instance.Name)
+}
+
+// readable drops instances the caller cant read.
+func (i *identity) readable(instances []dto.ServiceHeartBeat) []dto.ServiceHeartBeat {
+	if i == nil {
+		return instances
+	}
+	allowed := make([]dto.ServiceHeartBeat, 0, len(instances))
+	for _, instance := range instances {
+		if i.allows(PERMISSION_READ, instance.Name) {
+			allowed = append(allowed, instance)
+		}
+	}
+	return allowed
+}
+
+// watchAllowed checks read on serviceName, watches of the whole
+// registry only get events of services the caller can read.
+func watchAllowed(caller *identity, serviceName string) error {
+	if len(serviceName) == 0 {
+		return caller.checkAny()
+	}
+	return caller.check(PERMISSION_READ, serviceName)
+}
+
+// bearerToken strips the Bearer scheme of authorization header,
+// other schemes are kept so they fail authentication.
+func bearerToken(header string) string {
+	scheme, token, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return header
+	}
+	return strings.TrimSpace(token)
+}
+
+type identityKey struct{}
+
+func withIdentity(ctx context.Context, caller *identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, caller)
+}
+
+// identityFromContext returns nil when requests arent authenticated.
+func identityFromContext(ctx context.Context) *identity {
+	caller, _ := ctx.Value(identityKey{}).(*identity)
+	return caller
+}
+
+type tokensFile struct {
+	Tokens []struct {
+		Name  string   `yaml:"name"`
+		Token string   `yaml:"token"`
+		Acl   []string `yaml:"acl"`
+	} `yaml:"tokens"`
+}
+
+// authenticator resolves bearer tokens to identities, static tokens come
+// from the tokens file and signed jwts are verified with keys of the jwks
+// file. Jwt sub is the identity name and its acl claim holds the rules.
+type authenticator struct {
+	tokensFile string
+	jwksFile   string
+	issuer     string
+	audience   string
+	anonymous  *identity
+
+	// identities by sha256 of their token
+	tokens   map[[sha256.Size]byte]*identity
+	keys     []jose.JSONWebKey
+	modified map[string]time.Time
+	lock     sync.RWMutex
+	quit     chan struct{}
+	once     sync.Once
+}
+
+// authenticate returns anonymous identity for empty token.
+func (a *authenticator) authenticate(token string) (*identity, error) {
+	if a == nil {
+		return nil, nil
+	}
+	if len(token) == 0 {
+		return a.anonymous, nil
+	}
+	a.lock.RLock()
+	caller, ok := a.tokens[sha256.Sum256([]byte(token))]
+	hasKeys := len(a.keys) > 0
+	a.lock.RUnlock()
+	if ok {
+		return caller, nil
+	}
+	if hasKeys && strings.Count(token, ".") == 2 {
+		caller, err := a.verifyJwt(token)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errUnauthenticated, err)
+		}
+		return caller, nil
+	}
+	return nil, fmt.Errorf("%w: unknown token", errUnauthenticated)
+}
+
+// verifyJwt leaves signature and registered claims to go-jose,
+// sub and acl claims become the identity.
+func (a *authenticator) verifyJwt(token string) (*identity, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, err
+	}
+	header := parsed.Headers[0]
+	key, err := a.key(header.KeyID, header.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var claims jwt.Claims
+	var private struct {
+		Acl []string `json:"acl"`
+	}
+	if err := parsed.Claims(key, &claims, &private); err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("jwt has no exp")
+	}
+	expected := jwt.Expected{Issuer: a.issuer, Time: time.Now()}
+	if len(a.audience) > 0 {
+		expected.Audience = jwt.Audience{a.audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, JWT_LEEWAY); err != nil {
+		return nil, err
+	}
+	if len(claims.Subject) == 0 {
+		return nil, errors.New("jwt has no sub")
+	}
+	rules, err := parseAclRules(private.Acl)
+	if err != nil {
+		return nil, err
+	}
+	return &identity{name: claims.Subject, rules: rules}, nil
+}
+
+// key finds verification key by kid, jwts without kid
+// are accepted only when there is a single key.
+func (a *authenticator) key(kid string, alg string) (interface{}, error) {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, key := range a.keys {
+		if key.KeyID != kid && (len(kid) > 0 || len(a.keys) > 1) {
+			continue
+		}
+		if len(key.Algorithm) > 0 && key.Algorithm != alg {
+			return nil, fmt.Errorf("key %q is for %s, not %s", kid, key.Algorithm, alg)
+		}
+		return key.Key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// parseJwks keeps public signing keys of the set,
+// their public part when private keys are listed.
+func parseJwks(content []byte) ([]jose.JSONWebKey, error) {
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, err
+	}
+	var keys []jose.JSONWebKey
+	for _, key := range jwks.Keys {
+		if len(key.Use) > 0 && key.Use != "sig" {
+			continue
+		}
+		public := key.Public()
+		if !public.Valid() {
+			return nil, fmt.Errorf("[err] jwks key %q isnt an asymmetric signing key", key.KeyID)
+		}
+		keys = append(keys, public)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("[err] there arent any signing keys in jwks")
+	}
+	return keys, nil
+}
+
+func parseTokens(content []byte) (map[[sha256.Size]byte]*identity, error) {
+	var file tokensFile
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	// empty or comment only file has no tokens
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	tokens := make(map[[sha256.Size]byte]*identity)
+	for _, token := range file.Tokens {
+		if len(token.Name) == 0 || len(token.Token) == 0 {
+			return nil, errors.New("[err] name and token are mandatory")
+		}
+		rules, err := parseAclRules(token.Acl)
+		if err != nil {
+			return nil, fmt.Errorf("%w of %s", err, token.Name)
+		}
+		key := sha256.Sum256([]byte(token.Token))
+		if _, ok := tokens[key]; ok {
+			return nil, fmt.Errorf("[err] token of %s is used more than once", token.Name)
+		}
+		tokens[key] = &identity{name: token.Name, rules: rules}
+	}
+	return tokens, nil
+}
+
+// load reads the files when any of them changed since the last load.
+func (a *authenticator) load() (bool, error) {
+	modified := make(map[string]time.Time)
+	changed := false
+	for _, file := range []string{a.tokensFile, a.jwksFile} {
+		if len(file) == 0 {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modified[file] = info.ModTime()
+		changed = changed || !info.ModTime().Equal(a.modified[file])
+	}
+	if !changed {
+		return false, nil
+	}
+	tokens := make(map[[sha256.Size]byte]*identity)
+	if len(a.tokensFile) > 0 {
+		content, err := os.ReadFile(a.tokensFile)
+		if err != nil {
+			return false, err
+		}
+		if tokens, err = parseTokens(content); err != nil {
+			return false, fmt.Errorf("%w in %s", err, a.tokensFile)
+		}
+	}
+	var keys []jose.JSONWebKey
+	if len(a.jwksFile) > 0 {
+		content, err := os.ReadFile(a.jwksFile)
+		if err != nil {
+			return false, err
+		}
+		if keys, err = parseJwks(content); err != nil {
+			return false, fmt.Errorf("%w in %s", err, a.jwksFile)
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.tokens = tokens
+	a.keys = keys
+	a.modified = modified
+	return true, nil
+}
+
+// watch reloads the files until stop, broken ones are logged
+// and the previous tokens and keys are kept.
+func (a *authenticator) watch() {
+	ticker := time.NewTicker(AUTH_RELOAD_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.quit:
+			return
+		case <-ticker.C:
+			reloaded, err := a.load()
+			if err != nil {
+				log.Println("Failed to reload tokens, keeping the previous ones:", err)
+			} else if reloaded {
+				log.Println("Reloaded tokens")
+			}
+		}
+	}
+}
+
+func (a *authenticator) stop() {
+	if a == nil {
+		return
+	}
+	a.once.Do(func() { close(a.quit) })
+}
+
+// loadAuthenticator reads auth files of config, nil when there arent any.
+func loadAuthenticator(config Config) (*authenticator, error) {
+	if len(config.Auth.TokensFile) == 0 && len(config.Auth.JwksFile) == 0 {
+		return nil, nil
+	}
+	rules, err := parseAclRules(config.Auth.Anonymous)
+	if err != nil {
+		return nil, err
+	}
+	a := &authenticator{
+		tokensFile: config.Auth.TokensFile,
+		jwksFile:   config.Auth.JwksFile,
+		issuer:     config.Auth.Issuer,
+		audience:   config.Auth.Audience,
+		anonymous:  &identity{name: "anonymous", anonymous: true, rules: rules},
+		quit:       make(chan struct{}),
+	}
+	if _, err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Loads auth files of config and reloads them every AUTH_RELOAD_INTERVAL,
+// nil when requests arent authenticated.
+func newAuthenticator(config Config) (*authenticator, error) {
+	a, err := loadAuthenticator(config)
+	if a == nil || err != nil {
+		return nil, err
+	}
+	go a.watch()
+	return a, nil
+}
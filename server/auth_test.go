@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+	proto "github.com/ygaros/discovery-server/gen/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		tokens  int
+		valid   bool
+	}{
+		{"empty", "", 0, true},
+		{"comments only", "# tokens are added by the deployment\n", 0, true},
+		{"no tokens", "tokens: []\n", 0, true},
+		{"tokens", "tokens:\n  - {name: envoy, token: a, acl: [\"read:*\"]}\n  - {name: orders, token: b}\n", 2, true},
+		{"missing token", "tokens:\n  - {name: envoy}\n", 0, false},
+		{"reused token", "tokens:\n  - {name: envoy, token: a}\n  - {name: orders, token: a}\n", 0, false},
+		{"invalid rule", "tokens:\n  - {name: envoy, token: a, acl: [\"write:*\"]}\n", 0, false},
+		{"unknown key", "tokens:\n  - {name: envoy, secret: a}\n", 0, false},
+	}
+	for _, test := range tests {
+		tokens, err := parseTokens([]byte(test.content))
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: parseTokens returned %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if len(tokens) != test.tokens {
+			t.Errorf("%s: parsed %d tokens, want %d", test.name, len(tokens), test.tokens)
+		}
+	}
+}
+
+func TestParseAclRules(t *testing.T) {
+	tests := []struct {
+		rule  string
+		valid bool
+	}{
+		{"read:*", true},
+		{"heartbeat:orders", true},
+		{" register:orders-* ", true},
+		{"admin:*", true},
+		{"write:orders", false},
+		{"read", false},
+		{"read:", false},
+		{"read:[orders", false},
+	}
+	for _, test := range tests {
+		_, err := parseAclRules([]string{test.rule})
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("rule %q returned %v, want valid %v", test.rule, err, test.valid)
+		}
+	}
+}
+
+func TestAclLevels(t *testing.T) {
+	rules, err := parseAclRules([]string{"register:orders", "read:payments-*", "heartbeat:carts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller := &identity{name: "orders", rules: rules}
+	tests := []struct {
+		permission  string
+		serviceName string
+		allowed     bool
+	}{
+		{PERMISSION_READ, "orders", true},
+		{PERMISSION_HEARTBEAT, "orders", true},
+		{PERMISSION_REGISTER, "orders", true},
+		{PERMISSION_ADMIN, "orders", false},
+		{PERMISSION_READ, "payments-eu", true},
+		{PERMISSION_HEARTBEAT, "payments-eu", false},
+		{PERMISSION_READ, "payments", false},
+		{PERMISSION_HEARTBEAT, "carts", true},
+		{PERMISSION_REGISTER, "carts", false},
+		{PERMISSION_READ, "users", false},
+		{PERMISSION_READ, ALL_SERVICES, false},
+	}
+	for _, test := range tests {
+		err := caller.check(test.permission, test.serviceName)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s %s allowed = %v, want %v", test.permission, test.serviceName, allowed, test.allowed)
+		}
+		if err != nil && !errors.Is(err, errPermissionDenied) {
+			t.Errorf("%s %s failed with %v, want %v", test.permission, test.serviceName, err, errPermissionDenied)
+		}
+	}
+
+	everything, _ := parseAclRules([]string{"read:*"})
+	if err := (&identity{rules: everything}).check(PERMISSION_READ, ALL_SERVICES); err != nil {
+		t.Errorf("read:* cant read every service: %v", err)
+	}
+	var unauthenticated *identity
+	if err := unauthenticated.check(PERMISSION_ADMIN, ALL_SERVICES); err != nil {
+		t.Errorf("requests without auth are denied: %v", err)
+	}
+	anonymous := &identity{name: "anonymous", anonymous: true}
+	if err := anonymous.check(PERMISSION_READ, "orders"); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("anonymous caller got %v, want %v", err, errUnauthenticated)
+	}
+	if err := anonymous.checkAny(); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("anonymous caller without rules got %v from checkAny, want %v", err, errUnauthenticated)
+	}
+	if err := caller.checkAny(); err != nil {
+		t.Errorf("caller with rules failed checkAny: %v", err)
+	}
+}
+
+func encodeSegment(v interface{}) string {
+	content, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+// signJwt signs claims with key, kid header is left out when empty.
+func signJwt(t *testing.T, alg jose.SignatureAlgorithm, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	options := (&jose.SignerOptions{}).WithType("JWT")
+	if len(kid) > 0 {
+		options = options.WithHeader("kid", kid)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerifyJwt(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPrivate, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherRsa, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: edPublic, KeyID: "ed"},
+		{Key: &ecPrivate.PublicKey, KeyID: "ec", Algorithm: "ES256"},
+		// private keys only count with their public part
+		{Key: rsaPrivate, KeyID: "rsa", Algorithm: "RS256", Use: "sig"},
+		{Key: &otherRsa.PublicKey, KeyID: "encryption", Use: "enc"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := parseJwks(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || !keys[2].IsPublic() {
+		t.Fatalf("parsed %d keys, want 3 public signing ones", len(keys))
+	}
+	symmetric, _ := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: []byte("secret"), KeyID: "hs"}}})
+	if _, err := parseJwks(symmetric); err == nil {
+		t.Error("jwks with symmetric key was accepted")
+	}
+	a := &authenticator{keys: keys, issuer: "https://auth.example.com", audience: "discovery"}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub": "orders",
+			"iss": "https://auth.example.com",
+			"aud": "discovery",
+			"exp": now.Add(time.Hour).Unix(),
+			"acl": []string{"register:orders"},
+		}
+		for key, value := range changes {
+			if value == nil {
+				delete(claims, key)
+			} else {
+				claims[key] = value
+			}
+		}
+		return claims
+	}
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"EdDSA", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(nil)), true},
+		{"ES256", signJwt(t, jose.ES256, "ec", ecPrivate, claims(nil)), true},
+		{"RS256", signJwt(t, jose.RS256, "rsa", rsaPrivate, claims(nil)), true},
+		{"audience list", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"aud": []string{"other", "discovery"}})), true},
+		{"expired within leeway", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})), true},
+		{"expired", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})), false},
+		{"without exp", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"exp": nil})), false},
+		{"not valid yet", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})), false},
+		{"other issuer", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"iss": "https://evil.example.com"})), false},
+		{"other audience", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"aud": "billing"})), false},
+		{"without sub", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"sub": nil})), false},
+		{"invalid acl", signJwt(t, jose.EdDSA, "ed", edPrivate, claims(map[string]interface{}{"acl": []string{"write:*"}})), false},
+		{"unknown kid", signJwt(t, jose.EdDSA, "other", edPrivate, claims(nil)), false},
+		{"without kid among many keys", signJwt(t, jose.EdDSA, "", edPrivate, claims(nil)), false},
+		{"alg of another key", signJwt(t, jose.PS256, "rsa", rsaPrivate, claims(nil)), false},
+		{"key of another type", signJwt(t, jose.ES256, "ed", ecPrivate, claims(nil)), false},
+		{"public key as hmac secret", signJwt(t, jose.HS256, "ed", []byte(edPublic), claims(nil)), false},
+		{"signed by another key", signJwt(t, jose.RS256, "rsa", otherRsa, claims(nil)), false},
+		{"none alg", encodeSegment(map[string]string{"alg": "none", "kid": "ed"}) + "." + encodeSegment(claims(nil)) + ".", false},
+	}
+	for _, test := range tests {
+		caller, err := a.authenticate(test.token)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%s: authenticate returned %v, want valid %v", test.name, err, test.valid)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, errUnauthenticated) {
+				t.Errorf("%s: failed with %v, want %v", test.name, err, errUnauthenticated)
+			}
+			continue
+		}
+		if caller.name != "orders" || caller.check(PERMISSION_REGISTER, "orders") != nil || caller.check(PERMISSION_READ, "payments") == nil {
+			t.Errorf("%s: identity is %s with %v, want orders allowed register:orders", test.name, caller.name, caller.rules)
+		}
+	}
+
+	parts := strings.Split(signJwt(t, jose.EdDSA, "ed", edPrivate, claims(nil)), ".")
+	parts[1] = encodeSegment(claims(map[string]interface{}{"acl": []string{"admin:*"}}))
+	if _, err := a.authenticate(strings.Join(parts, ".")); err == nil {
+		t.Error("jwt with tampered claims was accepted")
+	}
+}
+
+func TestHiddenInstancesLookUnknown(t *testing.T) {
+	dservice := NewDiscoveryServiceWithInMemoryStorage()
+	for _, service := range []dto.Service{
+		{Name: "orders", Url: "localhost:8080"},
+		{Name: "payments", Url: "localhost:8081"},
+		{Name: "carts", Url: "localhost:8082"},
+	} {
+		if err := dservice.AddService(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules, err := parseAclRules([]string{"register:orders", "read:carts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	caller := &identity{name: "orders", rules: rules}
+	httpServer := newHttpServer(dservice, nil)
+	gs := newGrpcServer(dservice, nil)
+	ctx := withIdentity(context.Background(), caller)
+	tests := []struct {
+		name string
+		url  string
+		http int
+		grpc codes.Code
+	}{
+		{"allowed", "localhost:8080", http.StatusOK, codes.OK},
+		{"readable", "localhost:8082", http.StatusForbidden, codes.PermissionDenied},
+		{"hidden", "localhost:8081", http.StatusNotFound, codes.NotFound},
+		{"unknown", "localhost:9090", http.StatusNotFound, codes.NotFound},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/heartbeat", strings.NewReader(`{"url":"`+test.url+`"}`))
+		httpServer.HeartBeat(recorder, request.WithContext(ctx))
+		if recorder.Code != test.http {
+			t.Errorf("%s: heartbeat over http returned %d, want %d", test.name, recorder.Code, test.http)
+		}
+		_, err := gs.HeartBeat(ctx, &proto.Service{Url: test.url})
+		if status.Code(err) != test.grpc {
+			t.Errorf("%s: heartbeat over grpc returned %v, want %s", test.name, err, test.grpc)
+		}
+	}
+	// both fail with the same error so they cant be told apart
+	hidden := caller.checkInstance(dservice, PERMISSION_REGISTER, "", "localhost:8081", false)
+	unknown := caller.checkInstance(dservice, PERMISSION_REGISTER, "", "localhost:8083", false)
+	if !errors.Is(hidden, discover.ErrNotFound) || strings.Replace(hidden.Error(), "8081", "8083", 1) != unknown.Error() {
+		t.Errorf("hidden instance failed with %v, unknown one with %v", hidden, unknown)
+	}
+	anonymous := &identity{name: "anonymous", anonymous: true}
+	if err := anonymous.checkInstance(dservice, PERMISSION_HEARTBEAT, "", "localhost:8081", false); !errors.Is(err, errUnauthenticated) {
+		t.Errorf("anonymous caller without rules got %v, want %v", err, errUnauthenticated)
+	}
+}
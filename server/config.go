@@ -0,0 +1,489 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ygaros/discovery-server/discover"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Environment variables overriding the config are named after its
+	// yaml keys e.g. DISCOVERY_GRPC_ADDRESS or DISCOVERY_LEASE_DEFAULT_TTL.
+	ENV_PREFIX = "DISCOVERY_"
+
+	STORAGE_MEMORY = "memory"
+	STORAGE_SLICE  = "slice"
+	STORAGE_FILE   = "file"
+	STORAGE_RAFT   = "raft"
+)
+
+// Config of the whole server, see DefaultConfig. It's loaded from a yaml or
+// json file, then environment variables and then flags, later ones win.
+type Config struct {
+	Grpc struct {
+		Address string `yaml:"address"`
+	} `yaml:"grpc"`
+	Http struct {
+		Address string `yaml:"address"`
+		// Origins of pages allowed to open websocket feeds besides the
+		// server own one, e.g. https://dashboard.example.com or * for any.
+		AllowedOrigins []string `yaml:"allowedOrigins"`
+	} `yaml:"http"`
+	// Dns server is off when address is empty.
+	Dns struct {
+		Address string        `yaml:"address"`
+		Domain  string        `yaml:"domain"`
+		Ttl     time.Duration `yaml:"ttl"`
+	} `yaml:"dns"`
+	// Envoy control plane is off when address is empty.
+	Xds struct {
+		Address string `yaml:"address"`
+	} `yaml:"xds"`
+	Storage struct {
+		// One of STORAGE_MEMORY, STORAGE_SLICE, STORAGE_FILE or STORAGE_RAFT.
+		Type string `yaml:"type"`
+		// Directory of file and raft storages, raft keeps its log in memory when empty.
+		Dir  string `yaml:"dir"`
+		Raft struct {
+			NodeId      string `yaml:"nodeId"`
+			RaftAddress string `yaml:"raftAddress"`
+			RpcAddress  string `yaml:"rpcAddress"`
+			Bootstrap   bool   `yaml:"bootstrap"`
+			// Cluster members as nodeId@raftAddress/rpcAddress.
+			Peers []string `yaml:"peers"`
+		} `yaml:"raft"`
+	} `yaml:"storage"`
+	// Base urls of peer http servers registrations are replicated to.
+	Peers []string `yaml:"peers"`
+	Lease struct {
+		// Ttl of instances registered without one.
+		DefaultTtl time.Duration `yaml:"defaultTtl"`
+		// Suspends eviction while too few heartbeats arrive, off by default.
+		SelfPreservation bool          `yaml:"selfPreservation"`
+		RenewalThreshold float64       `yaml:"renewalThreshold"`
+		RenewalInterval  time.Duration `yaml:"renewalInterval"`
+	} `yaml:"lease"`
+	// Instances arent health checked when type is empty.
+	HealthCheck struct {
+		Type      string        `yaml:"type"`
+		Path      string        `yaml:"path"`
+		Interval  time.Duration `yaml:"interval"`
+		Timeout   time.Duration `yaml:"timeout"`
+		Threshold int           `yaml:"threshold"`
+	} `yaml:"healthCheck"`
+	Balancer struct {
+		Default string `yaml:"default"`
+		// Balancer by service name.
+		Services map[string]string `yaml:"services"`
+	} `yaml:"balancer"`
+	// Grpc and http are served over tls when both files are set.
+	Tls struct {
+		CertFile string `yaml:"certFile"`
+		KeyFile  string `yaml:"keyFile"`
+		// Client certificates are verified against the bundle when they are sent.
+		ClientCaFile      string `yaml:"clientCaFile"`
+		RequireClientCert bool   `yaml:"requireClientCert"`
+		// Instances can only be registered and changed under service
+		// names allowed by SANs of their client certificate.
+		BindServiceName bool `yaml:"bindServiceName"`
+		// How often changed files are reloaded, TLS_RELOAD_INTERVAL when 0.
+		ReloadInterval time.Duration `yaml:"reloadInterval"`
+	} `yaml:"tls"`
+	// Requests need a bearer token when any of the files is set.
+	Auth struct {
+		// Static tokens with their acl rules.
+		TokensFile string `yaml:"tokensFile"`
+		// Keys signed jwts are verified with.
+		JwksFile string `yaml:"jwksFile"`
+		// Iss and aud claims of jwts have to match when set.
+		Issuer   string `yaml:"issuer"`
+		Audience string `yaml:"audience"`
+		// Acl rules of requests without token, e.g. read:* keeps reads open.
+		Anonymous []string `yaml:"anonymous"`
+		// Token sent to peers, it needs admin:*.
+		PeerToken string `yaml:"peerToken"`
+	} `yaml:"auth"`
+}
+
+// Same setup as NewServer had before it was configurable,
+// except grpc listens on every interface.
+func DefaultConfig() Config {
+	config := Config{}
+	config.Grpc.Address = fmt.Sprintf(":%d", DEFAULT_PORT)
+	config.Http.Address = fmt.Sprintf(":%d", DEFAULT_PORT_FOR_UI)
+	config.Dns.Domain = DEFAULT_DNS_DOMAIN
+	config.Dns.Ttl = DEFAULT_DNS_TTL
+	config.Storage.Type = STORAGE_MEMORY
+	config.Lease.DefaultTtl = discover.DELETION_TIME
+	config.Lease.RenewalThreshold = discover.RENEWAL_PERCENT_THRESHOLD
+	config.Lease.RenewalInterval = discover.RENEWAL_INTERVAL
+	config.Balancer.Default = discover.RANDOM
+	return config
+}
+
+// LoadFile overrides the config with yaml or json file,
+// keys missing in the file are left as they are.
+func (c *Config) LoadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("[err] failed to parse config %s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadEnv overrides the config with ENV_PREFIX environment variables.
+func (c *Config) LoadEnv() error {
+	return eachField(reflect.ValueOf(c).Elem(), nil, func(path []string, field reflect.Value) error {
+		name := envName(path)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil
+		}
+		if err := setField(field, value); err != nil {
+			return fmt.Errorf("[err] invalid %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// RegisterConfigFlags defines flag for every config key e.g. -grpc.address
+// or -lease.defaultTtl, returned function applies the ones set.
+func RegisterConfigFlags(flags *flag.FlagSet) func(config *Config) error {
+	defaults := DefaultConfig()
+	eachField(reflect.ValueOf(&defaults).Elem(), nil, func(path []string, field reflect.Value) error {
+		name := strings.Join(path, ".")
+		usage := "overrides " + envName(path)
+		if field.Kind() == reflect.Bool {
+			flags.Bool(name, field.Bool(), usage)
+		} else {
+			flags.String(name, formatField(field), usage)
+		}
+		return nil
+	})
+	return func(config *Config) error {
+		var err error
+		flags.Visit(func(f *flag.Flag) {
+			if err != nil {
+				return
+			}
+			eachField(reflect.ValueOf(config).Elem(), nil, func(path []string, field reflect.Value) error {
+				if strings.Join(path, ".") == f.Name {
+					if setErr := setField(field, f.Value.String()); setErr != nil {
+						err = fmt.Errorf("[err] invalid -%s: %w", f.Name, setErr)
+					}
+				}
+				return nil
+			})
+		})
+		return err
+	}
+}
+
+// eachField calls visit for every leaf of the config with its yaml key path.
+func eachField(value reflect.Value, path []string, visit func(path []string, field reflect.Value) error) error {
+	for i := 0; i < value.NumField(); i++ {
+		key := strings.Split(value.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		fieldPath := append(append([]string{}, path...), key)
+		field := value.Field(i)
+		if field.Kind() == reflect.Struct {
+			if err := eachField(field, fieldPath, visit); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := visit(fieldPath, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// envName turns yaml key path e.g. lease.defaultTtl into DISCOVERY_LEASE_DEFAULT_TTL.
+func envName(path []string) string {
+	var name strings.Builder
+	name.WriteString(ENV_PREFIX)
+	for i, key := range path {
+		if i > 0 {
+			name.WriteByte('_')
+		}
+		for j, r := range key {
+			if j > 0 && r >= 'A' && r <= 'Z' {
+				name.WriteByte('_')
+			}
+			name.WriteRune(r)
+		}
+	}
+	return strings.ToUpper(name.String())
+}
+
+// setField parses value into field, lists are comma separated
+// and maps are comma separated key=value pairs.
+func setField(field reflect.Value, value string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(parsed))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(parsed)
+	case reflect.Int:
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(parsed))
+	case reflect.Float64:
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(parsed)
+	case reflect.Slice:
+		field.Set(reflect.ValueOf(splitList(value)))
+	case reflect.Map:
+		pairs := make(map[string]string)
+		for _, pair := range splitList(value) {
+			key, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("key=value expected instead of %s", pair)
+			}
+			pairs[strings.TrimSpace(key)] = strings.TrimSpace(val)
+		}
+		field.Set(reflect.ValueOf(pairs))
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	return nil
+}
+
+func formatField(field reflect.Value) string {
+	switch value := field.Interface().(type) {
+	case []string:
+		return strings.Join(value, ",")
+	case map[string]string:
+		pairs := make([]string, 0, len(value))
+		for key, val := range value {
+			pairs = append(pairs, key+"="+val)
+		}
+		return strings.Join(pairs, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func splitList(value string) []string {
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var problems []string
+	invalid := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	listeners := []struct {
+		name     string
+		address  string
+		optional bool
+	}{
+		{"grpc.address", c.Grpc.Address, false},
+		{"http.address", c.Http.Address, false},
+		{"dns.address", c.Dns.Address, true},
+		{"xds.address", c.Xds.Address, true},
+	}
+	for _, listener := range listeners {
+		if len(listener.address) == 0 && listener.optional {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(listener.address); err != nil {
+			invalid("%s %q isnt host:port", listener.name, listener.address)
+		}
+	}
+	for _, origin := range c.Http.AllowedOrigins {
+		parsed, err := url.Parse(origin)
+		if origin != "*" && (err != nil || len(parsed.Scheme) == 0 || len(parsed.Host) == 0 || len(parsed.Path) > 0) {
+			invalid("http.allowedOrigins %q isnt scheme://host or *", origin)
+		}
+	}
+	if c.Dns.Ttl < 0 {
+		invalid("dns.ttl cant be negative")
+	}
+
+	switch c.Storage.Type {
+	case STORAGE_MEMORY, STORAGE_SLICE:
+	case STORAGE_FILE:
+		if len(c.Storage.Dir) == 0 {
+			invalid("storage.dir is mandatory for file storage")
+		}
+	case STORAGE_RAFT:
+		raft := c.Storage.Raft
+		if len(raft.NodeId) == 0 || len(raft.RaftAddress) == 0 || len(raft.RpcAddress) == 0 {
+			invalid("storage.raft.nodeId, raftAddress and rpcAddress are mandatory for raft storage")
+		}
+		for _, peer := range raft.Peers {
+			if _, err := parseRaftPeer(peer); err != nil {
+				invalid("%v", err)
+			}
+		}
+		// forwarded writes are authenticated with the peer certificates
+		if len(c.Tls.CertFile) > 0 && len(c.Tls.ClientCaFile) == 0 {
+			invalid("tls.clientCaFile is mandatory for raft storage over tls, peers are verified with it")
+		}
+		if (len(c.Auth.TokensFile) > 0 || len(c.Auth.JwksFile) > 0) && len(c.Tls.CertFile) == 0 {
+			invalid("tls.certFile is mandatory for raft storage with auth, forwarded writes arent authenticated otherwise")
+		}
+	default:
+		invalid("unknown storage.type %q, memory, slice, file or raft expected", c.Storage.Type)
+	}
+	for _, peer := range c.Peers {
+		parsed, err := url.Parse(peer)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || len(parsed.Host) == 0 {
+			invalid("peer %q isnt http(s) url", peer)
+		}
+	}
+
+	if c.Lease.DefaultTtl < 0 {
+		invalid("lease.defaultTtl cant be negative")
+	}
+	if c.Lease.RenewalThreshold < 0 || c.Lease.RenewalThreshold > 1 {
+		invalid("lease.renewalThreshold has to be between 0 and 1")
+	}
+	if c.Lease.RenewalInterval < 0 {
+		invalid("lease.renewalInterval cant be negative")
+	}
+
+	switch c.HealthCheck.Type {
+	case "", discover.HEALTH_CHECK_HTTP, discover.HEALTH_CHECK_TCP, discover.HEALTH_CHECK_GRPC:
+	default:
+		invalid("unknown healthCheck.type %q, http, tcp or grpc expected", c.HealthCheck.Type)
+	}
+	if c.HealthCheck.Interval < 0 || c.HealthCheck.Timeout < 0 || c.HealthCheck.Threshold < 0 {
+		invalid("healthCheck interval, timeout and threshold cant be negative")
+	}
+
+	if discover.NewBalancer(c.Balancer.Default) == nil {
+		invalid("unknown balancer.default %q", c.Balancer.Default)
+	}
+	for serviceName, name := range c.Balancer.Services {
+		if discover.NewBalancer(name) == nil {
+			invalid("unknown balancer %q of %s", name, serviceName)
+		}
+	}
+
+	if (len(c.Tls.CertFile) == 0) != (len(c.Tls.KeyFile) == 0) {
+		invalid("tls.certFile and tls.keyFile have to be set together")
+	} else if len(c.Tls.CertFile) > 0 {
+		if _, err := tls.LoadX509KeyPair(c.Tls.CertFile, c.Tls.KeyFile); err != nil {
+			invalid("tls: %v", err)
+		}
+	}
+	if len(c.Tls.ClientCaFile) > 0 {
+		if len(c.Tls.CertFile) == 0 {
+			invalid("tls.clientCaFile needs tls.certFile and tls.keyFile")
+		}
+		if _, err := loadCertPool(c.Tls.ClientCaFile); err != nil {
+			invalid("tls.clientCaFile: %v", err)
+		}
+	} else if c.Tls.RequireClientCert || c.Tls.BindServiceName {
+		invalid("tls.requireClientCert and tls.bindServiceName need tls.clientCaFile")
+	}
+	if c.Tls.ReloadInterval < 0 {
+		invalid("tls.reloadInterval cant be negative")
+	}
+
+	if len(c.Auth.TokensFile) > 0 || len(c.Auth.JwksFile) > 0 {
+		if _, err := loadAuthenticator(*c); err != nil {
+			invalid("auth: %v", err)
+		}
+	} else if len(c.Auth.Anonymous) > 0 || len(c.Auth.Issuer) > 0 || len(c.Auth.Audience) > 0 {
+		invalid("auth.anonymous, auth.issuer and auth.audience need auth.tokensFile or auth.jwksFile")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("[err] invalid config: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// parseRaftPeer parses nodeId@raftAddress/rpcAddress.
+func parseRaftPeer(peer string) (discover.RaftPeer, error) {
+	nodeId, addresses, ok := strings.Cut(peer, "@")
+	raftAddr, rpcAddr, ok2 := strings.Cut(addresses, "/")
+	if !ok || !ok2 || len(nodeId) == 0 || len(raftAddr) == 0 || len(rpcAddr) == 0 {
+		return discover.RaftPeer{}, fmt.Errorf("raft peer %q isnt nodeId@raftAddress/rpcAddress", peer)
+	}
+	return discover.RaftPeer{NodeId: nodeId, RaftAddr: raftAddr, RpcAddr: rpcAddr}, nil
+}
+
+// Option changes config of NewServer.
+type Option func(config *Config)
+
+// Replaces the whole config, following options are applied on top of it.
+func WithConfig(config Config) Option {
+	return func(c *Config) { *c = config }
+}
+
+func WithGrpcAddress(address string) Option {
+	return func(c *Config) { c.Grpc.Address = address }
+}
+
+func WithHttpAddress(address string) Option {
+	return func(c *Config) { c.Http.Address = address }
+}
+
+func WithDefaultTtl(ttl time.Duration) Option {
+	return func(c *Config) { c.Lease.DefaultTtl = ttl }
+}
+
+func WithBalancer(name string) Option {
+	return func(c *Config) { c.Balancer.Default = name }
+}
+
+func WithTls(certFile string, keyFile string) Option {
+	return func(c *Config) {
+		c.Tls.CertFile = certFile
+		c.Tls.KeyFile = keyFile
+	}
+}
+
+func WithAuth(tokensFile string, jwksFile string) Option {
+	return func(c *Config) {
+		c.Auth.TokensFile = tokensFile
+		c.Auth.JwksFile = jwksFile
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSelfPreservationIsOptIn(t *testing.T) {
+	if DefaultConfig().Lease.SelfPreservation {
+		t.Fatal("self-preservation is enabled by default")
+	}
+
+	file := filepath.Join(t.TempDir(), "discovery.yaml")
+	if err := os.WriteFile(file, []byte("lease:\n  selfPreservation: true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	if err := config.LoadFile(file); err != nil || !config.Lease.SelfPreservation {
+		t.Errorf("config file didnt enable self-preservation: %v", err)
+	}
+
+	t.Setenv("DISCOVERY_LEASE_SELF_PRESERVATION", "true")
+	config = DefaultConfig()
+	if err := config.LoadEnv(); err != nil || !config.Lease.SelfPreservation {
+		t.Errorf("environment didnt enable self-preservation: %v", err)
+	}
+
+	flags := flag.NewFlagSet("discovery", flag.ContinueOnError)
+	apply := RegisterConfigFlags(flags)
+	if err := flags.Parse([]string{"-lease.selfPreservation"}); err != nil {
+		t.Fatal(err)
+	}
+	config = DefaultConfig()
+	if err := apply(&config); err != nil || !config.Lease.SelfPreservation {
+		t.Errorf("flag didnt enable self-preservation: %v", err)
+	}
+}
+
+func TestRaftForwardingIsAuthenticated(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(*Config)
+		rejected bool
+	}{
+		{"plain", func(*Config) {}, false},
+		{"auth without tls", func(c *Config) { c.Auth.TokensFile = "tokens.yaml" }, true},
+		{"tls without client CA", func(c *Config) { c.Tls.CertFile, c.Tls.KeyFile = "cert.pem", "key.pem" }, true},
+		{"auth with tls", func(c *Config) {
+			c.Auth.TokensFile = "tokens.yaml"
+			c.Tls.CertFile, c.Tls.KeyFile, c.Tls.ClientCaFile = "cert.pem", "key.pem", "ca.pem"
+		}, false},
+	}
+	for _, test := range tests {
+		config := DefaultConfig()
+		config.Storage.Type = STORAGE_RAFT
+		config.Storage.Raft.NodeId = "node-1"
+		config.Storage.Raft.RaftAddress = "127.0.0.1:7000"
+		config.Storage.Raft.RpcAddress = "127.0.0.1:7001"
+		test.change(&config)
+		// missing files are reported too, only the raft problems matter here
+		err := config.Validate()
+		if rejected := err != nil && strings.Contains(err.Error(), "for raft storage"); rejected != test.rejected {
+			t.Errorf("%s: Validate returned %v, want raft storage rejected %v", test.name, err, test.rejected)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+)
+
+const DEFAULT_DNS_PORT = 8600
+const DEFAULT_DNS_DOMAIN = "discovery."
+const DEFAULT_DNS_TTL = 5 * time.Second
+
+type DnsConfig struct {
+	// Zone answered by the server, DEFAULT_DNS_DOMAIN when empty.
+	Domain string
+	// Ttl of every answer, DEFAULT_DNS_TTL when 0. Keep it low
+	// as instances come and go.
+	Ttl time.Duration
+}
+
+type DnsServer interface {
+	Serve(port int) error
+	ServeAddress(address string) error
+	ServeDefaultPort() error
+	Shutdown() error
+}
+
+// dnsServer answers like consul does:
+//
+//	<service>.service.<domain>        A/AAAA of every UP instance, SRV with ports
+//	<tag>.<service>.service.<domain>  same limited to instances with the tag
+//	<hex ip>.addr.<domain>            A/AAAA targets of the SRV records
+//
+// Queries carry no token, they are answered as caller when requests are
+// authenticated and services it cant read are unknown.
+type dnsServer struct {
+	dservice DiscoveryService
+	caller   *identity
+	domain   string
+	ttl      uint32
+	servers  []*dns.Server
+	lock     sync.Mutex
+	stopped  bool
+}
+
+func (s *dnsServer) ServeDNS(w dns.ResponseWriter, request *dns.Msg) {
+	response := new(dns.Msg)
+	response.SetReply(request)
+	response.Authoritative = true
+	if len(request.Question) == 0 {
+		response.SetRcode(request, dns.RcodeFormatError)
+		w.WriteMsg(response)
+		return
+	}
+	question := request.Question[0]
+	if !dns.IsSubDomain(s.domain, question.Name) {
+		response.SetRcode(request, dns.RcodeRefused)
+		w.WriteMsg(response)
+		return
+	}
+	labels := dns.SplitDomainName(question.Name)
+	labels = labels[:len(labels)-dns.CountLabel(s.domain)]
+	switch {
+	case len(labels) >= 2 && len(labels) <= 3 && strings.EqualFold(labels[len(labels)-1], "service"):
+		s.answerService(response, question, labels)
+	case len(labels) == 2 && strings.EqualFold(labels[1], "addr"):
+		s.answerAddr(response, question, labels[0])
+	default:
+		response.SetRcode(request, dns.RcodeNameError)
+	}
+	size := dns.MinMsgSize
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); !udp {
+		size = dns.MaxMsgSize
+	} else if edns := request.IsEdns0(); edns != nil {
+		size = int(edns.UDPSize())
+	}
+	response.Truncate(size)
+	if err := w.WriteMsg(response); err != nil {
+		log.Println("Failed to write dns response:", err)
+	}
+}
+
+func (s *dnsServer) answerService(response *dns.Msg, question dns.Question, labels []string) {
+	instances, err := s.instances(labels[len(labels)-2])
+	if err != nil {
+		response.Rcode = dns.RcodeNameError
+		return
+	}
+	var tag string
+	if len(labels) == 3 {
+		tag = labels[0]
+	}
+	rand.Shuffle(len(instances), func(i, j int) {
+		instances[i], instances[j] = instances[j], instances[i]
+	})
+	found := false
+	var cname dns.RR
+	for _, instance := range instances {
+		if instance.Status != string(discover.UP) || (len(tag) > 0 && !hasTag(instance, tag)) {
+			continue
+		}
+		host, port, err := splitInstanceUrl(instance.Url)
+		if err != nil {
+			log.Printf("Skipping %s in dns answer: %v\n", instance.Url, err)
+			continue
+		}
+		found = true
+		switch question.Qtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeANY:
+			records := s.addressRecords(question.Name, question.Qtype, host)
+			if len(records) == 1 && records[0].Header().Rrtype == dns.TypeCNAME {
+				// cname cant be mixed with other records
+				if cname == nil {
+					cname = records[0]
+				}
+				continue
+			}
+			response.Answer = append(response.Answer, records...)
+		case dns.TypeSRV:
+			target := dns.Fqdn(host)
+			if ip := net.ParseIP(host); ip != nil {
+				target = fmt.Sprintf("%s.addr.%s", hex.EncodeToString(toIp(ip)), s.domain)
+				response.Extra = append(response.Extra, s.addressRecords(target, dns.TypeANY, host)...)
+			}
+			response.Answer = append(response.Answer, &dns.SRV{
+				Hdr:      s.header(question.Name, dns.TypeSRV),
+				Priority: 1,
+				Weight:   1,
+				Port:     port,
+				Target:   target,
+			})
+		}
+	}
+	if !found {
+		response.Rcode = dns.RcodeNameError
+	} else if len(response.Answer) == 0 && cname != nil {
+		response.Answer = []dns.RR{cname}
+	}
+}
+
+// instances of serviceName the caller can read, names are matched
+// case-insensitively like dns ones. Unknown service is listed empty.
+func (s *dnsServer) instances(serviceName string) ([]dto.ServiceHeartBeat, error) {
+	instances, err := s.dservice.ListInstances(serviceName)
+	if err != nil || len(instances) > 0 {
+		return s.caller.readable(instances), err
+	}
+	services, _ := s.dservice.ListServices()
+	for _, service := range services {
+		if strings.EqualFold(service.Name, serviceName) && service.Name != serviceName {
+			instances, err := s.dservice.ListInstances(service.Name)
+			return s.caller.readable(instances), err
+		}
+	}
+	return instances, nil
+}
+
+func (s *dnsServer) answerAddr(response *dns.Msg, question dns.Question, encoded string) {
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil || (len(decoded) != net.IPv4len && len(decoded) != net.IPv6len) {
+		response.Rcode = dns.RcodeNameError
+		return
+	}
+	response.Answer = s.addressRecords(question.Name, question.Qtype, net.IP(decoded).String())
+}
+
+// addressRecords returns A or AAAA of ip matching qtype, CNAME when host isnt an ip.
+func (s *dnsServer) addressRecords(name string, qtype uint16, host string) []dns.RR {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return []dns.RR{&dns.CNAME{Hdr: s.header(name, dns.TypeCNAME), Target: dns.Fqdn(host)}}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		if qtype == dns.TypeA || qtype == dns.TypeANY {
+			return []dns.RR{&dns.A{Hdr: s.header(name, dns.TypeA), A: ip4}}
+		}
+		return nil
+	}
+	if qtype == dns.TypeAAAA || qtype == dns.TypeANY {
+		return []dns.RR{&dns.AAAA{Hdr: s.header(name, dns.TypeAAAA), AAAA: ip}}
+	}
+	return nil
+}
+
+func (s *dnsServer) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: s.ttl}
+}
+
+func (s *dnsServer) Serve(port int) error {
+	return s.ServeAddress(fmt.Sprintf(":%d", port))
+}
+
+// ServeAddress answers over both udp and tcp on address.
+func (s *dnsServer) ServeAddress(address string) error {
+	log.Printf("Starting DNS server for %s on %s...\n", s.domain, address)
+	networks := []string{"udp", "tcp"}
+	errs := make(chan error, len(networks))
+	started := make(chan struct{}, len(networks))
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return nil
+	}
+	var servers []*dns.Server
+	for _, network := range networks {
+		server := &dns.Server{
+			Addr:              address,
+			Net:               network,
+			Handler:           s,
+			NotifyStartedFunc: func() { started <- struct{}{} },
+		}
+		servers = append(servers, server)
+		go func() {
+			errs <- server.ListenAndServe()
+		}()
+	}
+	// servers which arent started yet cant be shut down
+	var err error
+	for range networks {
+		select {
+		case <-started:
+		case err = <-errs:
+		}
+	}
+	if err != nil {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+		s.lock.Unlock()
+		return err
+	}
+	s.servers = append(s.servers, servers...)
+	s.lock.Unlock()
+	err = <-errs
+	if s.isStopped() {
+		return nil
+	}
+	return err
+}
+
+func (s *dnsServer) isStopped() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stopped
+}
+
+func (s *dnsServer) ServeDefaultPort() error {
+	return s.Serve(DEFAULT_DNS_PORT)
+}
+
+func (s *dnsServer) Shutdown() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	var err error
+	for _, server := range s.servers {
+		if shutdownErr := server.Shutdown(); shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+func hasTag(instance dto.ServiceHeartBeat, tag string) bool {
+	for _, instanceTag := range instance.Tags {
+		if strings.EqualFold(instanceTag, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitInstanceUrl returns host and port of the registered url,
+// the scheme default port when it has none.
+func splitInstanceUrl(instanceUrl string) (string, uint16, error) {
+	parsed, err := url.Parse(instanceUrl)
+	if err != nil {
+		return "", 0, err
+	}
+	port := parsed.Port()
+	if len(port) == 0 {
+		port = "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+	}
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return parsed.Hostname(), uint16(parsedPort), nil
+}
+
+func toIp(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func NewDnsServer(discoveryService *DiscoveryService, config DnsConfig) DnsServer {
+	domain := DEFAULT_DNS_DOMAIN
+	if len(config.Domain) > 0 {
+		domain = dns.Fqdn(strings.ToLower(config.Domain))
+	}
+	ttl := config.Ttl
+	if ttl == 0 {
+		ttl = DEFAULT_DNS_TTL
+	}
+	return &dnsServer{
+		dservice: *discoveryService,
+		domain:   domain,
+		ttl:      uint32(ttl / time.Second),
+	}
+}
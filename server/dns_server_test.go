@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/ygaros/discovery-server/dto"
+)
+
+// newTestDns answers over udp on a local port as caller, it returns the address.
+func newTestDns(t *testing.T, dservice DiscoveryService, ttl time.Duration, caller *identity) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	handler := NewDnsServer(&dservice, DnsConfig{Ttl: ttl}).(*dnsServer)
+	handler.caller = caller
+	server := &dns.Server{
+		PacketConn:        conn,
+		Handler:           handler,
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+	<-started
+	return conn.LocalAddr().String()
+}
+
+// records formats answers without their headers, sorted as the order is random.
+func records(answers []dns.RR) []string {
+	result := make([]string, 0, len(answers))
+	for _, answer := range answers {
+		switch record := answer.(type) {
+		case *dns.A:
+			result = append(result, "A "+record.A.String())
+		case *dns.AAAA:
+			result = append(result, "AAAA "+record.AAAA.String())
+		case *dns.CNAME:
+			result = append(result, "CNAME "+record.Target)
+		case *dns.SRV:
+			result = append(result, fmt.Sprintf("SRV %d %s", record.Port, record.Target))
+		default:
+			result = append(result, answer.String())
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestDnsAnswers(t *testing.T) {
+	dservice := NewDiscoveryServiceWithInMemoryStorage()
+	for _, service := range []dto.Service{
+		{Name: "orders", Url: "10.0.0.1:8080", Tags: []string{"eu"}},
+		{Name: "orders", Url: "10.0.0.2", Secure: true},
+		{Name: "orders", Url: "10.0.0.3:8080", Status: "DOWN"},
+		{Name: "orders", Url: "[fd00::1]:8080", Status: "OUT_OF_SERVICE"},
+		{Name: "payments", Url: "10.0.1.1:8080", Status: "DOWN"},
+		{Name: "carts", Url: "carts.internal:8080"},
+		{Name: "users", Url: "[fd00::2]:8080"},
+	} {
+		if err := dservice.AddService(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	address := newTestDns(t, dservice, 7*time.Second, nil)
+	tests := []struct {
+		name    string
+		qtype   uint16
+		rcode   int
+		answers []string
+		extra   []string
+	}{
+		{"orders.service.discovery.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1", "A 10.0.0.2"}, nil},
+		{"ORDERS.service.discovery.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1", "A 10.0.0.2"}, nil},
+		{"orders.service.discovery.", dns.TypeAAAA, dns.RcodeSuccess, []string{}, nil},
+		{"orders.service.discovery.", dns.TypeSRV, dns.RcodeSuccess,
+			[]string{"SRV 443 0a000002.addr.discovery.", "SRV 8080 0a000001.addr.discovery."},
+			[]string{"A 10.0.0.1", "A 10.0.0.2"}},
+		{"eu.orders.service.discovery.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1"}, nil},
+		{"us.orders.service.discovery.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"payments.service.discovery.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"unknown.service.discovery.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"carts.service.discovery.", dns.TypeA, dns.RcodeSuccess, []string{"CNAME carts.internal."}, nil},
+		{"carts.service.discovery.", dns.TypeSRV, dns.RcodeSuccess, []string{"SRV 8080 carts.internal."}, nil},
+		{"users.service.discovery.", dns.TypeAAAA, dns.RcodeSuccess, []string{"AAAA fd00::2"}, nil},
+		{"0a000001.addr.discovery.", dns.TypeA, dns.RcodeSuccess, []string{"A 10.0.0.1"}, nil},
+		{"zz.addr.discovery.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"orders.discovery.", dns.TypeA, dns.RcodeNameError, []string{}, nil},
+		{"orders.service.consul.", dns.TypeA, dns.RcodeRefused, []string{}, nil},
+	}
+	client := &dns.Client{Timeout: 5 * time.Second}
+	for _, test := range tests {
+		request := new(dns.Msg)
+		request.SetQuestion(test.name, test.qtype)
+		response, _, err := client.Exchange(request, address)
+		if err != nil {
+			t.Fatalf("%s %s: %v", test.name, dns.TypeToString[test.qtype], err)
+		}
+		query := test.name + " " + dns.TypeToString[test.qtype]
+		if response.Rcode != test.rcode {
+			t.Errorf("%s: rcode %s, want %s", query, dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+		}
+		if !response.Authoritative {
+			t.Errorf("%s: answer isnt authoritative", query)
+		}
+		if got := records(response.Answer); fmt.Sprint(got) != fmt.Sprint(test.answers) {
+			t.Errorf("%s: answered %v, want %v", query, got, test.answers)
+		}
+		if test.extra != nil {
+			if got := records(response.Extra); fmt.Sprint(got) != fmt.Sprint(test.extra) {
+				t.Errorf("%s: extra records %v, want %v", query, got, test.extra)
+			}
+		}
+		for _, record := range append(response.Answer, response.Extra...) {
+			if record.Header().Ttl != 7 {
+				t.Errorf("%s: %s has ttl %d, want 7", query, record, record.Header().Ttl)
+			}
+		}
+	}
+}
+
+func TestDnsAnswersReadableServices(t *testing.T) {
+	dservice := NewDiscoveryServiceWithInMemoryStorage()
+	for _, service := range []dto.Service{
+		{Name: "orders", Url: "10.0.0.1:8080"},
+		{Name: "Payments", Url: "10.0.1.1:8080"},
+	} {
+		if err := dservice.AddService(service); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules, err := parseAclRules([]string{"read:orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		caller *identity
+		query  string
+		rcode  int
+	}{
+		{"readable", &identity{name: "anonymous", anonymous: true, rules: rules}, "orders.service.discovery.", dns.RcodeSuccess},
+		{"not readable", &identity{name: "anonymous", anonymous: true, rules: rules}, "payments.service.discovery.", dns.RcodeNameError},
+		{"without rules", &identity{name: "anonymous", anonymous: true}, "orders.service.discovery.", dns.RcodeNameError},
+		{"without auth", nil, "payments.service.discovery.", dns.RcodeSuccess},
+	}
+	client := &dns.Client{Timeout: 5 * time.Second}
+	for _, test := range tests {
+		address := newTestDns(t, dservice, time.Second, test.caller)
+		request := new(dns.Msg)
+		request.SetQuestion(test.query, dns.TypeA)
+		response, _, err := client.Exchange(request, address)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if response.Rcode != test.rcode {
+			t.Errorf("%s: %s answered %s, want %s", test.name, test.query, dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ygaros/discovery-server/dto"
+)
+
+const (
+	// How often idle feeds are kept alive through proxies.
+	FEED_KEEPALIVE_INTERVAL = 15 * time.Second
+	FEED_WRITE_TIMEOUT      = 10 * time.Second
+)
+
+// checkOrigin lets browsers open websockets only from pages of the server
+// itself or allowed origins, requests without Origin arent from browsers.
+func (s *httpServer) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	parsed, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, parsed.Scheme+"://"+parsed.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// feedRevision reads ?revision= or the Last-Event-ID header sent by
+// reconnecting EventSource, changes after it are replayed first.
+func feedRevision(r *http.Request) (uint64, error) {
+	param := r.URL.Query().Get("revision")
+	if len(param) == 0 {
+		param = r.Header.Get("Last-Event-ID")
+	}
+	if len(param) == 0 {
+		return 0, nil
+	}
+	return strconv.ParseUint(param, 10, 64)
+}
+
+// Events streams registry changes as server-sent events,
+// ?serviceName= limits them to a single service.
+func (s *httpServer) Events(w http.ResponseWriter, r *http.Request) {
+	revision, err := feedRevision(r)
+	if err != nil {
+		log.Println("Invalid revision:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	serviceName := r.URL.Query().Get("serviceName")
+	caller := identityFromContext(r.Context())
+	if !permit(w, watchAllowed(caller, serviceName)) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Println("Streaming isnt supported by the connection")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var lock sync.Mutex
+	write := func(format string, args ...interface{}) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go keepAlive(ctx, func() error {
+		return write(": keepalive\n\n")
+	})
+	log.Printf("Streaming events of %q from revision %d\n", serviceName, revision)
+	err = s.dservice.Watch(ctx, serviceName, revision, func(event dto.ServiceEvent) error {
+		if !caller.allows(PERMISSION_READ, event.Service.Name) {
+			return nil
+		}
+		marshaled, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return write("id: %d\nevent: %s\ndata: %s\n\n", event.Revision, event.Type, marshaled)
+	})
+	if err != nil {
+		log.Println("Event stream closed:", err)
+		write("event: error\ndata: %s\n\n", err)
+	}
+}
+
+// Socket streams registry changes as json websocket messages,
+// ?serviceName= limits them to a single service.
+func (s *httpServer) Socket(w http.ResponseWriter, r *http.Request) {
+	revision, err := feedRevision(r)
+	if err != nil {
+		log.Println("Invalid revision:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	serviceName := r.URL.Query().Get("serviceName")
+	caller := identityFromContext(r.Context())
+	if !permit(w, watchAllowed(caller, serviceName)) {
+		return
+	}
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Failed to upgrade connection:", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// messages from the client arent expected, reading handles
+	// control frames and notices when the client goes away
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	go keepAlive(ctx, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(FEED_WRITE_TIMEOUT))
+	})
+	log.Printf("Streaming websocket events of %q from revision %d\n", serviceName, revision)
+	err = s.dservice.Watch(ctx, serviceName, revision, func(event dto.ServiceEvent) error {
+		if !caller.allows(PERMISSION_READ, event.Service.Name) {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(FEED_WRITE_TIMEOUT))
+		return conn.WriteJSON(event)
+	})
+	if err != nil {
+		log.Println("Websocket stream closed:", err)
+		message := websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error())
+		conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(FEED_WRITE_TIMEOUT))
+		return
+	}
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(FEED_WRITE_TIMEOUT))
+}
+
+func keepAlive(ctx context.Context, ping func() error) {
+	ticker := time.NewTicker(FEED_KEEPALIVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+)
+
+// newTestFeeds serves the http api of a registry with orders registered at
+// the returned revision and payments after it.
+func newTestFeeds(t *testing.T) (*httptest.Server, DiscoveryService, uint64) {
+	t.Helper()
+	dservice := NewDiscoveryServiceWithInMemoryStorage()
+	server := httptest.NewServer(newHttpServer(dservice, nil).router())
+	t.Cleanup(server.Close)
+	if err := dservice.AddService(dto.Service{Name: "orders", Url: "localhost:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	revision := dservice.Revision()
+	if err := dservice.AddService(dto.Service{Name: "payments", Url: "localhost:8081"}); err != nil {
+		t.Fatal(err)
+	}
+	return server, dservice, revision
+}
+
+// compact moves the registry past the history so the first revisions arent served.
+func compact(t *testing.T, dservice DiscoveryService) {
+	t.Helper()
+	for i := 0; i <= discover.EVENT_HISTORY_SIZE; i++ {
+		status := "DOWN"
+		if i%2 == 1 {
+			status = "UP"
+		}
+		if err := dservice.SetStatus(dto.ServiceStatus{Url: "localhost:8080", Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// sseEvent is a single server-sent event, data is the raw json.
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func readSse(t *testing.T, lines *bufio.Scanner) sseEvent {
+	t.Helper()
+	var event sseEvent
+	for lines.Scan() {
+		line := lines.Text()
+		switch {
+		case len(line) == 0 && len(event.event) > 0:
+			return event
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	t.Fatalf("event stream ended: %v", lines.Err())
+	return event
+}
+
+func openSse(t *testing.T, ctx context.Context, target string, lastEventId string) *bufio.Scanner {
+	t.Helper()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lastEventId) > 0 {
+		request.Header.Set("Last-Event-ID", lastEventId)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events returned %d with %s", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	return bufio.NewScanner(response.Body)
+}
+
+func TestEventsResume(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		lastEventId string
+	}{
+		{"revision", "/events?revision={revision}", ""},
+		{"Last-Event-ID", "/events", "{revision}"},
+	}
+	for _, test := range tests {
+		server, dservice, revision := newTestFeeds(t)
+		target := strings.ReplaceAll(test.target, "{revision}", fmt.Sprint(revision))
+		lastEventId := strings.ReplaceAll(test.lastEventId, "{revision}", fmt.Sprint(revision))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		lines := openSse(t, ctx, server.URL+target, lastEventId)
+		replayed := readSse(t, lines)
+		var event dto.ServiceEvent
+		if err := json.Unmarshal([]byte(replayed.data), &event); err != nil {
+			t.Fatal(err)
+		}
+		if replayed.id != fmt.Sprint(revision+1) || replayed.event != string(discover.ADDED) || event.Service.Name != "payments" {
+			t.Errorf("%s: replayed %s %s of %s, want %s of payments at %d",
+				test.name, replayed.id, replayed.event, event.Service.Name, discover.ADDED, revision+1)
+		}
+
+		if err := dservice.AddService(dto.Service{Name: "carts", Url: "localhost:9090"}); err != nil {
+			t.Fatal(err)
+		}
+		live := readSse(t, lines)
+		if err := json.Unmarshal([]byte(live.data), &event); err != nil {
+			t.Fatal(err)
+		}
+		if live.id != fmt.Sprint(dservice.Revision()) || event.Service.Name != "carts" {
+			t.Errorf("%s: streamed %s of %s, want %d of carts", test.name, live.id, event.Service.Name, dservice.Revision())
+		}
+		cancel()
+	}
+}
+
+func TestEventsPastCompactedHistory(t *testing.T) {
+	server, dservice, revision := newTestFeeds(t)
+	compact(t, dservice)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	lines := openSse(t, ctx, fmt.Sprintf("%s/events?revision=%d", server.URL, revision), "")
+	if event := readSse(t, lines); event.event != "error" || !strings.Contains(event.data, "compacted") {
+		t.Errorf("compacted revision streamed %s %q, want error", event.event, event.data)
+	}
+	if lines.Scan() && len(lines.Text()) > 0 {
+		t.Errorf("stream went on after the error with %q", lines.Text())
+	}
+}
+
+func dialSocket(t *testing.T, server *httptest.Server, query string, header http.Header) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	conn, response, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws"+query, header)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, response, err
+}
+
+func TestSocketResume(t *testing.T) {
+	server, dservice, revision := newTestFeeds(t)
+	conn, _, err := dialSocket(t, server, fmt.Sprintf("?revision=%d", revision), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event dto.ServiceEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Revision != revision+1 || event.Type != string(discover.ADDED) || event.Service.Name != "payments" {
+		t.Errorf("replayed %s of %s at %d, want %s of payments at %d",
+			event.Type, event.Service.Name, event.Revision, discover.ADDED, revision+1)
+	}
+
+	if err := dservice.SetStatus(dto.ServiceStatus{Url: "localhost:8080", Status: "DOWN"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Revision != dservice.Revision() || event.Type != string(discover.UPDATED) || event.Service.Status != "DOWN" {
+		t.Errorf("streamed %s of %s at %d, want %s to DOWN at %d",
+			event.Type, event.Service.Status, event.Revision, discover.UPDATED, dservice.Revision())
+	}
+}
+
+func TestSocketPastCompactedHistory(t *testing.T) {
+	server, dservice, revision := newTestFeeds(t)
+	compact(t, dservice)
+	conn, _, err := dialSocket(t, server, fmt.Sprintf("?revision=%d", revision), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn.ReadMessage()
+	var closed *websocket.CloseError
+	if !errors.As(err, &closed) || closed.Code != websocket.CloseInternalServerErr || !strings.Contains(closed.Text, "compacted") {
+		t.Errorf("compacted revision read %v, want close %d", err, websocket.CloseInternalServerErr)
+	}
+}
+
+func TestSocketChecksOrigin(t *testing.T) {
+	server, _, _ := newTestFeeds(t)
+	tests := []struct {
+		name    string
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{"without origin", "", nil, true},
+		{"same origin", server.URL, nil, true},
+		{"other origin", "https://evil.example.com", nil, false},
+		{"allowed origin", "https://dashboard.example.com", []string{"https://dashboard.example.com"}, true},
+		{"allowed origin with other scheme", "http://dashboard.example.com", []string{"https://dashboard.example.com"}, false},
+		{"any origin", "https://evil.example.com", []string{"*"}, true},
+	}
+	for _, test := range tests {
+		s := &httpServer{allowedOrigins: test.allowed}
+		request := httptest.NewRequest(http.MethodGet, server.URL+"/ws", nil)
+		if len(test.origin) > 0 {
+			request.Header.Set("Origin", test.origin)
+		}
+		if allowed := s.checkOrigin(request); allowed != test.want {
+			t.Errorf("%s: allowed = %v, want %v", test.name, allowed, test.want)
+		}
+	}
+
+	_, response, err := dialSocket(t, server, "", http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil || response == nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("websocket from other origin returned %v, want %d", err, http.StatusForbidden)
+	}
+}
@@ -2,44 +2,86 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/ygaros/discovery-server/discover"
 	"github.com/ygaros/discovery-server/dto"
 	proto "github.com/ygaros/discovery-server/gen/proto"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type GrpcServer interface {
 	Serve(port int) error
+	ServeAddress(address string) error
 	ServeDefaultPort() error
+	Shutdown(ctx context.Context) error
 }
 type grpcServer struct {
 	proto.UnimplementedDiscoveryServer
 	dservice DiscoveryService
+	server   *grpc.Server
+	// closed on shutdown to end watch streams
+	quit chan struct{}
+	once sync.Once
+	// registrations are limited to SANs of client certificates
+	bindServiceName bool
+	// callers are authenticated by the interceptors when set
+	auth *authenticator
 }
 
-func (gs *grpcServer) AddService(ctx context.Context, request *proto.Service) (*proto.Empty, error) {
+func (gs *grpcServer) AddService(ctx context.Context, request *proto.Service) (*proto.Registration, error) {
 	service := dto.ToService(request)
 	log.Printf("processing registering service %v\n", service)
-	return &proto.Empty{}, gs.dservice.AddService(service)
+	if err := gs.authorize(ctx, service.Name); err != nil {
+		return nil, err
+	}
+	if err := authStatus(identityFromContext(ctx).check(PERMISSION_REGISTER, service.Name)); err != nil {
+		return nil, err
+	}
+	if err := gs.dservice.AddService(service); err != nil {
+		return nil, storageStatus(err)
+	}
+	return &proto.Registration{Ttl: int64(gs.dservice.Ttl(service) / time.Second)}, nil
+}
+func (gs *grpcServer) Deregister(ctx context.Context, request *proto.DeregisterRequest) (*proto.Empty, error) {
+	log.Printf("processing deregistering service %q %s\n", request.Id, request.Url)
+	if err := gs.authorizeInstance(ctx, request.Id, request.Url, request.Secure); err != nil {
+		return nil, err
+	}
+	caller := identityFromContext(ctx)
+	if err := authStatus(caller.checkInstance(gs.dservice, PERMISSION_REGISTER, request.Id, request.Url, request.Secure)); err != nil {
+		return nil, err
+	}
+	if err := gs.dservice.Deregister(dto.ToDeregistration(request)); err != nil {
+		return nil, storageStatus(err)
+	}
+	return &proto.Empty{}, nil
 }
 func (gs *grpcServer) ListServices(ctx context.Context, request *proto.Empty) (response *proto.ListServiceResponse, err error) {
 	var parsedServices []*proto.ServiceWithHeartBeat
 	response = &proto.ListServiceResponse{}
+	caller := identityFromContext(ctx)
+	if err := authStatus(caller.checkAny()); err != nil {
+		return nil, err
+	}
 	services, err := gs.dservice.ListServices()
 	log.Println("processing get request for all registered services")
 	if err != nil {
-		return response, err
+		return response, storageStatus(err)
 	}
-	for _, service := range services {
-		parsedServices = append(parsedServices, &proto.ServiceWithHeartBeat{
-			Name:          service.Name,
-			Url:           service.Url,
-			LastHeartBeat: service.LastHeartBeat.Format(TIME_FORMAT),
-		})
+	for _, service := range caller.readable(services) {
+		parsedServices = append(parsedServices, toServiceWithHeartBeat(service))
 	}
 	response.Services = parsedServices
 	return response, nil
@@ -47,34 +89,281 @@ func (gs *grpcServer) ListServices(ctx context.Context, request *proto.Empty) (r
 
 func (gs *grpcServer) HeartBeat(ctx context.Context, request *proto.Service) (*proto.Empty, error) {
 	log.Printf("processing heartbeating on %s\n", request.Name)
-	return &proto.Empty{}, gs.dservice.HeartBeat(dto.ToService(request))
+	if err := gs.authorizeInstance(ctx, "", request.Url, request.Secure); err != nil {
+		return nil, err
+	}
+	caller := identityFromContext(ctx)
+	if err := authStatus(caller.checkInstance(gs.dservice, PERMISSION_HEARTBEAT, "", request.Url, request.Secure)); err != nil {
+		return nil, err
+	}
+	if err := gs.dservice.HeartBeat(dto.ToService(request)); err != nil {
+		return nil, storageStatus(err)
+	}
+	return &proto.Empty{}, nil
 }
 
 func (gs *grpcServer) GetService(ctx context.Context, request *proto.GetServiceRequest) (*proto.ServiceWithHeartBeat, error) {
-	service, err := gs.dservice.GetService(request.GetServiceName())
+	if err := authStatus(identityFromContext(ctx).check(PERMISSION_READ, request.GetServiceName())); err != nil {
+		return nil, err
+	}
+	service, err := gs.dservice.GetService(request.GetServiceName(), request.GetKey())
 	log.Printf("processing getting service data for %s\n", request.ServiceName)
 	if err != nil {
-		return &proto.ServiceWithHeartBeat{}, err
+		return &proto.ServiceWithHeartBeat{}, storageStatus(err)
 	}
+	return toServiceWithHeartBeat(service), nil
+}
+
+func (gs *grpcServer) ListInstances(ctx context.Context, request *proto.GetServiceRequest) (*proto.ListServiceResponse, error) {
+	log.Printf("processing listing instances of %s\n", request.ServiceName)
+	if err := authStatus(identityFromContext(ctx).check(PERMISSION_READ, request.GetServiceName())); err != nil {
+		return nil, err
+	}
+	// revision is taken before listing so watching from it misses nothing,
+	// services without instances get it too and an empty list
+	response := &proto.ListServiceResponse{Revision: gs.dservice.Revision()}
+	instances, err := gs.dservice.ListInstances(request.GetServiceName())
+	if err != nil {
+		log.Println(err)
+		return nil, storageStatus(err)
+	}
+	for _, instance := range instances {
+		response.Services = append(response.Services, toServiceWithHeartBeat(instance))
+	}
+	return response, nil
+}
+
+func (gs *grpcServer) FindInstances(ctx context.Context, request *proto.FindInstancesRequest) (*proto.ListServiceResponse, error) {
+	log.Printf("processing find instances matching %q\n", request.Selector)
+	response := &proto.ListServiceResponse{}
+	caller := identityFromContext(ctx)
+	if err := authStatus(caller.checkAny()); err != nil {
+		return nil, err
+	}
+	instances, err := gs.dservice.FindInstances(request.Selector)
+	if err != nil {
+		return response, storageStatus(err)
+	}
+	for _, instance := range caller.readable(instances) {
+		response.Services = append(response.Services, toServiceWithHeartBeat(instance))
+	}
+	return response, nil
+}
+
+func (gs *grpcServer) Watch(request *proto.WatchRequest, stream proto.Discovery_WatchServer) error {
+	log.Printf("processing watch on %q from revision %d\n", request.GetServiceName(), request.GetRevision())
+	caller := identityFromContext(stream.Context())
+	if err := authStatus(watchAllowed(caller, request.GetServiceName())); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-gs.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return gs.dservice.Watch(ctx, request.GetServiceName(), request.GetRevision(),
+		func(event dto.ServiceEvent) error {
+			if !caller.allows(PERMISSION_READ, event.Service.Name) {
+				return nil
+			}
+			return stream.Send(toWatchEvent(event))
+		})
+}
+
+func (gs *grpcServer) GetDelta(ctx context.Context, request *proto.DeltaRequest) (*proto.DeltaResponse, error) {
+	log.Printf("processing delta since revision %d\n", request.GetRevision())
+	// delta is hashed over the whole registry so it cant be filtered
+	if err := authStatus(identityFromContext(ctx).check(PERMISSION_READ, ALL_SERVICES)); err != nil {
+		return nil, err
+	}
+	response := &proto.DeltaResponse{}
+	delta, err := gs.dservice.GetDelta(request.GetRevision())
+	if err != nil {
+		return response, storageStatus(err)
+	}
+	response.Revision = delta.Revision
+	response.Hash = delta.Hash
+	for _, event := range delta.Events {
+		response.Events = append(response.Events, toWatchEvent(event))
+	}
+	return response, nil
+}
+
+func (gs *grpcServer) SetStatus(ctx context.Context, request *proto.StatusRequest) (*proto.Empty, error) {
+	log.Printf("processing status change of %s to %s\n", request.Url, request.Status)
+	if err := gs.authorizeInstance(ctx, "", request.Url, request.Secure); err != nil {
+		return nil, err
+	}
+	caller := identityFromContext(ctx)
+	if err := authStatus(caller.checkInstance(gs.dservice, PERMISSION_REGISTER, "", request.Url, request.Secure)); err != nil {
+		return nil, err
+	}
+	if err := gs.dservice.SetStatus(dto.ToServiceStatus(request)); err != nil {
+		return nil, storageStatus(err)
+	}
+	return &proto.Empty{}, nil
+}
+
+func (gs *grpcServer) GetSelfPreservation(ctx context.Context, request *proto.Empty) (*proto.SelfPreservation, error) {
+	if err := authStatus(identityFromContext(ctx).check(PERMISSION_READ, ALL_SERVICES)); err != nil {
+		return nil, err
+	}
+	status := gs.dservice.SelfPreservation()
+	return &proto.SelfPreservation{
+		Enabled:                   status.Enabled,
+		Active:                    status.Active,
+		ExpectedRenewalsPerMinute: int64(status.ExpectedRenewalsPerMinute),
+		RenewalsLastMinute:        int64(status.RenewalsLastMinute),
+	}, nil
+}
+
+// authorize checks serviceName against the client certificate
+// when registrations are bound to it.
+func (gs *grpcServer) authorize(ctx context.Context, serviceName string) error {
+	if !gs.bindServiceName {
+		return nil
+	}
+	if err := allowsServiceName(peerCertificates(ctx), serviceName); err != nil {
+		log.Println(err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// authorizeInstance checks name of the instance registered with id or on url,
+// unknown instances are left to fail as they would otherwise.
+func (gs *grpcServer) authorizeInstance(ctx context.Context, id string, url string, secure bool) error {
+	if !gs.bindServiceName {
+		return nil
+	}
+	instance, err := gs.dservice.Lookup(id, url, secure)
+	if err != nil {
+		return nil
+	}
+	return gs.authorize(ctx, instance.Name)
+}
+
+// authenticate resolves bearer token of the authorization metadata
+// to the caller identity.
+func (gs *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	return authenticateGrpc(gs.auth, ctx)
+}
+
+func authenticateGrpc(auth *authenticator, ctx context.Context) (context.Context, error) {
+	if auth == nil {
+		return ctx, nil
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			token = bearerToken(values[0])
+		}
+	}
+	caller, err := auth.authenticate(token)
+	if err != nil {
+		return ctx, authStatus(err)
+	}
+	return withIdentity(ctx, caller), nil
+}
+
+func (gs *grpcServer) unaryInterceptor(ctx context.Context, request interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := gs.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func (gs *grpcServer) streamInterceptor(service interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := gs.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(service, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticatedStream carries the caller identity to stream handlers.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authStatus maps auth errors to Unauthenticated and PermissionDenied,
+// instances hidden from the caller to NotFound.
+func authStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	log.Println(err)
+	if errors.Is(err, errUnauthenticated) {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	if errors.Is(err, discover.ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.PermissionDenied, err.Error())
+}
+
+// storageStatus maps errors of the discovery service to grpc codes,
+// the rest stays Unknown.
+func storageStatus(err error) error {
+	switch {
+	case errors.Is(err, discover.ErrDuplicate):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, discover.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, discover.ErrUnknownStatus), errors.Is(err, errInvalidArgument):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return err
+}
+
+func toWatchEvent(event dto.ServiceEvent) *proto.WatchEvent {
+	return &proto.WatchEvent{
+		Type:     proto.EventType(proto.EventType_value[event.Type]),
+		Revision: event.Revision,
+		Service:  toServiceWithHeartBeat(event.Service),
+	}
+}
+
+func toServiceWithHeartBeat(service dto.ServiceHeartBeat) *proto.ServiceWithHeartBeat {
 	return &proto.ServiceWithHeartBeat{
+		Id:            service.Id,
 		Name:          service.Name,
 		Url:           service.Url,
 		LastHeartBeat: service.LastHeartBeat.Format(TIME_FORMAT),
-	}, nil
+		Status:        proto.InstanceStatus(proto.InstanceStatus_value[service.Status]),
+		Metadata:      service.Metadata,
+		Tags:          service.Tags,
+	}
 }
 
+// Serve listens on localhost only, see ServeAddress.
 func (gs *grpcServer) Serve(port int) error {
-	url := fmt.Sprintf("%s:%d", "localhost", port)
-	log.Printf("Starting GRPC server on %s...\n", url)
-	listen, err := net.Listen("tcp", url)
+	return gs.ServeAddress(fmt.Sprintf("%s:%d", "localhost", port))
+}
+
+// ServeAddress listens on address e.g. :7654 for every interface
+// until the server is shut down.
+func (gs *grpcServer) ServeAddress(address string) error {
+	log.Printf("Starting GRPC server on %s...\n", address)
+	listen, err := net.Listen("tcp", address)
 	if err != nil {
 		return err
 	}
-	grpcServer := grpc.NewServer()
-	proto.RegisterDiscoveryServer(grpcServer, gs)
 	log.Println("Server started...")
-	err = grpcServer.Serve(listen)
-	if err != nil {
+	err = gs.server.Serve(listen)
+	if err != nil && err != grpc.ErrServerStopped {
 		return err
 	}
 	return nil
@@ -82,23 +371,49 @@ func (gs *grpcServer) Serve(port int) error {
 func (gs *grpcServer) ServeDefaultPort() error {
 	return gs.Serve(DEFAULT_PORT)
 }
+
+// Shutdown ends watch streams and waits for other calls to finish,
+// they are cancelled once ctx is done.
+func (gs *grpcServer) Shutdown(ctx context.Context) error {
+	gs.once.Do(func() { close(gs.quit) })
+	stopped := make(chan struct{})
+	go func() {
+		gs.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		gs.server.Stop()
+		return ctx.Err()
+	}
+}
 func NewDiscoveryGrpcServerInMemoryStorage() GrpcServer {
-	return &grpcServer{dservice: NewDiscoveryServiceWithInMemoryStorage()}
+	return newGrpcServer(NewDiscoveryServiceWithInMemoryStorage(), nil)
 }
 func NewDiscoveryGrpcServer(discoveryService *DiscoveryService) GrpcServer {
-	return &grpcServer{dservice: *discoveryService}
+	return newGrpcServer(*discoveryService, nil)
 }
 
-/*
-	Starts new default server on port 7654 for discovery (gRPC)
-	and on port 7655 http for ui.
-*/
-func NewServer() {
-	discoveryService := NewDiscoveryServiceWithInMemoryStorage()
-
-	grpcServer := NewDiscoveryGrpcServer(&discoveryService)
-	httpServer := NewHttpDiscoveryServer(&discoveryService)
+// Serves grpc over tls, plaintext when tlsConfig is nil.
+func NewDiscoveryGrpcServerWithTls(discoveryService *DiscoveryService, tlsConfig *tls.Config) GrpcServer {
+	return newGrpcServer(*discoveryService, tlsConfig)
+}
 
-	go grpcServer.ServeDefaultPort()
-	httpServer.Serve(DEFAULT_PORT_FOR_UI)
+func newGrpcServer(discoveryService DiscoveryService, tlsConfig *tls.Config) *grpcServer {
+	gs := &grpcServer{
+		dservice: discoveryService,
+		quit:     make(chan struct{}),
+	}
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(gs.unaryInterceptor),
+		grpc.StreamInterceptor(gs.streamInterceptor),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	gs.server = grpc.NewServer(options...)
+	proto.RegisterDiscoveryServer(gs.server, gs)
+	return gs
 }
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+	proto "github.com/ygaros/discovery-server/gen/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGrpcListInstancesOfUnknownService(t *testing.T) {
+	dservice := NewDiscoveryServiceWithInMemoryStorage()
+	gs := newGrpcServer(dservice, nil)
+	if err := dservice.AddService(dto.Service{Name: "payments", Url: "localhost:8081"}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := gs.ListInstances(context.Background(), &proto.GetServiceRequest{ServiceName: "orders"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Services) != 0 || response.Revision != dservice.Revision() {
+		t.Errorf("listed %d instances at revision %d, want none at %d", len(response.Services), response.Revision, dservice.Revision())
+	}
+}
+
+func TestGrpcAddServiceReturnsTtl(t *testing.T) {
+	storage := discover.NewMultiMapStorage()
+	storage.Leases().SetDefaultTtl(30 * time.Second)
+	gs := newGrpcServer(NewDiscoveryService(storage), nil)
+	tests := []struct {
+		ttl  int64
+		want int64
+	}{
+		{0, 30},
+		{10, 10},
+		{120, 120},
+	}
+	for i, test := range tests {
+		registration, err := gs.AddService(context.Background(), &proto.Service{
+			Name: "orders",
+			Url:  fmt.Sprintf("localhost:%d", 8080+i),
+			Ttl:  test.ttl,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if registration.Ttl != test.want {
+			t.Errorf("registered with ttl %d got %d, want %d", test.ttl, registration.Ttl, test.want)
+		}
+	}
+}
+
+func TestGrpcErrorCodes(t *testing.T) {
+	gs := newGrpcServer(NewDiscoveryServiceWithInMemoryStorage(), nil)
+	ctx := context.Background()
+	registered := &proto.Service{Name: "orders", Url: "localhost:8080"}
+	if _, err := gs.AddService(ctx, registered); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"duplicate", func() error {
+			_, err := gs.AddService(ctx, registered)
+			return err
+		}, codes.AlreadyExists},
+		{"unknown status", func() error {
+			_, err := gs.AddService(ctx, &proto.Service{Name: "orders", Url: "localhost:8081", Status: proto.InstanceStatus(42)})
+			return err
+		}, codes.InvalidArgument},
+		{"heartbeat of unknown instance", func() error {
+			_, err := gs.HeartBeat(ctx, &proto.Service{Name: "orders", Url: "localhost:9090"})
+			return err
+		}, codes.NotFound},
+		{"deregistration of unknown instance", func() error {
+			_, err := gs.Deregister(ctx, &proto.DeregisterRequest{Url: "localhost:9090"})
+			return err
+		}, codes.NotFound},
+		{"deregistration with invalid id", func() error {
+			_, err := gs.Deregister(ctx, &proto.DeregisterRequest{Id: "orders"})
+			return err
+		}, codes.InvalidArgument},
+		{"status of unknown instance", func() error {
+			_, err := gs.SetStatus(ctx, &proto.StatusRequest{Url: "localhost:9090", Status: proto.InstanceStatus_DOWN})
+			return err
+		}, codes.NotFound},
+		{"unknown status of instance", func() error {
+			_, err := gs.SetStatus(ctx, &proto.StatusRequest{Url: "localhost:8080", Status: proto.InstanceStatus(42)})
+			return err
+		}, codes.InvalidArgument},
+		{"unknown service", func() error {
+			_, err := gs.GetService(ctx, &proto.GetServiceRequest{ServiceName: "payments"})
+			return err
+		}, codes.NotFound},
+		{"invalid selector", func() error {
+			_, err := gs.FindInstances(ctx, &proto.FindInstancesRequest{Selector: "name in (orders"})
+			return err
+		}, codes.InvalidArgument},
+		{"heartbeat", func() error {
+			_, err := gs.HeartBeat(ctx, registered)
+			return err
+		}, codes.OK},
+	}
+	for _, test := range tests {
+		if code := status.Code(test.call()); code != test.want {
+			t.Errorf("%s returned %s, want %s", test.name, code, test.want)
+		}
+	}
+}
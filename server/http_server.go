@@ -1,27 +1,62 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/ygaros/discovery-server/discover"
 	"github.com/ygaros/discovery-server/dto"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+const (
+	LONG_POLL_DEFAULT_WAIT = 5 * time.Minute
+	LONG_POLL_MAX_WAIT     = 10 * time.Minute
+	// Revision the listed services last changed at, next ?index= for long polling.
+	INDEX_HEADER = "X-Registry-Index"
+)
+
 type HttpServer interface {
 	AddService(w http.ResponseWriter, r *http.Request)
+	Deregister(w http.ResponseWriter, r *http.Request)
 	ListServices(w http.ResponseWriter, r *http.Request)
 	HeartBeat(w http.ResponseWriter, r *http.Request)
+	SetStatus(w http.ResponseWriter, r *http.Request)
 	GetService(w http.ResponseWriter, r *http.Request)
+	ListInstances(w http.ResponseWriter, r *http.Request)
+	FindInstances(w http.ResponseWriter, r *http.Request)
+	Replicate(w http.ResponseWriter, r *http.Request)
+	SelfPreservation(w http.ResponseWriter, r *http.Request)
+	GetDelta(w http.ResponseWriter, r *http.Request)
+	Events(w http.ResponseWriter, r *http.Request)
+	Socket(w http.ResponseWriter, r *http.Request)
 	Serve(port int) error
+	ServeAddress(address string) error
+	Shutdown(ctx context.Context) error
 }
 type httpServer struct {
 	dservice DiscoveryService
+	server   *http.Server
+	cancel   context.CancelFunc
+	// registrations are limited to SANs of client certificates
+	bindServiceName bool
+	// callers are authenticated by the middleware when set
+	auth *authenticator
+	// websocket origins accepted besides the one of the server
+	allowedOrigins []string
 }
 
 func (s *httpServer) AddService(w http.ResponseWriter, r *http.Request) {
@@ -40,21 +75,85 @@ func (s *httpServer) AddService(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if _, err := discover.ParseStatus(service.Status); err != nil {
+		log.Printf("Invalid status %q\n", service.Status)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, r, service.Name) {
+		return
+	}
+	if !permit(w, identityFromContext(r.Context()).check(PERMISSION_REGISTER, service.Name)) {
+		return
+	}
+	err = s.dservice.AddService(service)
+	if errors.Is(err, discover.ErrDuplicate) {
+		log.Println(err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Println("Failed to register:", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 	log.Printf("Registered %s on %s\n",
 		service.Name,
 		service.Url,
 	)
-	err = s.dservice.AddService(service)
+	w.WriteHeader(http.StatusCreated)
+}
+func (s *httpServer) Deregister(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
+		log.Println("Failed to read body:", err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	w.WriteHeader(http.StatusCreated)
-}
-func (s *httpServer) ListServices(w http.ResponseWriter, _ *http.Request) {
+	defer r.Body.Close()
 
+	service := dto.Deregistration{}
+
+	if err := json.Unmarshal(body, &service); err != nil {
+		log.Println("Failed to unmarshal payload:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(service.Id) == 0 && len(service.Url) == 0 {
+		log.Println("id or url is mandatory!")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeInstance(w, r, service.Id, service.Url, service.Secure) {
+		return
+	}
+	caller := identityFromContext(r.Context())
+	if !permit(w, caller.checkInstance(s.dservice, PERMISSION_REGISTER, service.Id, service.Url, service.Secure)) {
+		return
+	}
+	err = s.dservice.Deregister(service)
+	if err != nil {
+		log.Println("Error occurred during deregistering", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	log.Printf("Deregistered %s%s\n",
+		service.Id,
+		service.Url,
+	)
+	w.WriteHeader(http.StatusNoContent)
+}
+func (s *httpServer) ListServices(w http.ResponseWriter, r *http.Request) {
+	caller := identityFromContext(r.Context())
+	if !permit(w, caller.checkAny()) {
+		return
+	}
+	if !s.blockingQuery(w, r, "") {
+		return
+	}
 	if services, err := s.dservice.ListServices(); err == nil {
-		if marshaled, err := json.Marshal(services); err == nil {
-			w.Write(marshaled)
+		if marshaled, err := json.Marshal(caller.readable(services)); err == nil {
+			writeTagged(w, r, marshaled)
 			return
 		} else {
 			w.WriteHeader(http.StatusBadRequest)
@@ -79,6 +178,13 @@ func (s *httpServer) HeartBeat(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if !s.authorizeInstance(w, r, "", service.Url, service.Secure) {
+		return
+	}
+	caller := identityFromContext(r.Context())
+	if !permit(w, caller.checkInstance(s.dservice, PERMISSION_HEARTBEAT, "", service.Url, service.Secure)) {
+		return
+	}
 	log.Printf("HeartBeat %s on %s\n",
 		service.Name,
 		service.Url,
@@ -90,6 +196,45 @@ func (s *httpServer) HeartBeat(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+func (s *httpServer) SetStatus(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Failed to read body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	service := dto.ServiceStatus{}
+
+	if err := json.Unmarshal(body, &service); err != nil {
+		log.Println("Failed to unmarshal payload:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if _, err := discover.ParseStatus(service.Status); err != nil || len(service.Status) == 0 {
+		log.Printf("Invalid status %q\n", service.Status)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !s.authorizeInstance(w, r, "", service.Url, service.Secure) {
+		return
+	}
+	caller := identityFromContext(r.Context())
+	if !permit(w, caller.checkInstance(s.dservice, PERMISSION_REGISTER, "", service.Url, service.Secure)) {
+		return
+	}
+	log.Printf("Status %s on %s\n",
+		service.Status,
+		service.Url,
+	)
+	err = s.dservice.SetStatus(service)
+	if err != nil {
+		log.Println("Error occurred during updating status", err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+}
 func (s *httpServer) GetService(w http.ResponseWriter, r *http.Request) {
 	serviceName := r.URL.Query().Get("serviceName")
 	if len(serviceName) == 0 {
@@ -97,14 +242,20 @@ func (s *httpServer) GetService(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	get, err := s.dservice.GetService(serviceName)
+	if !permit(w, identityFromContext(r.Context()).check(PERMISSION_READ, serviceName)) {
+		return
+	}
+	if !s.blockingQuery(w, r, serviceName) {
+		return
+	}
+	get, err := s.dservice.GetService(serviceName, r.URL.Query().Get("key"))
 	if err != nil {
 		log.Printf("Service %s isnt registered!\n", serviceName)
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 	if marshaled, err := json.Marshal(get); err == nil {
-		w.Write(marshaled)
+		writeTagged(w, r, marshaled)
 		return
 	} else {
 		log.Printf("error occurred during processing getService request on %s\n", serviceName)
@@ -114,27 +265,327 @@ func (s *httpServer) GetService(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func (s *httpServer) ListInstances(w http.ResponseWriter, r *http.Request) {
+	serviceName := r.URL.Query().Get("serviceName")
+	if len(serviceName) == 0 {
+		log.Println("serviceName parameter is mandatory!")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !permit(w, identityFromContext(r.Context()).check(PERMISSION_READ, serviceName)) {
+		return
+	}
+	// like over grpc unknown service is listed empty with the registry
+	// revision taken before listing, so watching from it misses nothing
+	w.Header().Set(INDEX_HEADER, strconv.FormatUint(s.dservice.Revision(), 10))
+	instances, err := s.dservice.ListInstances(serviceName)
+	if err != nil {
+		log.Printf("Failed to list instances of %s: %v\n", serviceName, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if marshaled, err := json.Marshal(instances); err == nil {
+		writeTagged(w, r, marshaled)
+		return
+	} else {
+		log.Printf("error occurred during processing listInstances request on %s\n", serviceName)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+func (s *httpServer) FindInstances(w http.ResponseWriter, r *http.Request) {
+	caller := identityFromContext(r.Context())
+	if !permit(w, caller.checkAny()) {
+		return
+	}
+	selector := r.URL.Query().Get("selector")
+	instances, err := s.dservice.FindInstances(selector)
+	if err != nil {
+		log.Printf("Invalid selector %q: %v\n", selector, err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if marshaled, err := json.Marshal(caller.readable(instances)); err == nil {
+		w.Write(marshaled)
+		return
+	} else {
+		log.Printf("error occurred during processing findInstances request on %s\n", selector)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+}
+
+func (s *httpServer) Replicate(w http.ResponseWriter, r *http.Request) {
+	if !permit(w, identityFromContext(r.Context()).check(PERMISSION_ADMIN, ALL_SERVICES)) {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println("Failed to read body:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	var events []dto.ReplicationEvent
+
+	if err := json.Unmarshal(body, &events); err != nil {
+		log.Println("Failed to unmarshal payload:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	s.dservice.Replicate(events)
+}
+
+func (s *httpServer) SelfPreservation(w http.ResponseWriter, r *http.Request) {
+	if !permit(w, identityFromContext(r.Context()).check(PERMISSION_READ, ALL_SERVICES)) {
+		return
+	}
+	if marshaled, err := json.Marshal(s.dservice.SelfPreservation()); err == nil {
+		w.Write(marshaled)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+}
+
+func (s *httpServer) GetDelta(w http.ResponseWriter, r *http.Request) {
+	// delta is hashed over the whole registry so it cant be filtered
+	if !permit(w, identityFromContext(r.Context()).check(PERMISSION_READ, ALL_SERVICES)) {
+		return
+	}
+	var revision uint64
+	if param := r.URL.Query().Get("revision"); len(param) > 0 {
+		parsed, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			log.Printf("Invalid revision %q\n", param)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		revision = parsed
+	}
+	delta, err := s.dservice.GetDelta(revision)
+	if err != nil {
+		// client has to fetch the whole registry with revision 0
+		log.Println("Error occurred during getting delta", err)
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if marshaled, err := json.Marshal(delta); err == nil {
+		w.Write(marshaled)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+}
+
+// blockingQuery holds requests with ?index=N until serviceName changes after
+// revision N or ?wait passes, like consul blocking queries. Responses carry
+// the revision serviceName last changed at, the registry one when it's empty,
+// false is returned when the request was invalid.
+func (s *httpServer) blockingQuery(w http.ResponseWriter, r *http.Request, serviceName string) bool {
+	query := r.URL.Query()
+	var index uint64
+	if param := query.Get("index"); len(param) > 0 {
+		parsed, err := strconv.ParseUint(param, 10, 64)
+		if err != nil {
+			log.Printf("Invalid index %q\n", param)
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		index = parsed
+	}
+	wait := LONG_POLL_DEFAULT_WAIT
+	if param := query.Get("wait"); len(param) > 0 {
+		parsed, err := time.ParseDuration(param)
+		if err != nil || parsed < 0 {
+			log.Printf("Invalid wait %q\n", param)
+			w.WriteHeader(http.StatusBadRequest)
+			return false
+		}
+		wait = parsed
+	}
+	if wait > LONG_POLL_MAX_WAIT {
+		wait = LONG_POLL_MAX_WAIT
+	}
+	revision := s.dservice.ServiceRevision(serviceName)
+	if index > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		revision = s.dservice.WaitIndex(ctx, serviceName, index)
+	}
+	w.Header().Set(INDEX_HEADER, strconv.FormatUint(revision, 10))
+	return true
+}
+
+// writeTagged writes body with ETag hashed over it, the revision doesnt move
+// on heartbeats while the heartbeat timestamps in the body do. Requests with
+// a matching If-None-Match get 304 instead.
+func writeTagged(w http.ResponseWriter, r *http.Request, body []byte) {
+	hash := fnv.New64a()
+	hash.Write(body)
+	etag := fmt.Sprintf("\"%x\"", hash.Sum64())
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(body)
+}
+
+// authorize checks serviceName against the client certificate when
+// registrations are bound to it, it responds with 403 otherwise.
+func (s *httpServer) authorize(w http.ResponseWriter, r *http.Request, serviceName string) bool {
+	if !s.bindServiceName {
+		return true
+	}
+	var certificates []*x509.Certificate
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		certificates = r.TLS.PeerCertificates
+	}
+	if err := allowsServiceName(certificates, serviceName); err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeInstance checks name of the instance registered with id or on url,
+// unknown instances are left to fail as they would otherwise.
+func (s *httpServer) authorizeInstance(w http.ResponseWriter, r *http.Request, id string, url string, secure bool) bool {
+	if !s.bindServiceName {
+		return true
+	}
+	instance, err := s.dservice.Lookup(id, url, secure)
+	if err != nil {
+		return true
+	}
+	return s.authorize(w, r, instance.Name)
+}
+
+// authenticate resolves bearer token of the Authorization header, or of
+// ?access_token= as EventSource and websockets cant set headers, to the
+// caller identity. Invalid tokens are rejected with 401.
+func (s *httpServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := r.URL.Query().Get("access_token")
+		if header := r.Header.Get("Authorization"); len(header) > 0 {
+			token = bearerToken(header)
+		}
+		caller, err := s.auth.authenticate(token)
+		if !permit(w, err) {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(withIdentity(r.Context(), caller)))
+	})
+}
+
+// permit responds with 401, 403 or 404 for hidden instances
+// unless err of the acl check is nil.
+func permit(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+	log.Println(err)
+	if errors.Is(err, errUnauthenticated) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if errors.Is(err, discover.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return false
+	}
+	w.WriteHeader(http.StatusForbidden)
+	return false
+}
+
 func (s *httpServer) Serve(port int) error {
 	if port == 0 {
 		port = 7654
 	}
+	return s.ServeAddress(fmt.Sprintf(":%d", port))
+}
+
+// ServeAddress listens on address until the server is shut down.
+func (s *httpServer) ServeAddress(address string) error {
+	log.Printf("Starting HTTP server on %s...\n", address)
+	listen, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if s.server.TLSConfig != nil {
+		// certificates come from TLSConfig
+		err = s.server.ServeTLS(listen, "", "")
+	} else {
+		err = s.server.Serve(listen)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown ends change feeds and long polls and waits for other
+// requests to finish, connections are closed once ctx is done.
+func (s *httpServer) Shutdown(ctx context.Context) error {
+	s.cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.server.Close()
+		return err
+	}
+	return nil
+}
+
+func (s *httpServer) router() http.Handler {
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
+	r.Use(s.authenticate)
 	r.Group(func(r chi.Router) {
 		r.Post("/register", s.AddService)
+		r.Delete("/register", s.Deregister)
 		r.Post("/heartbeat", s.HeartBeat)
+		r.Put("/status", s.SetStatus)
 		r.Get("/list", s.ListServices)
 		r.Get("/service", s.GetService)
+		r.Get("/service/instances", s.ListInstances)
+		r.Get("/instances", s.FindInstances)
+		r.Post("/replicate", s.Replicate)
+		r.Get("/selfpreservation", s.SelfPreservation)
+		r.Get("/delta", s.GetDelta)
+		r.Get("/events", s.Events)
+		r.Get("/ws", s.Socket)
 	})
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), r)
+	return r
 }
 
 func NewHttpDiscoveryServer(discoveryService *DiscoveryService) HttpServer {
-	return &httpServer{dservice: *discoveryService}
+	return newHttpServer(*discoveryService, nil)
+}
+
+// Serves https, plain http when tlsConfig is nil.
+func NewHttpDiscoveryServerWithTls(discoveryService *DiscoveryService, tlsConfig *tls.Config) HttpServer {
+	return newHttpServer(*discoveryService, tlsConfig)
 }
 
 func NewHttpDiscoveryServerInMemoryStorage() HttpServer {
-	return &httpServer{dservice: NewDiscoveryServiceWithInMemoryStorage()}
+	return newHttpServer(NewDiscoveryServiceWithInMemoryStorage(), nil)
+}
+
+func newHttpServer(discoveryService DiscoveryService, tlsConfig *tls.Config) *httpServer {
+	// requests are cancelled through it on shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &httpServer{dservice: discoveryService, cancel: cancel}
+	s.server = &http.Server{
+		Handler:     s.router(),
+		TLSConfig:   tlsConfig,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	return s
 }
 
 // func IndexMapping(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ygaros/discovery-server/dto"
+)
+
+func TestHttpAddServiceStatusCodes(t *testing.T) {
+	handler := newHttpServer(NewDiscoveryServiceWithInMemoryStorage(), nil).router()
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"registered", `{"name":"orders","url":"localhost:8080"}`, http.StatusCreated},
+		{"duplicate", `{"name":"orders","url":"localhost:8080"}`, http.StatusConflict},
+		{"unknown status", `{"name":"orders","url":"localhost:8081","status":"SLEEPING"}`, http.StatusBadRequest},
+		{"malformed", `{"name":`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(test.body)))
+		if recorder.Code != test.want {
+			t.Errorf("%s returned %d, want %d", test.name, recorder.Code, test.want)
+		}
+	}
+}
+
+func TestHttpServiceIndex(t *testing.T) {
+	handler := newHttpServer(NewDiscoveryServiceWithInMemoryStorage(), nil).router()
+	send := func(method string, target string, body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return recorder
+	}
+	index := func(target string) string {
+		return send(http.MethodGet, target, "").Header().Get(INDEX_HEADER)
+	}
+	send(http.MethodPost, "/register", `{"name":"orders","url":"localhost:8080"}`)
+	orders, registry := index("/service?serviceName=orders"), index("/list")
+
+	send(http.MethodPost, "/heartbeat", `{"name":"orders","url":"localhost:8080"}`)
+	send(http.MethodPost, "/register", `{"name":"payments","url":"localhost:8081"}`)
+	if got := index("/service?serviceName=orders"); got != orders {
+		t.Errorf("orders index moved from %s to %s without changing", orders, got)
+	}
+	if got := index("/list"); got == registry {
+		t.Errorf("registry index stayed %s after a registration", got)
+	}
+	// the blocking query waits for orders only
+	start := time.Now()
+	recorder := send(http.MethodGet, "/service?serviceName=orders&index="+orders+"&wait=100ms", "")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || recorder.Header().Get(INDEX_HEADER) != orders {
+		t.Errorf("blocking query returned index %s after %v, want %s after wait", recorder.Header().Get(INDEX_HEADER), elapsed, orders)
+	}
+
+	send(http.MethodPut, "/status", `{"url":"localhost:8080","status":"DOWN"}`)
+	if got := index("/service?serviceName=orders"); got == orders {
+		t.Errorf("orders index stayed %s after status change", got)
+	}
+}
+
+func TestHttpDeregisterStatusCodes(t *testing.T) {
+	handler := newHttpServer(NewDiscoveryServiceWithInMemoryStorage(), nil).router()
+	register := httptest.NewRecorder()
+	handler.ServeHTTP(register, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(`{"name":"orders","url":"localhost:8080"}`)))
+	if register.Code != http.StatusCreated {
+		t.Fatalf("registration returned %d", register.Code)
+	}
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{"registered", `{"url":"localhost:8080"}`, http.StatusNoContent},
+		{"already deregistered", `{"url":"localhost:8080"}`, http.StatusNotFound},
+		{"without id and url", `{}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/register", strings.NewReader(test.body)))
+		if recorder.Code != test.want {
+			t.Errorf("%s returned %d, want %d", test.name, recorder.Code, test.want)
+		}
+	}
+}
+
+func TestHttpETagFollowsHeartbeats(t *testing.T) {
+	handler := newHttpServer(NewDiscoveryServiceWithInMemoryStorage(), nil).router()
+	send := func(method string, target string, body string, etag string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(etag) > 0 {
+			request.Header.Set("If-None-Match", etag)
+		}
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+	send(http.MethodPost, "/register", `{"name":"orders","url":"localhost:8080"}`, "")
+	for _, target := range []string{"/list", "/service?serviceName=orders", "/service/instances?serviceName=orders"} {
+		first := send(http.MethodGet, target, "", "")
+		etag := first.Header().Get("ETag")
+		if len(etag) == 0 {
+			t.Errorf("%s isnt tagged", target)
+			continue
+		}
+		if cached := send(http.MethodGet, target, "", etag); cached.Code != http.StatusNotModified {
+			t.Errorf("%s with unchanged body returned %d, want %d", target, cached.Code, http.StatusNotModified)
+		}
+		time.Sleep(10 * time.Millisecond)
+		send(http.MethodPost, "/heartbeat", `{"name":"orders","url":"localhost:8080"}`, "")
+		renewed := send(http.MethodGet, target, "", etag)
+		if renewed.Code != http.StatusOK || renewed.Body.String() == first.Body.String() {
+			t.Errorf("%s after heartbeat returned %d with the same body %v, want %d with the new heartbeat",
+				target, renewed.Code, renewed.Body.String() == first.Body.String(), http.StatusOK)
+		}
+	}
+}
+
+func TestHttpListInstancesOfUnknownService(t *testing.T) {
+	dservice := NewDiscoveryServiceWithInMemoryStorage()
+	handler := newHttpServer(dservice, nil).router()
+	if err := dservice.AddService(dto.Service{Name: "payments", Url: "localhost:8081"}); err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/service/instances?serviceName=orders", nil))
+	index := strconv.FormatUint(dservice.Revision(), 10)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "[]" || recorder.Header().Get(INDEX_HEADER) != index {
+		t.Errorf("listed %d %s at index %s, want %d [] at %s",
+			recorder.Code, recorder.Body.String(), recorder.Header().Get(INDEX_HEADER), http.StatusOK, index)
+	}
+}
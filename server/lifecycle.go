@@ -0,0 +1,183 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// How long Start waits for in-flight requests after a stop signal.
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// Server runs every listener of its config over one discovery service.
+type Server struct {
+	config   Config
+	dservice DiscoveryService
+	grpc     GrpcServer
+	http     HttpServer
+	dns      DnsServer
+	xds      XdsServer
+	certs    *certReloader
+	auth     *authenticator
+	quit     chan struct{}
+	once     sync.Once
+	err      error
+}
+
+// Start serves until ctx is done, SIGTERM or SIGINT is received, a listener
+// fails or Shutdown is called, then it shuts the server down with
+// SHUTDOWN_TIMEOUT and returns the listener error if there was any.
+func (s *Server) Start(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		return s.grpc.ServeAddress(s.config.Grpc.Address)
+	})
+	group.Go(func() error {
+		return s.http.ServeAddress(s.config.Http.Address)
+	})
+	if s.dns != nil {
+		group.Go(func() error {
+			return s.dns.ServeAddress(s.config.Dns.Address)
+		})
+	}
+	if s.xds != nil {
+		group.Go(func() error {
+			return s.xds.ServeAddress(s.config.Xds.Address)
+		})
+	}
+	group.Go(func() error {
+		select {
+		case <-groupCtx.Done():
+			log.Println("Shutting down...")
+		case <-s.quit:
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+		defer cancel()
+		return s.Shutdown(shutdownCtx)
+	})
+	return group.Wait()
+}
+
+// Shutdown stops accepting connections, waits for in-flight requests until
+// ctx is done and closes the discovery service. It's safe to call more than once,
+// later calls wait for the first one and return its result.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.once.Do(func() {
+		close(s.quit)
+		var group errgroup.Group
+		group.Go(func() error { return s.grpc.Shutdown(ctx) })
+		group.Go(func() error { return s.http.Shutdown(ctx) })
+		if s.dns != nil {
+			group.Go(s.dns.Shutdown)
+		}
+		if s.xds != nil {
+			group.Go(s.xds.Shutdown)
+		}
+		s.err = group.Wait()
+		s.certs.stop()
+		s.auth.stop()
+		if err := s.dservice.Close(); err != nil && s.err == nil {
+			s.err = err
+		}
+		if s.err != nil {
+			log.Println("Server stopped:", s.err)
+			return
+		}
+		log.Println("Server stopped")
+	})
+	return s.err
+}
+
+// Creates server with DefaultConfig changed by options, it fails
+// when the config is invalid or the storage cant be opened.
+func NewDiscoveryServer(options ...Option) (*Server, error) {
+	config := DefaultConfig()
+	for _, option := range options {
+		option(&config)
+	}
+	certs, err := newCertReloader(config)
+	if err != nil {
+		return nil, err
+	}
+	discoveryService, err := newDiscoveryServiceWithConfig(config, certs)
+	if err != nil {
+		certs.stop()
+		return nil, err
+	}
+	auth, err := newAuthenticator(config)
+	if err != nil {
+		certs.stop()
+		discoveryService.Close()
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if certs != nil {
+		tlsConfig = certs.tlsConfig()
+	}
+	grpcServer := newGrpcServer(discoveryService, tlsConfig)
+	grpcServer.bindServiceName = config.Tls.BindServiceName
+	grpcServer.auth = auth
+	httpServer := newHttpServer(discoveryService, tlsConfig)
+	httpServer.bindServiceName = config.Tls.BindServiceName
+	httpServer.auth = auth
+	httpServer.allowedOrigins = config.Http.AllowedOrigins
+	s := &Server{
+		config:   config,
+		dservice: discoveryService,
+		grpc:     grpcServer,
+		http:     httpServer,
+		certs:    certs,
+		auth:     auth,
+		quit:     make(chan struct{}),
+	}
+	if len(config.Dns.Address) > 0 {
+		dnsServer := NewDnsServer(&discoveryService, DnsConfig{Domain: config.Dns.Domain, Ttl: config.Dns.Ttl}).(*dnsServer)
+		if auth != nil {
+			dnsServer.caller = auth.anonymous
+			if len(auth.anonymous.rules) == 0 {
+				log.Println("DNS answers only services auth.anonymous can read, there arent any")
+			}
+		}
+		s.dns = dnsServer
+	}
+	if len(config.Xds.Address) > 0 {
+		xdsServer := newXdsServer(discoveryService, tlsConfig)
+		xdsServer.auth = auth
+		s.xds = xdsServer
+	}
+	return s, nil
+}
+
+/*
+	Starts new server with DefaultConfig changed by options,
+	by default on port 7654 for discovery (gRPC) and on port 7655 http for ui.
+	Blocks until SIGTERM or SIGINT, exits when the config is invalid or a server fails.
+*/
+func NewServer(options ...Option) {
+	s, err := NewDiscoveryServer(options...)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := s.Start(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Run serves discovery on every listener of config until a stop signal
+// or until one of them fails.
+func Run(config Config) error {
+	s, err := NewDiscoveryServer(WithConfig(config))
+	if err != nil {
+		return err
+	}
+	return s.Start(context.Background())
+}
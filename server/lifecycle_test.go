@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newLocalServer listens on free local ports for every transport.
+func newLocalServer(t *testing.T, change func(*Config)) *Server {
+	t.Helper()
+	config := DefaultConfig()
+	config.Grpc.Address = "127.0.0.1:0"
+	config.Http.Address = "127.0.0.1:0"
+	config.Dns.Address = "127.0.0.1:0"
+	config.Xds.Address = "127.0.0.1:0"
+	change(&config)
+	s, err := NewDiscoveryServer(WithConfig(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// start runs Start in background, the returned channel gets its result.
+func start(s *Server) chan error {
+	result := make(chan error, 1)
+	go func() { result <- s.Start(context.Background()) }()
+	return result
+}
+
+func awaitStart(t *testing.T, result chan error) error {
+	t.Helper()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("Start didnt return")
+		return nil
+	}
+}
+
+// awaitGoroutines waits until no more than baseline goroutines run.
+func awaitGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			stacks := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines run after shutdown, want %d:\n%s",
+				runtime.NumGoroutine(), baseline, stacks[:runtime.Stack(stacks, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerShutdownTwice(t *testing.T) {
+	// the first server starts the signal watcher and grpc internals,
+	// they live as long as the process does
+	warmup := newLocalServer(t, func(*Config) {})
+	result := start(warmup)
+	time.Sleep(100 * time.Millisecond)
+	warmup.Shutdown(context.Background())
+	awaitStart(t, result)
+	baseline := runtime.NumGoroutine()
+
+	s := newLocalServer(t, func(*Config) {})
+	result = start(s)
+	time.Sleep(100 * time.Millisecond)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- s.Shutdown(context.Background()) }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("shutdown returned %v", err)
+		}
+	}
+	if err := awaitStart(t, result); err != nil {
+		t.Errorf("Start returned %v after shutdown", err)
+	}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown after Start returned %v", err)
+	}
+	awaitGoroutines(t, baseline)
+}
+
+func TestServerStopsOnListenerFailure(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	warmup := newLocalServer(t, func(*Config) {})
+	result := start(warmup)
+	time.Sleep(100 * time.Millisecond)
+	warmup.Shutdown(context.Background())
+	awaitStart(t, result)
+	baseline := runtime.NumGoroutine()
+
+	s := newLocalServer(t, func(c *Config) { c.Http.Address = taken.Addr().String() })
+	err = awaitStart(t, start(s))
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Start returned %v, want %v", err, syscall.EADDRINUSE)
+	}
+	// the other listeners were shut down before Start returned
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown after failed Start returned %v", err)
+	}
+	awaitGoroutines(t, baseline)
+}
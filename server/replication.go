@@ -0,0 +1,234 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+)
+
+const (
+	REPLICATION_INTERVAL   = 1 * time.Second
+	REPLICATION_TIMEOUT    = 5 * time.Second
+	REPLICATION_BATCH_SIZE = 250
+	REPLICATION_QUEUE_SIZE = 10000
+)
+
+// peerReplicator asynchronously forwards registrations, heartbeats and
+// cancellations made on this node to the other nodes, like eureka does.
+// Unreachable peers are reconciled with a full sync of the registrations
+// owned by this node once they are back.
+type peerReplicator struct {
+	peers []*peerNode
+	// registrations received directly from clients, keyed by url
+	owned map[string]dto.ReplicationEvent
+	// ttl of registrations without their own one
+	defaultTtl time.Duration
+	lock       sync.Mutex
+	quit       chan struct{}
+	done       sync.WaitGroup
+}
+
+type peerNode struct {
+	url       string
+	client    *http.Client
+	events    chan dto.ReplicationEvent
+	reachable bool
+	// bearer token of the peer, empty when it doesnt authenticate requests
+	token string
+}
+
+func (r *peerReplicator) replicate(action string, service discover.Service) {
+	if r == nil {
+		return
+	}
+	event := dto.ReplicationEvent{
+		Action:        action,
+		Name:          service.Name,
+		Url:           service.Url,
+		Status:        string(service.Status),
+		Metadata:      service.Metadata,
+		Tags:          service.Tags,
+		Ttl:           int64(service.Ttl / time.Second),
+		LastHeartBeat: service.LastHeartBeatCheck,
+	}
+	r.lock.Lock()
+	if action == dto.REPLICATE_CANCEL {
+		delete(r.owned, event.Url)
+	} else {
+		r.owned[event.Url] = event
+	}
+	r.lock.Unlock()
+	for _, peer := range r.peers {
+		select {
+		case peer.events <- event:
+		default:
+			// heartbeats of unknown services are registered by the peer,
+			// so the next one makes up for the dropped event
+			log.Printf("Replication queue of %s is full, dropping %s of %s\n", peer.url, action, event.Url)
+		}
+	}
+}
+
+// snapshot returns registrations owned by this node which arent expired yet.
+func (r *peerReplicator) snapshot() []dto.ReplicationEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	events := make([]dto.ReplicationEvent, 0, len(r.owned))
+	for url, event := range r.owned {
+		if expired(event, r.defaultTtl) {
+			delete(r.owned, url)
+			continue
+		}
+		event.Action = dto.REPLICATE_REGISTER
+		events = append(events, event)
+	}
+	return events
+}
+
+// stop sends events still queued to reachable peers and stops replicating.
+func (r *peerReplicator) stop() {
+	if r == nil {
+		return
+	}
+	close(r.quit)
+	r.done.Wait()
+}
+
+func (p *peerNode) run(snapshot func() []dto.ReplicationEvent, quit chan struct{}) {
+	ticker := time.NewTicker(REPLICATION_INTERVAL)
+	defer ticker.Stop()
+	var batch []dto.ReplicationEvent
+	for {
+		select {
+		case <-quit:
+			p.flush(batch)
+			return
+		case event := <-p.events:
+			batch = append(batch, event)
+			if len(batch) < REPLICATION_BATCH_SIZE {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if !p.reachable {
+			if err := p.send(snapshot()); err != nil {
+				batch = pendingCancellations(batch)
+				continue
+			}
+			log.Printf("Peer %s is reachable, registry reconciled\n", p.url)
+			p.reachable = true
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		if err := p.send(batch); err != nil {
+			log.Printf("Peer %s is unreachable, replication suspended: %v\n", p.url, err)
+			p.reachable = false
+			batch = pendingCancellations(batch)
+			continue
+		}
+		batch = batch[:0]
+	}
+}
+
+func (p *peerNode) flush(batch []dto.ReplicationEvent) {
+	// run is the only reader of events
+	for len(p.events) > 0 {
+		batch = append(batch, <-p.events)
+	}
+	if !p.reachable || len(batch) == 0 {
+		return
+	}
+	if err := p.send(batch); err != nil {
+		log.Printf("Failed to flush %d events to %s: %v\n", len(batch), p.url, err)
+	}
+}
+
+func (p *peerNode) send(batch []dto.ReplicationEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, p.url+"/replicate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(p.token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("[err] peer %s responded with %s", p.url, response.Status)
+	}
+	return nil
+}
+
+// pendingCancellations keeps only events that the full sync
+// done on reconnect cant make up for.
+func pendingCancellations(batch []dto.ReplicationEvent) []dto.ReplicationEvent {
+	pending := batch[:0]
+	for _, event := range batch {
+		if event.Action == dto.REPLICATE_CANCEL {
+			pending = append(pending, event)
+		}
+	}
+	return pending
+}
+
+func (r *peerReplicator) setDefaultTtl(ttl time.Duration) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.defaultTtl = ttl
+}
+
+func expired(event dto.ReplicationEvent, defaultTtl time.Duration) bool {
+	ttl := time.Duration(event.Ttl) * time.Second
+	if ttl <= 0 {
+		ttl = defaultTtl
+	}
+	return event.LastHeartBeat.Add(ttl).Before(time.Now())
+}
+
+// Peers are reached with tlsConfig over https, default settings when it's nil.
+func newPeerReplicator(peers []string, token string, tlsConfig *tls.Config) *peerReplicator {
+	r := &peerReplicator{
+		owned:      make(map[string]dto.ReplicationEvent),
+		defaultTtl: discover.DELETION_TIME,
+		quit:       make(chan struct{}),
+	}
+	for _, url := range peers {
+		peer := &peerNode{
+			url: strings.TrimSuffix(url, "/"),
+			client: &http.Client{
+				Timeout:   REPLICATION_TIMEOUT,
+				Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+			},
+			events: make(chan dto.ReplicationEvent, REPLICATION_QUEUE_SIZE),
+			token:  token,
+		}
+		r.peers = append(r.peers, peer)
+		r.done.Add(1)
+		go func() {
+			defer r.done.Done()
+			peer.run(r.snapshot, r.quit)
+		}()
+	}
+	return r
+}
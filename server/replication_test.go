@@ -0,0 +1,184 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+)
+
+// testPeer records batches posted to /replicate and fails them while down.
+type testPeer struct {
+	*httptest.Server
+	batches chan []dto.ReplicationEvent
+	down    int32
+}
+
+func newTestPeer(t *testing.T, secure bool) *testPeer {
+	t.Helper()
+	peer := &testPeer{batches: make(chan []dto.ReplicationEvent, 100)}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&peer.down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []dto.ReplicationEvent
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		peer.batches <- batch
+	})
+	if secure {
+		peer.Server = httptest.NewTLSServer(handler)
+	} else {
+		peer.Server = httptest.NewServer(handler)
+	}
+	t.Cleanup(peer.Close)
+	return peer
+}
+
+func (p *testPeer) next(t *testing.T) []dto.ReplicationEvent {
+	t.Helper()
+	select {
+	case batch := <-p.batches:
+		return batch
+	case <-time.After(5 * REPLICATION_INTERVAL):
+		t.Fatal("peer didnt receive any batch")
+		return nil
+	}
+}
+
+func actions(batch []dto.ReplicationEvent) (result []string) {
+	for _, event := range batch {
+		result = append(result, event.Action+" "+event.Url)
+	}
+	return result
+}
+
+func TestPeerReplicationBatches(t *testing.T) {
+	peer := newTestPeer(t, false)
+	r := newPeerReplicator([]string{peer.URL + "/"}, "", nil)
+	defer r.stop()
+
+	// the first batch reconciles the peer, so the registry is sent before it
+	if len(peer.next(t)) != 0 {
+		t.Fatal("snapshot of an empty registry isnt empty")
+	}
+	services := make([]discover.Service, REPLICATION_BATCH_SIZE)
+	for i := range services {
+		services[i] = discover.NewService("orders", fmt.Sprintf("localhost:%d", 8080+i), false)
+		r.replicate(dto.REPLICATE_REGISTER, services[i])
+	}
+	// a full batch is sent without waiting for the interval
+	start := time.Now()
+	batch := peer.next(t)
+	if elapsed := time.Since(start); len(batch) != REPLICATION_BATCH_SIZE || elapsed >= REPLICATION_INTERVAL {
+		t.Fatalf("batch of %d events sent after %v, want %d at once", len(batch), elapsed, REPLICATION_BATCH_SIZE)
+	}
+	for i, event := range batch {
+		if event.Action != dto.REPLICATE_REGISTER || event.Url != services[i].Url {
+			t.Fatalf("event %d is %s of %s, want register of %s", i, event.Action, event.Url, services[i].Url)
+		}
+	}
+
+	r.replicate(dto.REPLICATE_HEARTBEAT, services[0])
+	r.replicate(dto.REPLICATE_CANCEL, services[1])
+	got := actions(peer.next(t))
+	want := []string{"heartbeat " + services[0].Url, "cancel " + services[1].Url}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("partial batch is %v, want %v", got, want)
+	}
+}
+
+func TestPeerReplicationReconcilesOnReconnect(t *testing.T) {
+	peer := newTestPeer(t, false)
+	atomic.StoreInt32(&peer.down, 1)
+	r := newPeerReplicator([]string{peer.URL}, "", nil)
+	defer r.stop()
+
+	kept := discover.NewService("orders", "localhost:8080", false)
+	cancelled := discover.NewService("orders", "localhost:8081", false)
+	r.replicate(dto.REPLICATE_REGISTER, kept)
+	r.replicate(dto.REPLICATE_REGISTER, cancelled)
+	r.replicate(dto.REPLICATE_HEARTBEAT, kept)
+	r.replicate(dto.REPLICATE_CANCEL, cancelled)
+	time.Sleep(2 * REPLICATION_INTERVAL)
+	atomic.StoreInt32(&peer.down, 0)
+
+	// the snapshot makes up for everything except the cancellation
+	snapshot := actions(peer.next(t))
+	if want := []string{"register " + kept.Url}; fmt.Sprint(snapshot) != fmt.Sprint(want) {
+		t.Errorf("snapshot is %v, want %v", snapshot, want)
+	}
+	pending := actions(peer.next(t))
+	if want := []string{"cancel " + cancelled.Url}; fmt.Sprint(pending) != fmt.Sprint(want) {
+		t.Errorf("batch after the snapshot is %v, want %v", pending, want)
+	}
+}
+
+func TestPeerReplicationUsesTlsConfig(t *testing.T) {
+	peer := newTestPeer(t, true)
+	roots := x509.NewCertPool()
+	roots.AddCert(peer.Certificate())
+	r := newPeerReplicator([]string{peer.URL}, "", &tls.Config{RootCAs: roots})
+	defer r.stop()
+
+	service := discover.NewService("orders", "localhost:8080", false)
+	r.replicate(dto.REPLICATE_REGISTER, service)
+	peer.next(t)
+	if got := actions(peer.next(t)); len(got) != 1 || got[0] != "register "+service.Url {
+		t.Errorf("peer over tls received %v, want register of %s", got, service.Url)
+	}
+}
+
+func TestReplicateEvents(t *testing.T) {
+	storage := discover.NewMultiMapStorage()
+	dservice := NewDiscoveryService(storage)
+	now := time.Now().Round(0)
+	url := "http://localhost:8080"
+	event := func(action string, status string, lastHeartBeat time.Time) dto.ReplicationEvent {
+		return dto.ReplicationEvent{Action: action, Name: "orders", Url: url, Status: status, LastHeartBeat: lastHeartBeat}
+	}
+	tests := []struct {
+		name          string
+		event         dto.ReplicationEvent
+		registered    bool
+		status        discover.Status
+		lastHeartBeat time.Time
+	}{
+		{"expired registration", event(dto.REPLICATE_REGISTER, "UP", now.Add(-time.Hour)), false, "", time.Time{}},
+		{"registration with unknown status", event(dto.REPLICATE_REGISTER, "SLEEPING", now), false, "", time.Time{}},
+		{"registration", event(dto.REPLICATE_REGISTER, "", now), true, discover.UP, now},
+		{"newer heartbeat", event(dto.REPLICATE_HEARTBEAT, "UP", now.Add(time.Second)), true, discover.UP, now.Add(time.Second)},
+		{"older heartbeat", event(dto.REPLICATE_HEARTBEAT, "UP", now), true, discover.UP, now.Add(time.Second)},
+		{"status", event(dto.REPLICATE_STATUS, "DOWN", now), true, discover.DOWN, now.Add(time.Second)},
+		{"unknown status", event(dto.REPLICATE_STATUS, "SLEEPING", now.Add(2*time.Second)), true, discover.DOWN, now.Add(time.Second)},
+		{"heartbeat keeps status", event(dto.REPLICATE_HEARTBEAT, "UP", now.Add(2*time.Second)), true, discover.DOWN, now.Add(2 * time.Second)},
+		{"cancellation", event(dto.REPLICATE_CANCEL, "", now), false, "", time.Time{}},
+		{"cancellation of unknown instance", event(dto.REPLICATE_CANCEL, "", now), false, "", time.Time{}},
+	}
+	for _, test := range tests {
+		dservice.Replicate([]dto.ReplicationEvent{test.event})
+		saved, err := storage.GetByUrl(url)
+		if registered := err == nil; registered != test.registered {
+			t.Errorf("%s: registered = %v, want %v", test.name, registered, test.registered)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if saved.Status != test.status || !saved.LastHeartBeatCheck.Equal(test.lastHeartBeat) {
+			t.Errorf("%s: instance is %s with heartbeat %v, want %s with %v",
+				test.name, saved.Status, saved.LastHeartBeatCheck, test.status, test.lastHeartBeat)
+		}
+	}
+}
@@ -1,47 +1,136 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/ygaros/discovery-server/discover"
 	"github.com/ygaros/discovery-server/dto"
 )
 
 const DEFAULT_PORT = 7654
 const DEFAULT_PORT_FOR_UI = 7655
-const TIME_FORMAT = "2006-01-02 15:04:05.999999999 -0700 MST"
+const TIME_FORMAT = dto.TIME_FORMAT
+
+var defaultBalancer = discover.NewRandomBalancer()
+
+// errInvalidArgument marks requests which cant succeed as they are.
+var errInvalidArgument = errors.New("[err] invalid argument")
 
 type DiscoveryService interface {
 	AddService(service dto.Service) error
+	// Ttl is how long service expires after without heartbeat.
+	Ttl(service dto.Service) time.Duration
+	Deregister(service dto.Deregistration) error
+	Lookup(id string, url string, secure bool) (dto.ServiceHeartBeat, error)
 	ListServices() ([]dto.ServiceHeartBeat, error)
 	HeartBeat(service dto.Service) error
-	GetService(serviceName string) (dto.ServiceHeartBeat, error)
+	SetStatus(service dto.ServiceStatus) error
+	GetService(serviceName string, key string) (dto.ServiceHeartBeat, error)
+	ListInstances(serviceName string) ([]dto.ServiceHeartBeat, error)
+	FindInstances(selector string) ([]dto.ServiceHeartBeat, error)
+	Replicate(events []dto.ReplicationEvent)
+	Watch(ctx context.Context, serviceName string, revision uint64, send func(dto.ServiceEvent) error) error
+	GetDelta(revision uint64) (dto.RegistryDelta, error)
+	Revision() uint64
+	ServiceRevision(serviceName string) uint64
+	WaitIndex(ctx context.Context, serviceName string, index uint64) uint64
+	UseBalancer(balancer discover.Balancer)
+	UseServiceBalancer(serviceName string, balancer discover.Balancer)
+	EnableSelfPreservation(config discover.SelfPreservationConfig)
+	SelfPreservation() dto.SelfPreservation
+	Close() error
 }
 type discoveryService struct {
-	storage discover.Storage
+	storage          discover.Storage
+	peers            *peerReplicator
+	balancer         discover.Balancer
+	serviceBalancers map[string]discover.Balancer
+	lock             sync.RWMutex
 }
 
 func (s *discoveryService) AddService(service dto.Service) error {
+	status, err := discover.ParseStatus(service.Status)
+	if err != nil {
+		return err
+	}
 	newService := discover.NewService(
 		service.Name,
 		service.Url,
 		service.Secure,
 	)
-	err := s.storage.Add(newService)
+	newService.Status = status
+	newService.Metadata = service.Metadata
+	newService.Tags = service.Tags
+	newService.Ttl = time.Duration(service.Ttl) * time.Second
+	err = s.storage.Add(newService)
+	if err == nil {
+		s.peers.replicate(dto.REPLICATE_REGISTER, newService)
+	}
 	return err
 }
 
+// Instances registered without ttl get the lease default one.
+func (s *discoveryService) Ttl(service dto.Service) time.Duration {
+	if service.Ttl > 0 {
+		return time.Duration(service.Ttl) * time.Second
+	}
+	return s.storage.Leases().DefaultTtl()
+}
+
+// Removes instance right away instead of waiting for it to expire,
+// watchers get the same removal event.
+func (s *discoveryService) Deregister(service dto.Deregistration) error {
+	savedService, err := s.lookup(service.Id, service.Url, service.Secure)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	err = s.storage.Remove(savedService.Name, savedService.Id())
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	s.peers.replicate(dto.REPLICATE_CANCEL, *savedService)
+	return nil
+}
+
+// Returns instance registered with id, or on url when id is empty.
+func (s *discoveryService) Lookup(id string, url string, secure bool) (dto.ServiceHeartBeat, error) {
+	savedService, err := s.lookup(id, url, secure)
+	if err != nil {
+		return dto.ServiceHeartBeat{}, err
+	}
+	return toServiceHeartBeat(*savedService), nil
+}
+
+func (s *discoveryService) lookup(id string, url string, secure bool) (*discover.Service, error) {
+	if len(id) > 0 {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return nil, fmt.Errorf("%w, id %s: %v", errInvalidArgument, id, err)
+		}
+		return s.storage.GetById(parsed)
+	}
+	if len(url) > 0 {
+		return s.storage.GetByUrl(discover.PrepareUrl(url, secure))
+	}
+	return nil, fmt.Errorf("%w, id or url is mandatory", errInvalidArgument)
+}
+
 func (s *discoveryService) ListServices() ([]dto.ServiceHeartBeat, error) {
 	var parsedService []dto.ServiceHeartBeat
 	var err error
 	if services, err := s.storage.GetAllServices(); err == nil {
 		for _, service := range services {
-			parsedService = append(parsedService, dto.ServiceHeartBeat{
-				Name:          service.Name,
-				Url:           service.Url,
-				LastHeartBeat: service.LastHeartBeatCheck,
-			})
+			parsedService = append(parsedService, toServiceHeartBeat(service))
 		}
 	}
 
@@ -54,26 +143,300 @@ func (s *discoveryService) HeartBeat(service dto.Service) error {
 		log.Println(err)
 		return err
 	}
-	err = s.storage.UpdateLastHeartBeat(*savedService, time.Now())
+	now := time.Now()
+	err = s.storage.UpdateLastHeartBeat(*savedService, now)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	savedService.LastHeartBeatCheck = now
+	s.peers.replicate(dto.REPLICATE_HEARTBEAT, *savedService)
+	return nil
+}
+
+// Changes status of the instance registered on url,
+// only UP instances are returned from GetService.
+func (s *discoveryService) SetStatus(service dto.ServiceStatus) error {
+	status, err := discover.ParseStatus(service.Status)
+	if err != nil {
+		return err
+	}
+	savedService, err := s.storage.GetByUrl(discover.PrepareUrl(service.Url, service.Secure))
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	err = s.storage.UpdateStatus(savedService.Id(), status)
 	if err != nil {
 		log.Println(err)
 		return err
 	}
+	savedService.Status = status
+	s.peers.replicate(dto.REPLICATE_STATUS, *savedService)
 	return nil
 }
 
-func (s *discoveryService) GetService(serviceName string) (dto.ServiceHeartBeat, error) {
-	if service, err := s.storage.Get(serviceName); err == nil {
-		return dto.ServiceHeartBeat{
-			Name:          service.Name,
-			Url:           service.Url,
-			LastHeartBeat: service.LastHeartBeatCheck,
-		}, err
+// Picks one of the serviceName instances which are UP with balancer
+// configured for it, key is used by key aware balancers e.g. consistent hash.
+func (s *discoveryService) GetService(serviceName string, key string) (dto.ServiceHeartBeat, error) {
+	instances, err := s.storage.ListInstances(serviceName)
+	if err != nil {
+		return dto.ServiceHeartBeat{}, err
+	}
+	up := instances[:0]
+	for _, instance := range instances {
+		if instance.Status == discover.UP {
+			up = append(up, instance)
+		}
+	}
+	if len(up) == 0 {
+		return dto.ServiceHeartBeat{}, fmt.Errorf("%w named %s which is UP", discover.ErrNotFound, serviceName)
+	}
+	if service, err := s.balancerFor(serviceName).Pick(serviceName, up, key); err == nil {
+		return toServiceHeartBeat(*service), err
 	} else {
 		return dto.ServiceHeartBeat{}, err
 	}
 }
 
+// Returns every instance of serviceName whatever its status is,
+// so clients can do their own balancing. Unknown service is listed
+// empty, it can be watched until its instances register.
+func (s *discoveryService) ListInstances(serviceName string) ([]dto.ServiceHeartBeat, error) {
+	instances, err := s.storage.ListInstances(serviceName)
+	if errors.Is(err, discover.ErrNotFound) {
+		return []dto.ServiceHeartBeat{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	result := make([]dto.ServiceHeartBeat, 0, len(instances))
+	for _, instance := range instances {
+		result = append(result, toServiceHeartBeat(instance))
+	}
+	return result, nil
+}
+
+// Returns every instance matching selector, see discover.Selector for the syntax.
+func (s *discoveryService) FindInstances(selector string) ([]dto.ServiceHeartBeat, error) {
+	parsed, err := discover.ParseSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %v", errInvalidArgument, err)
+	}
+	instances, err := s.storage.FindInstances(parsed)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]dto.ServiceHeartBeat, 0, len(instances))
+	for _, instance := range instances {
+		result = append(result, toServiceHeartBeat(instance))
+	}
+	return result, nil
+}
+
+// Sets balancer used for services without their own one.
+func (s *discoveryService) UseBalancer(balancer discover.Balancer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.balancer = balancer
+}
+
+// Sets balancer used for serviceName, nil restores the global one.
+func (s *discoveryService) UseServiceBalancer(serviceName string, balancer discover.Balancer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if balancer == nil {
+		delete(s.serviceBalancers, serviceName)
+		return
+	}
+	if s.serviceBalancers == nil {
+		s.serviceBalancers = make(map[string]discover.Balancer)
+	}
+	s.serviceBalancers[serviceName] = balancer
+}
+
+// Stops evicting expired instances while fewer heartbeats than expected
+// arrive, e.g. when this node is partitioned from its clients.
+func (s *discoveryService) EnableSelfPreservation(config discover.SelfPreservationConfig) {
+	s.storage.Leases().EnableSelfPreservation(config)
+}
+
+func (s *discoveryService) SelfPreservation() dto.SelfPreservation {
+	status := s.storage.Leases().SelfPreservation()
+	return dto.SelfPreservation{
+		Enabled:                   status.Enabled,
+		Active:                    status.Active,
+		ExpectedRenewalsPerMinute: status.ExpectedRenewalsPerMinute,
+		RenewalsLastMinute:        status.RenewalsLastMinute,
+	}
+}
+
+func (s *discoveryService) balancerFor(serviceName string) discover.Balancer {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if balancer, ok := s.serviceBalancers[serviceName]; ok {
+		return balancer
+	}
+	if s.balancer != nil {
+		return s.balancer
+	}
+	return defaultBalancer
+}
+
+// Streams registry changes of serviceName (all services when empty) to send
+// until ctx is done. Changes after revision are replayed first.
+func (s *discoveryService) Watch(
+	ctx context.Context,
+	serviceName string,
+	revision uint64,
+	send func(dto.ServiceEvent) error) error {
+	watcher, err := s.storage.Watch(serviceName, revision)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events():
+			if !ok {
+				return watcher.Err()
+			}
+			if err := send(toServiceEvent(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Returns changes after revision so polling clients dont fetch the whole
+// registry every time, it fails when revision is too old to be served.
+func (s *discoveryService) GetDelta(revision uint64) (dto.RegistryDelta, error) {
+	delta, err := s.storage.Delta(revision)
+	if err != nil {
+		return dto.RegistryDelta{}, err
+	}
+	result := dto.RegistryDelta{
+		Revision: delta.Revision,
+		Hash:     delta.Hash,
+		Events:   make([]dto.ServiceEvent, 0, len(delta.Events)),
+	}
+	for _, event := range delta.Events {
+		result.Events = append(result.Events, toServiceEvent(event))
+	}
+	return result, nil
+}
+
+func (s *discoveryService) Revision() uint64 {
+	return s.storage.Revision()
+}
+
+// Revision serviceName last changed at, the registry one when it's empty.
+func (s *discoveryService) ServiceRevision(serviceName string) uint64 {
+	return s.storage.ServiceRevision(serviceName)
+}
+
+// Blocks until serviceName (any service when empty) changes after index
+// or ctx is done and returns its revision.
+func (s *discoveryService) WaitIndex(ctx context.Context, serviceName string, index uint64) uint64 {
+	// index may be older than the kept history for services which
+	// didnt change for long, so only new events are watched
+	watcher, err := s.storage.Watch(serviceName, 0)
+	if err == nil {
+		defer watcher.Close()
+		if s.storage.ServiceRevision(serviceName) <= index {
+			select {
+			case <-ctx.Done():
+			case <-watcher.Events():
+			}
+		}
+	}
+	return s.storage.ServiceRevision(serviceName)
+}
+
+// Applies events replicated by peer nodes, they arent replicated any further.
+func (s *discoveryService) Replicate(events []dto.ReplicationEvent) {
+	for _, event := range events {
+		saved, err := s.storage.GetByUrl(event.Url)
+		switch event.Action {
+		case dto.REPLICATE_REGISTER, dto.REPLICATE_HEARTBEAT, dto.REPLICATE_STATUS:
+			status, parseErr := discover.ParseStatus(event.Status)
+			if parseErr != nil {
+				// the whole event is rejected rather than stored without status
+				err = parseErr
+				break
+			}
+			if err == nil {
+				if event.LastHeartBeat.After(saved.LastHeartBeatCheck) {
+					err = s.storage.UpdateLastHeartBeat(*saved, event.LastHeartBeat)
+				}
+				if err == nil && event.Action != dto.REPLICATE_HEARTBEAT && status != saved.Status {
+					err = s.storage.UpdateStatus(saved.Id(), status)
+				}
+			} else if !expired(event, s.storage.Leases().DefaultTtl()) {
+				restored := discover.RestoreService(event.Name, event.Url, event.LastHeartBeat)
+				restored.Status = status
+				restored.Metadata = event.Metadata
+				restored.Tags = event.Tags
+				restored.Ttl = time.Duration(event.Ttl) * time.Second
+				err = s.storage.Add(restored)
+			} else {
+				err = nil
+			}
+		case dto.REPLICATE_CANCEL:
+			if err == nil {
+				err = s.storage.Remove(saved.Name, saved.Id())
+			} else {
+				err = nil
+			}
+		default:
+			err = fmt.Errorf("[err] unknown replication action %s", event.Action)
+		}
+		if err != nil {
+			log.Printf("Failed to replicate %s of %s: %v\n", event.Action, event.Url, err)
+		}
+	}
+}
+
+// Close flushes replication to peers and closes the storage, which stops
+// expiring instances and persists them when it's durable.
+func (s *discoveryService) Close() error {
+	s.peers.stop()
+	if closer, ok := s.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func toServiceHeartBeat(service discover.Service) dto.ServiceHeartBeat {
+	return dto.ServiceHeartBeat{
+		Id:            service.Id().String(),
+		Name:          service.Name,
+		Url:           service.Url,
+		Status:        string(service.Status),
+		Metadata:      service.Metadata,
+		Tags:          service.Tags,
+		LastHeartBeat: service.LastHeartBeatCheck,
+	}
+}
+
+func toServiceEvent(event discover.Event) dto.ServiceEvent {
+	return dto.ServiceEvent{
+		Type:     string(event.Type),
+		Revision: event.Revision,
+		Service:  toServiceHeartBeat(event.Service),
+	}
+}
+
+// Creates discovery service on top of any storage e.g. one wrapped
+// with discover.NewHealthCheckedStorage.
+func NewDiscoveryService(storage discover.Storage) DiscoveryService {
+	return &discoveryService{
+		storage: storage,
+	}
+}
+
 //MultiMap implementation that allow multiple instances of the same service
 func NewDiscoveryServiceWithInMemoryStorage() DiscoveryService {
 	return &discoveryService{
@@ -81,9 +444,129 @@ func NewDiscoveryServiceWithInMemoryStorage() DiscoveryService {
 	}
 }
 
+//MultiMap implementation persisted to a write-ahead log and snapshots in dir
+func NewDiscoveryServiceWithFileStorage(dir string) (DiscoveryService, error) {
+	storage, err := discover.NewFileStorage(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &discoveryService{
+		storage: storage,
+	}, nil
+}
+
+//MultiMap implementation replicated between cluster nodes with raft
+func NewDiscoveryServiceWithRaftStorage(config discover.RaftConfig) (DiscoveryService, error) {
+	storage, err := discover.NewRaftStorage(config)
+	if err != nil {
+		return nil, err
+	}
+	return &discoveryService{
+		storage: storage,
+	}, nil
+}
+
+//MultiMap implementation replicating registrations to peer nodes asynchronously,
+//peers are base urls of their http servers e.g. http://10.0.0.2:7655
+func NewDiscoveryServiceWithPeerReplication(peers []string) DiscoveryService {
+	return &discoveryService{
+		storage: discover.NewMultiMapStorage(),
+		peers:   newPeerReplicator(peers, "", nil),
+	}
+}
+
 //Slice implementation that doesn't allow multiple instances of the same service
 func NewDiscoveryServiceWithSliceStorage() DiscoveryService {
 	return &discoveryService{
 		storage: discover.NewInMemoryStorage(),
 	}
 }
+
+// Creates discovery service with storage, lease, health check and balancer
+// settings of config, listener settings are ignored.
+func NewDiscoveryServiceWithConfig(config Config) (DiscoveryService, error) {
+	var certs *certReloader
+	if config.Storage.Type == STORAGE_RAFT || len(config.Peers) > 0 {
+		// peers are verified with certificates loaded once
+		var err error
+		if certs, err = loadCerts(config); err != nil {
+			return nil, err
+		}
+	}
+	return newDiscoveryServiceWithConfig(config, certs)
+}
+
+// newDiscoveryServiceWithConfig secures raft forwarding and peer replication
+// with certs when they are set.
+func newDiscoveryServiceWithConfig(config Config, certs *certReloader) (DiscoveryService, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	var storage discover.Storage
+	var err error
+	switch config.Storage.Type {
+	case STORAGE_MEMORY:
+		storage = discover.NewMultiMapStorage()
+	case STORAGE_SLICE:
+		storage = discover.NewInMemoryStorage()
+	case STORAGE_FILE:
+		storage, err = discover.NewFileStorage(config.Storage.Dir)
+	case STORAGE_RAFT:
+		raftConfig := discover.RaftConfig{
+			RaftPeer: discover.RaftPeer{
+				NodeId:   config.Storage.Raft.NodeId,
+				RaftAddr: config.Storage.Raft.RaftAddress,
+				RpcAddr:  config.Storage.Raft.RpcAddress,
+			},
+			Dir:       config.Storage.Dir,
+			Bootstrap: config.Storage.Raft.Bootstrap,
+		}
+		if certs != nil {
+			raftConfig.ServerTls = certs.tlsConfig()
+			raftConfig.ClientTls = certs.clientTlsConfig()
+		}
+		for _, peer := range config.Storage.Raft.Peers {
+			parsed, _ := parseRaftPeer(peer)
+			raftConfig.Peers = append(raftConfig.Peers, parsed)
+		}
+		storage, err = discover.NewRaftStorage(raftConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(config.HealthCheck.Type) > 0 {
+		storage, err = discover.NewHealthCheckedStorage(storage, discover.HealthCheckConfig{
+			Type:      config.HealthCheck.Type,
+			Path:      config.HealthCheck.Path,
+			Interval:  config.HealthCheck.Interval,
+			Timeout:   config.HealthCheck.Timeout,
+			Threshold: config.HealthCheck.Threshold,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	service := &discoveryService{
+		storage:  storage,
+		balancer: discover.NewBalancer(config.Balancer.Default),
+	}
+	if len(config.Peers) > 0 {
+		var tlsConfig *tls.Config
+		if certs != nil {
+			tlsConfig = certs.clientTlsConfig()
+		}
+		service.peers = newPeerReplicator(config.Peers, config.Auth.PeerToken, tlsConfig)
+	}
+	storage.Leases().SetDefaultTtl(config.Lease.DefaultTtl)
+	service.peers.setDefaultTtl(storage.Leases().DefaultTtl())
+	for serviceName, name := range config.Balancer.Services {
+		service.UseServiceBalancer(serviceName, discover.NewBalancer(name))
+	}
+	if config.Lease.SelfPreservation {
+		service.EnableSelfPreservation(discover.SelfPreservationConfig{
+			Threshold:       config.Lease.RenewalThreshold,
+			RenewalInterval: config.Lease.RenewalInterval,
+		})
+	}
+	return service, nil
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// How often certificate files are checked for changes by default.
+const TLS_RELOAD_INTERVAL = time.Minute
+
+var errServiceNameNotAllowed = errors.New("[err] client certificate doesnt allow the service name")
+
+// certReloader serves the certificate and client CA bundle from disk
+// and picks up their changes, e.g. renewals, without restarting.
+type certReloader struct {
+	certFile          string
+	keyFile           string
+	caFile            string
+	requireClientCert bool
+
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modified    map[string]time.Time
+	lock        sync.RWMutex
+	quit        chan struct{}
+	once        sync.Once
+}
+
+// tlsConfig is shared by grpc and http, every handshake gets
+// the certificate and CA bundle loaded last.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return r.certificate, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if r.clientCAs != nil {
+				config.ClientCAs = r.clientCAs
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				if r.requireClientCert {
+					config.ClientAuth = tls.RequireAndVerifyClientCert
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// clientTlsConfig is used towards peers of the cluster, it presents the
+// certificate loaded last and verifies peers against the client CA bundle.
+func (r *certReloader) clientTlsConfig() *tls.Config {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    r.clientCAs,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			r.lock.RLock()
+			defer r.lock.RUnlock()
+			return r.certificate, nil
+		},
+	}
+}
+
+// load reads the files when any of them changed since the last load.
+func (r *certReloader) load() (bool, error) {
+	modified := make(map[string]time.Time)
+	changed := false
+	for _, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if len(file) == 0 {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modified[file] = info.ModTime()
+		changed = changed || !info.ModTime().Equal(r.modified[file])
+	}
+	if !changed {
+		return false, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+	var clientCAs *x509.CertPool
+	if len(r.caFile) > 0 {
+		if clientCAs, err = loadCertPool(r.caFile); err != nil {
+			return false, err
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.modified = modified
+	return true, nil
+}
+
+// watch reloads the files every interval until stop, a broken
+// file is logged and the previous certificate is kept.
+func (r *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+			reloaded, err := r.load()
+			if err != nil {
+				log.Println("Failed to reload tls certificate, keeping the previous one:", err)
+			} else if reloaded {
+				log.Printf("Reloaded tls certificate %s\n", r.certFile)
+			}
+		}
+	}
+}
+
+func (r *certReloader) stop() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() { close(r.quit) })
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("[err] there arent any certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// Loads certificates of config and reloads them every interval,
+// nil when tls isnt configured.
+func newCertReloader(config Config) (*certReloader, error) {
+	r, err := loadCerts(config)
+	if r == nil || err != nil {
+		return nil, err
+	}
+	interval := config.Tls.ReloadInterval
+	if interval <= 0 {
+		interval = TLS_RELOAD_INTERVAL
+	}
+	go r.watch(interval)
+	return r, nil
+}
+
+// loadCerts loads certificates of config once, nil when tls isnt configured.
+func loadCerts(config Config) (*certReloader, error) {
+	if len(config.Tls.CertFile) == 0 {
+		return nil, nil
+	}
+	r := &certReloader{
+		certFile:          config.Tls.CertFile,
+		keyFile:           config.Tls.KeyFile,
+		caFile:            config.Tls.ClientCaFile,
+		requireClientCert: config.Tls.RequireClientCert,
+		quit:              make(chan struct{}),
+	}
+	if _, err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// allowsServiceName checks serviceName against SANs of the verified client
+// certificate. DNS SANs allow their own name and their first label,
+// orders.prod.example.com allows orders, URI SANs allow the last path
+// segment, spiffe://example.com/ns/prod/sa/orders allows orders.
+func allowsServiceName(certificates []*x509.Certificate, serviceName string) error {
+	if len(certificates) == 0 {
+		return fmt.Errorf("%w %s: there isnt any", errServiceNameNotAllowed, serviceName)
+	}
+	certificate := certificates[0]
+	for _, name := range certificate.DNSNames {
+		label, _, _ := strings.Cut(name, ".")
+		if strings.EqualFold(name, serviceName) || strings.EqualFold(label, serviceName) {
+			return nil
+		}
+	}
+	for _, uri := range certificate.URIs {
+		if strings.EqualFold(lastSegment(uri), serviceName) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w %s", errServiceNameNotAllowed, serviceName)
+}
+
+func lastSegment(uri *url.URL) string {
+	if len(uri.Path) == 0 {
+		return uri.Opaque
+	}
+	return path.Base(uri.Path)
+}
+
+// peerCertificates returns the verified client chain of the grpc call.
+func peerCertificates(ctx context.Context) []*x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return nil
+	}
+	return info.State.PeerCertificates
+}
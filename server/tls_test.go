@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCa issues certificates signed by a generated CA.
+type testCa struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	serial      int64
+}
+
+func newTestCa(t *testing.T) *testCa {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "discovery test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCa{certificate: certificate, key: key, serial: 1}
+}
+
+// issue returns pem encoded certificate and key with the SANs, server
+// certificates are issued for 127.0.0.1.
+func (ca *testCa) issue(t *testing.T, dnsNames []string, uris []string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: "discovery test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template.URIs = append(template.URIs, parsed)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
+
+func (ca *testCa) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+	return pool
+}
+
+func (ca *testCa) pem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.certificate.Raw})
+}
+
+// writeCerts writes certificate, key and CA bundle into dir, their
+// modification time is moved forward so a reload sees them as changed.
+func writeCerts(t *testing.T, dir string, certificate []byte, key []byte, ca []byte, modified time.Time) Config {
+	t.Helper()
+	config := DefaultConfig()
+	config.Tls.CertFile = filepath.Join(dir, "cert.pem")
+	config.Tls.KeyFile = filepath.Join(dir, "key.pem")
+	config.Tls.ClientCaFile = filepath.Join(dir, "ca.pem")
+	files := map[string][]byte{config.Tls.CertFile: certificate, config.Tls.KeyFile: key, config.Tls.ClientCaFile: ca}
+	for file, content := range files {
+		if err := os.WriteFile(file, content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return config
+}
+
+func TestBindServiceNameToClientCertificate(t *testing.T) {
+	ca := newTestCa(t)
+	certificate, key := ca.issue(t, nil, nil)
+	config := writeCerts(t, t.TempDir(), certificate, key, ca.pem(), time.Now())
+	certs, err := loadCerts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := newHttpServer(NewDiscoveryServiceWithInMemoryStorage(), certs.tlsConfig())
+	httpServer.bindServiceName = true
+	server := httptest.NewUnstartedServer(httpServer.router())
+	server.TLS = certs.tlsConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		dnsNames []string
+		uris     []string
+		want     int
+	}{
+		{"DNS SAN first label", []string{"orders.prod.example.com"}, nil, http.StatusCreated},
+		{"DNS SAN", []string{"ORDERS"}, nil, http.StatusCreated},
+		{"URI SAN last segment", nil, []string{"spiffe://example.com/ns/prod/sa/orders"}, http.StatusCreated},
+		{"other DNS SAN", []string{"payments.prod.example.com", "prod.orders.example.com"}, nil, http.StatusForbidden},
+		{"other URI SAN", nil, []string{"spiffe://example.com/orders/sa/payments"}, http.StatusForbidden},
+		{"without SANs", nil, nil, http.StatusForbidden},
+	}
+	for i, test := range tests {
+		certificate, key := ca.issue(t, test.dnsNames, test.uris)
+		clientCertificate, err := tls.X509KeyPair(certificate, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      ca.pool(),
+			Certificates: []tls.Certificate{clientCertificate},
+		}}}
+		body := fmt.Sprintf(`{"name":"orders","url":"10.0.0.%d:8080"}`, i+1)
+		response, err := client.Post(server.URL+"/register", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		response.Body.Close()
+		if response.StatusCode != test.want {
+			t.Errorf("%s: registering orders returned %d, want %d", test.name, response.StatusCode, test.want)
+		}
+	}
+
+	// certificates which arent verified allow nothing
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool()}}}
+	response, err := client.Post(server.URL+"/register", "application/json", strings.NewReader(`{"name":"orders","url":"10.0.0.9:8080"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("registering without client certificate returned %d, want %d", response.StatusCode, http.StatusForbidden)
+	}
+}
+
+// servedSerial returns serial number of the certificate served on address.
+func servedSerial(t *testing.T, address string, roots *x509.CertPool) int64 {
+	t.Helper()
+	conn, err := tls.Dial("tcp", address, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertReloaderPicksUpRotatedCertificate(t *testing.T) {
+	ca := newTestCa(t)
+	dir := t.TempDir()
+	certificate, key := ca.issue(t, nil, nil)
+	config := writeCerts(t, dir, certificate, key, ca.pem(), time.Now().Add(-time.Minute))
+	config.Tls.ReloadInterval = 10 * time.Millisecond
+	certs, err := newCertReloader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer certs.stop()
+	listen, err := tls.Listen("tcp", "127.0.0.1:0", certs.tlsConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	address := listen.Addr().String()
+	if serial := servedSerial(t, address, ca.pool()); serial != ca.serial {
+		t.Fatalf("served certificate %d, want %d", serial, ca.serial)
+	}
+
+	certificate, key = ca.issue(t, nil, nil)
+	writeCerts(t, dir, certificate, key, ca.pem(), time.Now())
+	deadline := time.Now().Add(5 * time.Second)
+	for servedSerial(t, address, ca.pool()) != ca.serial {
+		if time.Now().After(deadline) {
+			t.Fatalf("rotated certificate %d wasnt served", ca.serial)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a broken file keeps the previous certificate
+	rotated := ca.serial
+	writeCerts(t, dir, []byte("broken"), key, ca.pem(), time.Now().Add(time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	if serial := servedSerial(t, address, ca.pool()); serial != rotated {
+		t.Errorf("served certificate %d after a broken rotation, want %d", serial, rotated)
+	}
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	clusterservice "github.com/envoyproxy/go-control-plane/envoy/service/cluster/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	endpointservice "github.com/envoyproxy/go-control-plane/envoy/service/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	xds "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"github.com/ygaros/discovery-server/discover"
+	"github.com/ygaros/discovery-server/dto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	protobuf "google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const DEFAULT_XDS_PORT = 18000
+
+const (
+	// Instance metadata keys translated to envoy localities.
+	REGION_METADATA  = "region"
+	ZONE_METADATA    = "zone"
+	SUBZONE_METADATA = "subzone"
+
+	XDS_CONNECT_TIMEOUT = 5 * time.Second
+	// Registry changes within the window are pushed together.
+	XDS_PUSH_DELAY = 100 * time.Millisecond
+	// Every envoy node gets the same snapshot.
+	xdsNode = "discovery"
+)
+
+type XdsServer interface {
+	Serve(port int) error
+	ServeAddress(address string) error
+	ServeDefaultPort() error
+	Shutdown() error
+}
+
+// xdsServer is an envoy control plane, every registered service is
+// an EDS cluster of the same name with its instances as endpoints.
+// Snapshots are versioned by registry revision and pushed over ADS
+// (or standalone CDS/EDS) whenever the translated resources change.
+type xdsServer struct {
+	dservice DiscoveryService
+	cache    cache.SnapshotCache
+	// served over tls when set, snapshots need read:* when auth is set
+	tlsConfig *tls.Config
+	auth      *authenticator
+	// serialized resources of the current snapshot
+	current []byte
+	lock    sync.Mutex
+	// grpc servers and their watch cancellations, for Shutdown
+	servers []*grpc.Server
+	cancels []context.CancelFunc
+	stopped bool
+}
+
+type singleNodeHash struct{}
+
+func (singleNodeHash) ID(*core.Node) string {
+	return xdsNode
+}
+
+// update translates the registry into a new snapshot if it's any different.
+func (s *xdsServer) update() error {
+	delta, err := s.dservice.GetDelta(0)
+	if err != nil {
+		return err
+	}
+	instances := make(map[string][]dto.ServiceHeartBeat)
+	for _, event := range delta.Events {
+		instances[event.Service.Name] = append(instances[event.Service.Name], event.Service)
+	}
+	names := make([]string, 0, len(instances))
+	for name := range instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var clusters, assignments []types.Resource
+	var serialized bytes.Buffer
+	marshal := protobuf.MarshalOptions{Deterministic: true}
+	for _, name := range names {
+		clusterResource := toCluster(name)
+		assignment := toLoadAssignment(name, instances[name])
+		clusters = append(clusters, clusterResource)
+		assignments = append(assignments, assignment)
+		for _, message := range []protobuf.Message{clusterResource, assignment} {
+			marshaled, err := marshal.Marshal(message)
+			if err != nil {
+				return err
+			}
+			serialized.Write(marshaled)
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.current != nil && bytes.Equal(s.current, serialized.Bytes()) {
+		return nil
+	}
+	version := strconv.FormatUint(delta.Revision, 10)
+	snapshot, err := cache.NewSnapshot(version, map[resource.Type][]types.Resource{
+		resource.ClusterType:  clusters,
+		resource.EndpointType: assignments,
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.cache.SetSnapshot(context.Background(), xdsNode, snapshot); err != nil {
+		return err
+	}
+	s.current = serialized.Bytes()
+	log.Printf("Pushed xds snapshot %s with %d clusters\n", version, len(clusters))
+	return nil
+}
+
+// watch updates the snapshot on registry changes until ctx is done.
+func (s *xdsServer) watch(ctx context.Context) {
+	changed := make(chan struct{}, 1)
+	go func() {
+		for {
+			revision := s.dservice.Revision()
+			err := s.dservice.Watch(ctx, "", revision, func(dto.ServiceEvent) error {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+				return nil
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			// lagging watcher is dropped, resubscribing covers missed changes
+			log.Println("Xds registry watch restarted:", err)
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		}
+		// changes arriving meanwhile are pushed with this one
+		delay := time.NewTimer(XDS_PUSH_DELAY)
+		select {
+		case <-ctx.Done():
+			delay.Stop()
+			return
+		case <-delay.C:
+		}
+		if err := s.update(); err != nil {
+			log.Println("Failed to update xds snapshot:", err)
+		}
+	}
+}
+
+func toCluster(serviceName string) *cluster.Cluster {
+	return &cluster.Cluster{
+		Name:                 serviceName,
+		ConnectTimeout:       durationpb.New(XDS_CONNECT_TIMEOUT),
+		ClusterDiscoveryType: &cluster.Cluster_Type{Type: cluster.Cluster_EDS},
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: &core.ConfigSource{
+				ResourceApiVersion:    core.ApiVersion_V3,
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+			},
+		},
+		LbPolicy: cluster.Cluster_ROUND_ROBIN,
+	}
+}
+
+// toLoadAssignment groups instances by locality from their metadata,
+// the weight metadata becomes the endpoint load balancing weight.
+func toLoadAssignment(serviceName string, instances []dto.ServiceHeartBeat) *endpoint.ClusterLoadAssignment {
+	localities := make(map[locality]*endpoint.LocalityLbEndpoints)
+	var order []locality
+	for _, instance := range instances {
+		host, port, err := splitInstanceUrl(instance.Url)
+		if err != nil || net.ParseIP(host) == nil {
+			// eds endpoints have to be ip addresses
+			log.Printf("Skipping %s in xds endpoints: not an ip address\n", instance.Url)
+			continue
+		}
+		key := locality{
+			region:  instance.Metadata[REGION_METADATA],
+			zone:    instance.Metadata[ZONE_METADATA],
+			subZone: instance.Metadata[SUBZONE_METADATA],
+		}
+		group, ok := localities[key]
+		if !ok {
+			group = &endpoint.LocalityLbEndpoints{
+				Locality: &core.Locality{Region: key.region, Zone: key.zone, SubZone: key.subZone},
+			}
+			localities[key] = group
+			order = append(order, key)
+		}
+		group.LbEndpoints = append(group.LbEndpoints, &endpoint.LbEndpoint{
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Address:       host,
+								PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
+							},
+						},
+					},
+				},
+			},
+			HealthStatus:        toHealthStatus(instance.Status),
+			LoadBalancingWeight: wrapperspb.UInt32(uint32(instanceWeight(instance))),
+		})
+	}
+	assignment := &endpoint.ClusterLoadAssignment{ClusterName: serviceName}
+	sort.Slice(order, func(i, j int) bool {
+		return order[i].String() < order[j].String()
+	})
+	for _, key := range order {
+		group := localities[key]
+		sort.Slice(group.LbEndpoints, func(i, j int) bool {
+			return endpointAddress(group.LbEndpoints[i]) < endpointAddress(group.LbEndpoints[j])
+		})
+		var weight uint32
+		for _, lbEndpoint := range group.LbEndpoints {
+			weight += lbEndpoint.LoadBalancingWeight.GetValue()
+		}
+		group.LoadBalancingWeight = wrapperspb.UInt32(weight)
+		assignment.Endpoints = append(assignment.Endpoints, group)
+	}
+	return assignment
+}
+
+type locality struct {
+	region  string
+	zone    string
+	subZone string
+}
+
+func (l locality) String() string {
+	return l.region + "/" + l.zone + "/" + l.subZone
+}
+
+func endpointAddress(lbEndpoint *endpoint.LbEndpoint) string {
+	address := lbEndpoint.GetEndpoint().GetAddress().GetSocketAddress()
+	return fmt.Sprintf("%s:%d", address.GetAddress(), address.GetPortValue())
+}
+
+func instanceWeight(instance dto.ServiceHeartBeat) int {
+	weight := discover.MetadataWeight(discover.Service{Metadata: instance.Metadata})
+	if weight < 1 {
+		// envoy rejects zero weights
+		return 1
+	}
+	return weight
+}
+
+func toHealthStatus(status string) core.HealthStatus {
+	switch discover.Status(status) {
+	case discover.UP:
+		return core.HealthStatus_HEALTHY
+	case discover.OUT_OF_SERVICE:
+		return core.HealthStatus_DRAINING
+	default:
+		return core.HealthStatus_UNHEALTHY
+	}
+}
+
+func (s *xdsServer) Serve(port int) error {
+	return s.ServeAddress(fmt.Sprintf(":%d", port))
+}
+
+func (s *xdsServer) ServeAddress(address string) error {
+	log.Printf("Starting XDS server on %s...\n", address)
+	if err := s.update(); err != nil {
+		return err
+	}
+	listen, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.watch(ctx)
+	server := xds.NewServer(ctx, s.cache, nil)
+	options := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	}
+	if s.tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(s.tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(options...)
+	discoverygrpc.RegisterAggregatedDiscoveryServiceServer(grpcServer, server)
+	clusterservice.RegisterClusterDiscoveryServiceServer(grpcServer, server)
+	endpointservice.RegisterEndpointDiscoveryServiceServer(grpcServer, server)
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		listen.Close()
+		return nil
+	}
+	s.servers = append(s.servers, grpcServer)
+	s.cancels = append(s.cancels, cancel)
+	s.lock.Unlock()
+	err = grpcServer.Serve(listen)
+	if err != nil && err != grpc.ErrServerStopped {
+		return err
+	}
+	return nil
+}
+
+// authenticate lets only callers allowed to read every service
+// fetch snapshots, they hold the whole registry.
+func (s *xdsServer) authenticate(ctx context.Context) (context.Context, error) {
+	ctx, err := authenticateGrpc(s.auth, ctx)
+	if err != nil {
+		return ctx, err
+	}
+	return ctx, authStatus(identityFromContext(ctx).check(PERMISSION_READ, ALL_SERVICES))
+}
+
+func (s *xdsServer) unaryInterceptor(ctx context.Context, request interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, request)
+}
+
+func (s *xdsServer) streamInterceptor(service interface{}, stream grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(service, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// Shutdown ends envoy streams and waits for their handlers to return,
+// envoys reconnect to another control plane and keep the last snapshot
+// meanwhile.
+func (s *xdsServer) Shutdown() error {
+	s.lock.Lock()
+	s.stopped = true
+	cancels, servers := s.cancels, s.servers
+	s.lock.Unlock()
+	// streams return once their context is cancelled
+	for _, cancel := range cancels {
+		cancel()
+	}
+	for _, server := range servers {
+		server.GracefulStop()
+	}
+	return nil
+}
+
+func (s *xdsServer) ServeDefaultPort() error {
+	return s.Serve(DEFAULT_XDS_PORT)
+}
+
+func NewXdsServer(discoveryService *DiscoveryService) XdsServer {
+	return newXdsServer(*discoveryService, nil)
+}
+
+// Serves xDS over tls, plaintext when tlsConfig is nil.
+func NewXdsServerWithTls(discoveryService *DiscoveryService, tlsConfig *tls.Config) XdsServer {
+	return newXdsServer(*discoveryService, tlsConfig)
+}
+
+func newXdsServer(discoveryService DiscoveryService, tlsConfig *tls.Config) *xdsServer {
+	return &xdsServer{
+		dservice:  discoveryService,
+		cache:     cache.NewSnapshotCache(true, singleNodeHash{}, nil),
+		tlsConfig: tlsConfig,
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	discoverygrpc "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	"github.com/ygaros/discovery-server/dto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestXdsServerAuthenticates(t *testing.T) {
+	tokens, err := parseTokens([]byte(`
+tokens:
+  - name: envoy
+    token: envoy-token
+    acl: ["read:*"]
+  - name: orders
+    token: orders-token
+    acl: ["register:orders"]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newXdsServer(NewDiscoveryServiceWithInMemoryStorage(), nil)
+	s.auth = &authenticator{tokens: tokens, anonymous: &identity{name: "anonymous", anonymous: true}}
+	tests := []struct {
+		token string
+		want  codes.Code
+	}{
+		{"", codes.Unauthenticated},
+		{"unknown-token", codes.Unauthenticated},
+		{"orders-token", codes.PermissionDenied},
+		{"envoy-token", codes.OK},
+	}
+	for _, test := range tests {
+		ctx := context.Background()
+		if len(test.token) > 0 {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+test.token))
+		}
+		_, err := s.authenticate(ctx)
+		if code := status.Code(err); code != test.want {
+			t.Errorf("token %q got %s, want %s", test.token, code, test.want)
+		}
+	}
+}
+
+// snapshotContents lists clusters and their endpoints as
+// cluster locality address health, sorted.
+func snapshotContents(t *testing.T, s *xdsServer) (string, []string) {
+	t.Helper()
+	snapshot, err := s.cache.GetSnapshot(xdsNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents []string
+	for name, clusterResource := range snapshot.GetResources(resource.ClusterType) {
+		if clusterResource.(*cluster.Cluster).GetType() != cluster.Cluster_EDS {
+			t.Errorf("cluster %s isnt eds", name)
+		}
+		contents = append(contents, name)
+	}
+	for name, assignment := range snapshot.GetResources(resource.EndpointType) {
+		for _, group := range assignment.(*endpoint.ClusterLoadAssignment).Endpoints {
+			for _, lbEndpoint := range group.LbEndpoints {
+				contents = append(contents, fmt.Sprintf("%s %s/%s %s %s", name,
+					group.Locality.Region, group.Locality.Zone, endpointAddress(lbEndpoint), lbEndpoint.HealthStatus))
+			}
+		}
+	}
+	sort.Strings(contents)
+	return snapshot.GetVersion(resource.ClusterType), contents
+}
+
+func TestXdsSnapshots(t *testing.T) {
+	dservice := NewDiscoveryServiceWithInMemoryStorage()
+	s := newXdsServer(dservice, nil)
+	tests := []struct {
+		name     string
+		change   func() error
+		contents []string
+	}{
+		{"registrations", func() error {
+			for _, service := range []dto.Service{
+				{Name: "orders", Url: "10.0.0.1:8080", Metadata: map[string]string{REGION_METADATA: "eu", ZONE_METADATA: "a"}},
+				{Name: "orders", Url: "10.0.0.2:8080"},
+				{Name: "payments", Url: "10.0.1.1:8080"},
+				{Name: "carts", Url: "carts.internal:8080"},
+			} {
+				if err := dservice.AddService(service); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, []string{
+			"carts",
+			"orders",
+			"orders / 10.0.0.2:8080 HEALTHY",
+			"orders eu/a 10.0.0.1:8080 HEALTHY",
+			"payments",
+			"payments / 10.0.1.1:8080 HEALTHY",
+		}},
+		{"status DOWN", func() error {
+			return dservice.SetStatus(dto.ServiceStatus{Url: "10.0.0.2:8080", Status: "DOWN"})
+		}, []string{
+			"carts",
+			"orders",
+			"orders / 10.0.0.2:8080 UNHEALTHY",
+			"orders eu/a 10.0.0.1:8080 HEALTHY",
+			"payments",
+			"payments / 10.0.1.1:8080 HEALTHY",
+		}},
+		{"status OUT_OF_SERVICE", func() error {
+			return dservice.SetStatus(dto.ServiceStatus{Url: "10.0.0.1:8080", Status: "OUT_OF_SERVICE"})
+		}, []string{
+			"carts",
+			"orders",
+			"orders / 10.0.0.2:8080 UNHEALTHY",
+			"orders eu/a 10.0.0.1:8080 DRAINING",
+			"payments",
+			"payments / 10.0.1.1:8080 HEALTHY",
+		}},
+		{"deregistration", func() error {
+			return dservice.Deregister(dto.Deregistration{Url: "10.0.1.1:8080"})
+		}, []string{
+			"carts",
+			"orders",
+			"orders / 10.0.0.2:8080 UNHEALTHY",
+			"orders eu/a 10.0.0.1:8080 DRAINING",
+		}},
+	}
+	for _, test := range tests {
+		if err := test.change(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.update(); err != nil {
+			t.Fatal(err)
+		}
+		version, contents := snapshotContents(t, s)
+		if version != strconv.FormatUint(dservice.Revision(), 10) {
+			t.Errorf("%s: snapshot version %s, want revision %d", test.name, version, dservice.Revision())
+		}
+		if fmt.Sprint(contents) != fmt.Sprint(test.contents) {
+			t.Errorf("%s: snapshot is %q, want %q", test.name, contents, test.contents)
+		}
+	}
+
+	// heartbeats dont change the resources so nothing is pushed
+	version, _ := snapshotContents(t, s)
+	if err := dservice.HeartBeat(dto.Service{Name: "orders", Url: "10.0.0.2:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.update(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := snapshotContents(t, s); got != version {
+		t.Errorf("heartbeat pushed snapshot %s over %s", got, version)
+	}
+}
+
+func TestXdsShutdownEndsStreams(t *testing.T) {
+	dservice := NewDiscoveryServiceWithInMemoryStorage()
+	if err := dservice.AddService(dto.Service{Name: "orders", Url: "10.0.0.1:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listen.Addr().String()
+	listen.Close()
+	s := newXdsServer(dservice, nil)
+	served := make(chan error, 1)
+	go func() { served <- s.ServeAddress(address) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, address, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := discoverygrpc.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Send(&discoverygrpc.DiscoveryRequest{TypeUrl: resource.ClusterType}); err != nil {
+		t.Fatal(err)
+	}
+	response, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Resources) != 1 {
+		t.Errorf("received %d clusters, want orders", len(response.Resources))
+	}
+
+	// the stream is open while the server shuts down gracefully
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown() }()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown waits for the open stream")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("ServeAddress returned %v after shutdown", err)
+	}
+	if _, err := stream.Recv(); err == nil {
+		t.Error("stream is still open after shutdown")
+	}
+}